@@ -0,0 +1,88 @@
+package tcpez
+
+import (
+	"sync/atomic"
+)
+
+// Load is how busy a Server is when a request arrives, see
+// AdmissionController.
+type Load struct {
+	// Inflight is the number of requests being handled, including the ones
+	// waiting for a MaxInflight slot.
+	Inflight int
+	// Queued is the number of requests waiting for a MaxInflight slot,
+	// always 0 without a MaxInflight.
+	Queued int
+	// Connections is the number of connections the Server has open.
+	Connections int
+}
+
+// AdmissionController decides whether a Server takes on each request, so an
+// overloaded server turns requests away straight away instead of piling
+// them up until it falls over. Admit is called before the request is
+// handled, or waits for a MaxInflight slot, and a request it returns false
+// for is answered with a CodeUnavailable error frame without its Handler
+// being called. Clients retry those, up to their Retries, which lets them
+// land on a backend that isn't overloaded. The rejected requests are counted
+// as the request.rejected stat. Pipelined requests that are rejected get an
+// empty response, like any other failed request in a pipeline.
+//
+// Admit is called concurrently, for every request, so it must be quick.
+type AdmissionController interface {
+	Admit(load Load) bool
+}
+
+// ThresholdAdmissionController is an AdmissionController that rejects the
+// requests that arrive when there are already MaxInflight requests being
+// handled, or MaxQueued of them waiting for a slot. Unlike the Server's own
+// MaxInflight, which has the requests over it wait, the requests over
+// these thresholds are turned away.
+//
+//        s.MaxInflight = 100
+//        s.AdmissionController = &tcpez.ThresholdAdmissionController{MaxQueued: 500}
+//
+type ThresholdAdmissionController struct {
+	// MaxInflight is the number of requests being handled past which new
+	// ones are rejected, 0 means no limit.
+	MaxInflight int
+	// MaxQueued is the number of requests waiting for a slot past which
+	// new ones are rejected, 0 means no limit.
+	MaxQueued int
+}
+
+// Admit fulfills the AdmissionController interface.
+func (c *ThresholdAdmissionController) Admit(load Load) bool {
+	if c.MaxInflight > 0 && load.Inflight >= c.MaxInflight {
+		return false
+	}
+	if c.MaxQueued > 0 && load.Queued >= c.MaxQueued {
+		return false
+	}
+	return true
+}
+
+// errOverloaded is what a request the AdmissionController rejected fails
+// with
+var errOverloaded = &StatusError{Code: CodeUnavailable, Message: "tcpez: server overloaded"}
+
+// load returns how busy the Server is right now
+func (s *Server) load() Load {
+	load := Load{
+		Inflight:    int(atomic.LoadInt64(&s.handling)),
+		Connections: s.NumConnections(),
+	}
+	if s.slots != nil {
+		load.Queued = s.slots.queued()
+	}
+	return load
+}
+
+// admit asks the AdmissionController, if there is one, whether to handle a
+// request
+func (s *Server) admit() bool {
+	if s.AdmissionController == nil || s.AdmissionController.Admit(s.load()) == true {
+		return true
+	}
+	s.Stats.Increment("request.rejected")
+	return false
+}
@@ -0,0 +1,71 @@
+package tcpez
+
+import (
+	"errors"
+	"github.com/bmizerany/assert"
+	"testing"
+	"time"
+)
+
+func TestThresholdAdmissionController(t *testing.T) {
+	c := &ThresholdAdmissionController{MaxInflight: 2, MaxQueued: 1}
+	assert.Equal(t, true, c.Admit(Load{}))
+	assert.Equal(t, true, c.Admit(Load{Inflight: 1}))
+	assert.Equal(t, false, c.Admit(Load{Inflight: 2}))
+	assert.Equal(t, false, c.Admit(Load{Queued: 1}))
+	c = &ThresholdAdmissionController{}
+	assert.Equal(t, true, c.Admit(Load{Inflight: 1000, Queued: 1000}))
+}
+
+func TestServerAdmissionController(t *testing.T) {
+	started := make(chan bool, 2)
+	release := make(chan bool)
+	s, err := NewServer("127.0.0.1:0", StringHandler(func(req string, span *Span) (string, error) {
+		if req == "SLOW" {
+			started <- true
+			<-release
+		}
+		return req, nil
+	}))
+	assert.T(t, err == nil)
+	stats := newTestStatsRecorder()
+	s.Stats = stats
+	s.AdmissionController = &ThresholdAdmissionController{MaxInflight: 2}
+	go s.Start()
+	defer s.Close()
+	c, _ := NewClient([]string{s.Addr().String()}, 1, time.Second)
+	assert.T(t, c != nil)
+	m, err := c.Mux()
+	assert.Equal(t, nil, err)
+	defer m.Close()
+
+	// saturate the server
+	slow := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := m.SendRecv([]byte("SLOW"))
+			slow <- err
+		}()
+		<-started
+	}
+	// the requests over the threshold are turned away rather than queued
+	var remoteErr *RemoteError
+	for i := 0; i < 3; i++ {
+		_, err = m.SendRecv([]byte("FAST"))
+		assert.T(t, errors.As(err, &remoteErr))
+		assert.Equal(t, CodeUnavailable, remoteErr.Code)
+		assert.Equal(t, "tcpez: server overloaded", remoteErr.Message)
+	}
+	_, err = c.SendRecvOpts([]byte("FAST"), WithRetries(0))
+	assert.T(t, errors.As(err, &remoteErr))
+	assert.Equal(t, CodeUnavailable, remoteErr.Code)
+	assert.Equal(t, int64(4), stats.counter("request.rejected"))
+
+	close(release)
+	assert.Equal(t, nil, <-slow)
+	assert.Equal(t, nil, <-slow)
+	// and admitted again once the load is down
+	res, err := m.SendRecv([]byte("FAST"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "FAST", string(res))
+}
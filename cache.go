@@ -0,0 +1,123 @@
+package tcpez
+
+import (
+	"container/list"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CacheMetadataKey and CacheKeyMetadataKey are the metadata keys a client
+// sends (see WithMetadata) to opt a request into the CacheMiddleware. With
+// CacheMetadataKey the response is cached by the request bytes, with
+// CacheKeyMetadataKey it's cached by the request bytes within the key given
+// as its value, so requests with different keys get separate entries (for
+// example one per version of the data they read).
+const (
+	CacheMetadataKey    = "cache"
+	CacheKeyMetadataKey = "cache-key"
+)
+
+// CacheMiddleware caches the responses of the requests that opt into it in an
+// LRU of up to size responses, each kept for ttl. A request that hits the
+// cache is answered without calling the handler. Only successful responses
+// are cached.
+//
+// The cache is only correct for requests whose response depends on nothing
+// but the request bytes, which is why requests have to opt in:
+//
+//        res, err := c.SendRecvOpts(req, tcpez.WithMetadata(tcpez.CacheMetadataKey, "true"))
+//
+// The cache is shared by every client of the Server and the metadata that
+// opts into it comes from the client, so a response that depends on who
+// sent the request (such as one checked against credentials in the
+// metadata) must never be cached: another client sending the same request
+// would be given it without the handler being called. A cache key can't be
+// used to read or replace the response to a different request, it only
+// ever narrows the entries a request can hit.
+//
+// Hits and misses are counted on the span as "cache.hit" and "cache.miss".
+// Cached responses are shared between requests and must not be modified.
+func CacheMiddleware(size int, ttl time.Duration) Middleware {
+	return func(next RequestHandler) RequestHandler {
+		cache := newResponseCache(size, ttl)
+		return RequestHandlerFunc(func(req []byte, span *Span) ([]byte, error) {
+			// the keys are prefixed so a cache key can't collide with
+			// the bytes of a request, and the cache key is length
+			// prefixed so it can't run into the request bytes after it
+			key, ok := span.Metadata[CacheKeyMetadataKey]
+			if ok == true {
+				key = "k:" + strconv.Itoa(len(key)) + ":" + key + string(req)
+			} else {
+				if _, ok = span.Metadata[CacheMetadataKey]; ok == false {
+					return next.Respond(req, span)
+				}
+				key = "r:" + string(req)
+			}
+			if res, hit := cache.get(key); hit == true {
+				span.Increment("cache.hit")
+				return res, nil
+			}
+			span.Increment("cache.miss")
+			res, err := next.Respond(req, span)
+			if err == nil && res != nil {
+				cache.set(key, res)
+			}
+			return res, err
+		})
+	}
+}
+
+// responseCache is a fixed size LRU whose entries also expire after ttl
+type responseCache struct {
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	lru     *list.List
+	sync.Mutex
+}
+
+type cacheEntry struct {
+	key      string
+	response []byte
+	expires  time.Time
+}
+
+func newResponseCache(size int, ttl time.Duration) *responseCache {
+	return &responseCache{size: size, ttl: ttl, entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+func (c *responseCache) get(key string) (response []byte, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[key]
+	if ok == false {
+		return nil, false
+	}
+	entry := e.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return entry.response, true
+}
+
+func (c *responseCache) set(key string, response []byte) {
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.entries[key]; ok == true {
+		entry := e.Value.(*cacheEntry)
+		entry.response = response
+		entry.expires = time.Now().Add(c.ttl)
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, response: response, expires: time.Now().Add(c.ttl)})
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
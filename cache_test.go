@@ -0,0 +1,68 @@
+package tcpez
+
+import (
+	"github.com/bmizerany/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheMiddleware(t *testing.T) {
+	var calls int32
+	handler := RequestHandlerFunc(func(req []byte, span *Span) ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		return req, nil
+	})
+	l, addr := newTestServer(CacheMiddleware(10, time.Minute)(handler))
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	for i := 0; i < 2; i++ {
+		res, err := c.SendRecvOpts([]byte("PING"), WithMetadata(CacheMetadataKey, "true"))
+		assert.T(t, err == nil)
+		assert.Equal(t, "PING", string(res))
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	// requests that don't opt in always reach the handler
+	c.SendRecv([]byte("PING"))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	// an explicit key gets its own entry for the request
+	res, _ := c.SendRecvOpts([]byte("PING"), WithMetadata(CacheKeyMetadataKey, "v1"))
+	assert.Equal(t, "PING", string(res))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	res, _ = c.SendRecvOpts([]byte("PING"), WithMetadata(CacheKeyMetadataKey, "v1"))
+	assert.Equal(t, "PING", string(res))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	// but it can't be used to read another request's response
+	res, _ = c.SendRecvOpts([]byte("PONG"), WithMetadata(CacheKeyMetadataKey, "v1"))
+	assert.Equal(t, "PONG", string(res))
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+	// or one cached by its bytes alone
+	res, _ = c.SendRecvOpts([]byte("PING"), WithMetadata(CacheKeyMetadataKey, ""))
+	assert.Equal(t, "PING", string(res))
+	assert.Equal(t, int32(5), atomic.LoadInt32(&calls))
+	// and the key can't run into the request bytes
+	res, _ = c.SendRecvOpts([]byte("1PING"), WithMetadata(CacheKeyMetadataKey, "v"))
+	assert.Equal(t, "1PING", string(res))
+	assert.Equal(t, int32(6), atomic.LoadInt32(&calls))
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	cache := newResponseCache(2, time.Minute)
+	cache.set("a", []byte("A"))
+	cache.set("b", []byte("B"))
+	cache.get("a")
+	cache.set("c", []byte("C"))
+	// b was the least recently used
+	_, ok := cache.get("b")
+	assert.T(t, !ok)
+	res, ok := cache.get("a")
+	assert.T(t, ok)
+	assert.Equal(t, "A", string(res))
+
+	cache = newResponseCache(2, time.Millisecond)
+	cache.set("a", []byte("A"))
+	time.Sleep(2 * time.Millisecond)
+	_, ok = cache.get("a")
+	assert.T(t, !ok)
+}
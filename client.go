@@ -11,6 +11,7 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -18,9 +19,132 @@ import (
 type Client struct {
 	pool      *ConnectionPool
 	Addresses []string
-	Retries   int
+	// Retries is the number of times a request is retried after the first
+	// attempt fails with a retryable (connection) error, or the server
+	// answers it with a Code that's Retryable. Defaults to 2, a negative
+	// value is the same as 0.
+	Retries int
+	// Stats is where the client's stats are sent, like the Server's it is
+	// the DebugStatsRecorder by default. Each request made with SendRecv
+	// (or its variants) is timed as "client.request" and counted as
+	// "client.request.success" or "client.request.failure". Connections
+	// taken from the pool are counted as "client.pool.take", and the ones
+	// that had to be dialed as "client.pool.dial". Every retry is counted as
+	// "client.retry" and "client.retry.<reason>".
+	Stats StatsRecorder
+	// UUIDGenerator generates the ids of the client side Spans, see
+	// RequestInfo.
+	UUIDGenerator UUIDGenerator
+	// MaxConcurrentRequests limits the number of requests (SendRecv or
+	// SendRecvBatch calls) in flight at once. Requests over the limit fail
+	// straight away with ErrClientOverloaded instead of piling up waiting
+	// for connections. 0 means no limit.
+	MaxConcurrentRequests int
+	// Shedder, if set, fails some of the requests to a backend fast when
+	// the backend gets slower than usual, see LoadShedder.
+	Shedder      *LoadShedder
+	interceptors []Interceptor
+	inflight     int32
 }
 
+// ErrClientOverloaded is returned when a request is made while the Client
+// already has MaxConcurrentRequests requests in flight.
+var ErrClientOverloaded = errors.New("tcpez: client overloaded")
+
+// ErrTimeout is matched (with errors.Is) by the errors of requests that hit
+// their deadline.
+var ErrTimeout = errors.New("tcpez: timeout")
+
+// ErrAllRetriesFailed is matched (with errors.Is) by the errors of requests
+// that were retried and failed every time. The error of the last attempt is
+// wrapped inside it.
+var ErrAllRetriesFailed = errors.New("tcpez: all retries failed")
+
+// ErrRemoteTimeout is matched (with errors.Is) by the error of a request the
+// server's handler didn't answer within the server's HandlerTimeout.
+var ErrRemoteTimeout = errors.New("tcpez: remote handler timed out")
+
+// RemoteError is the error of a request the server answered with an error
+// instead of a response, because its handler timed out or returned a
+// StatusError. The connection the request was made on is still usable, so it
+// goes back into the pool.
+//
+//        _, err := c.SendRecv(req)
+//        var remoteErr *tcpez.RemoteError
+//        if errors.As(err, &remoteErr) && remoteErr.Code == tcpez.CodeNotFound {
+//                // create it
+//        }
+//
+type RemoteError struct {
+	Code    Code
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "tcpez: remote error: " + e.Code.String() + ": " + e.Message
+}
+
+// Is lets a RemoteError for a timed out handler match ErrRemoteTimeout.
+func (e *RemoteError) Is(target error) bool {
+	return target == ErrRemoteTimeout && e.Code == CodeDeadlineExceeded
+}
+
+// RequestError is the error of a failed request. Kind is one of the client's
+// Err* values and Err is what actually went wrong, both can be matched with
+// errors.Is.
+//
+//        _, err := c.SendRecv(req)
+//        if errors.Is(err, tcpez.ErrTimeout) {
+//                // maybe back off
+//        }
+//
+type RequestError struct {
+	Kind error
+	Err  error
+}
+
+func (e *RequestError) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+func (e *RequestError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Timeout and Temporary make a RequestError a net.Error, so callers that
+// type assert the errors of timed out requests keep working.
+func (e *RequestError) Timeout() bool {
+	var netErr net.Error
+	return errors.As(e.Err, &netErr) && netErr.Timeout()
+}
+
+func (e *RequestError) Temporary() bool {
+	var netErr net.Error
+	return errors.As(e.Err, &netErr) && netErr.Temporary()
+}
+
+// requestError classifies the error a request failed with, retried is true
+// when it was the last of several attempts that all failed
+func requestError(err error, retried bool) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		err = &RequestError{Kind: ErrTimeout, Err: err}
+	}
+	if retried == true {
+		err = &RequestError{Kind: ErrAllRetriesFailed, Err: err}
+	}
+	return err
+}
+
+// An Interceptor wraps the requests made with SendRecv (and its variants). It
+// can change the request, the response or the error, and calls next to send
+// the request on.
+type Interceptor func(req []byte, next func([]byte) ([]byte, error)) ([]byte, error)
+
 // Create a new Client to connect and load balance between a pool of addresses
 // given as a slice of strings in "host:port" format (the same format that net.Dial
 // uses for the underlying connections. poolInit and poolMax set the initial connection
@@ -32,7 +156,69 @@ func NewClient(addresses []string, poolInit int, timeout time.Duration) (client
 		log.Error(err.Error())
 		return nil, err
 	}
-	return &Client{pool: pool, Addresses: addresses, Retries: 3}, nil
+	return &Client{pool: pool, Addresses: addresses, Retries: 2, Stats: new(DebugStatsRecorder), UUIDGenerator: DefaultUUIDGenerator}, nil
+}
+
+// NewResolvingClient creates a Client that load balances between the addresses
+// name resolves to through resolver, re-resolving every refresh. Connections to
+// addresses that disappear are dropped from the pool.
+//
+//        c, err := tcpez.NewResolvingClient("backends.local:2222", new(tcpez.DNSResolver), time.Minute, 3, 3*time.Second)
+//
+func NewResolvingClient(name string, resolver Resolver, refresh time.Duration, poolInit int, timeout time.Duration) (client *Client, err error) {
+	pool, err := NewResolvingConnectionPool(name, resolver, refresh, poolInit, timeout)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	return &Client{pool: pool, Addresses: []string{name}, Retries: 2, Stats: new(DebugStatsRecorder), UUIDGenerator: DefaultUUIDGenerator}, nil
+}
+
+// NewClientWithPool creates a Client that uses a ConnectionPool that has
+// already been set up, for example with a custom Dialer.
+//
+//        pool, _ := tcpez.NewConnectionPool([]string{"localserver:2222"}, 0, time.Second)
+//        pool.Dialer = proxyDialer
+//        c := tcpez.NewClientWithPool(pool)
+//
+func NewClientWithPool(pool *ConnectionPool) (client *Client) {
+	return &Client{pool: pool, Addresses: pool.Addresses, Retries: 2, Stats: new(DebugStatsRecorder), UUIDGenerator: DefaultUUIDGenerator}
+}
+
+// ErrConnClosed is returned by a Client created with NewClientFromConn once
+// its connection has been closed, after an error on it for example, since it
+// has no way of opening another.
+var ErrConnClosed = errors.New("tcpez: connection closed")
+
+// NewClientFromConn creates a Client that makes its requests over conn
+// rather than dialing connections of its own, so tcpez can be spoken over a
+// connection that's already been set up, like a tunnel. The handshake happens
+// on the first request. Requests are made one at a time and aren't retried,
+// and once the connection fails the Client fails with ErrConnClosed.
+//
+//        conn, _ := tunnel.Dial("backend:2222")
+//        c := tcpez.NewClientFromConn(conn)
+//        resp, err := c.SendRecv([]byte("PING"))
+//
+func NewClientFromConn(conn net.Conn) (client *Client) {
+	pool, _ := NewConnectionPool([]string{conn.RemoteAddr().String()}, 0, DefaultRequestTimeout)
+	pool.MaxActive = 1
+	var dialed int32
+	pool.Dialer = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		if atomic.CompareAndSwapInt32(&dialed, 0, 1) == false {
+			return nil, ErrConnClosed
+		}
+		return conn, nil
+	}
+	client = NewClientWithPool(pool)
+	client.Retries = 0
+	return client
+}
+
+// Close closes the Client's pooled connections and stops refreshing its
+// addresses. Requests made after Close fail with ErrPoolClosed.
+func (c *Client) Close() error {
+	return c.pool.Close()
 }
 
 // Pipeline returns a new pipeline for sending requests. These requests are kept in
@@ -59,75 +245,491 @@ func (c *Client) Pipeline() *Pipeline {
 //        resp //=> []byte{"PONG"}
 //
 func (c *Client) SendRecv(req []byte) (res []byte, err error) {
-	for tries := 1; tries <= c.Retries; tries++ {
-		conn, err := c.pool.Take()
-		if err != nil && tries < c.Retries {
-			continue
-		}
-		// Timeout the connection after 10 seconds
-		conn.SetDeadline(time.Now().Add(10 * time.Second))
-		_, err = c.sendRequest(conn, req)
+	return c.SendRecvOpts(req)
+}
+
+// SendRecvString is SendRecv for text protocols, see StringHandler.
+//
+//        resp, err := c.SendRecvString("PING")
+//        resp //=> "PONG"
+//
+func (c *Client) SendRecvString(req string) (res string, err error) {
+	b, err := c.SendRecv([]byte(req))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// RequestInfo describes how a request made with SendRecvWithInfo was served.
+type RequestInfo struct {
+	// Retries is the number of times the request was retried before it
+	// succeeded (or finally failed)
+	Retries int
+	// Dialed is true if the connection that served the request had to be
+	// dialed instead of being taken from the pool
+	Dialed bool
+	// Backend is the address of the server that served the request
+	Backend string
+	// Span is the client side Span of the request, with the time spent
+	// taking a connection, writing the request and reading the response as
+	// the "client.take", "client.write" and "client.read" SubSpans.
+	Span *Span
+}
+
+// SendRecvWithInfo is SendRecv that also reports how the request was served,
+// which is useful for diagnosing connection churn and pool efficiency.
+func (c *Client) SendRecvWithInfo(req []byte) (res []byte, info RequestInfo, err error) {
+	return c.sendRecv(req, c.newRequestOptions(nil))
+}
+
+// SendRecvRetries is SendRecv with the number of retries overridden for this
+// request. Pass 0 for requests that are not safe to send twice, the request
+// then fails on the first error.
+func (c *Client) SendRecvRetries(req []byte, retries int) (res []byte, err error) {
+	return c.SendRecvOpts(req, WithRetries(retries))
+}
+
+// SendRecvOpts is SendRecv with per request Options, e.g. to set a timeout
+// or send metadata along with the request.
+//
+//        resp, err := c.SendRecvOpts([]byte("PING"), tcpez.WithTimeout(time.Second), tcpez.WithMetadata("user", "bob"))
+//
+func (c *Client) SendRecvOpts(req []byte, opts ...Option) (res []byte, err error) {
+	res, _, err = c.sendRecv(req, c.newRequestOptions(opts))
+	return res, err
+}
+
+// SendRecvBatch sends independent requests together in a single pipeline and
+// returns their responses in the same order. If the connection fails part way
+// through, the requests that weren't answered are retried on a fresh
+// connection (up to Retries times) and the responses put back together. Like
+// SendRecv this means requests may be sent twice, so they need to be
+// idempotent, set Retries to 0 if they aren't.
+//
+//        responses, err := c.SendRecvBatch([][]byte{[]byte("PING1"), []byte("PING2")})
+//        responses //=> [[]byte{"PONG1"}, []byte{"PONG2"}]
+//
+func (c *Client) SendRecvBatch(reqs [][]byte) (responses [][]byte, err error) {
+	responses = make([][]byte, 0, len(reqs))
+	if len(reqs) == 0 {
+		return responses, nil
+	}
+	err = c.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer c.release()
+	for tries := 0; ; tries++ {
+		res, err := c.sendBatch(reqs[len(responses):])
+		responses = append(responses, res...)
+		if err == nil {
+			return responses, nil
+		}
+		if tries >= c.Retries || retryableError(err) == false {
+			return nil, requestError(err, tries > 0 && retryableError(err))
+		}
+		log.Debug("Retrying %d of %d batched requests: %s", len(reqs)-len(responses), len(reqs), err.Error())
+		c.recordRetry(err)
+	}
+}
+
+// sendBatch sends reqs as a pipeline on one connection. On error it returns
+// the responses that were read before it along with the error.
+func (c *Client) sendBatch(reqs [][]byte) (responses [][]byte, err error) {
+	conn, err := c.pool.Take()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(DefaultRequestTimeout))
+	// the requests are written straight from reqs with one writev
+	headers := make([]byte, 4*len(reqs))
+	buffers := make(net.Buffers, 0, 2*len(reqs)+1)
+	buffers = append(buffers, pipelineHeader(conn, int32(len(reqs))))
+	for i, req := range reqs {
+		header := headers[4*i : 4*(i+1)]
+		binary.BigEndian.PutUint32(header, uint32(len(req)))
+		buffers = append(buffers, header, req)
+	}
+	_, err = buffers.WriteTo(conn.Conn)
+	if err != nil {
+		c.pool.Discard(conn)
+		return nil, err
+	}
+	err = readPipelineHeader(conn, int32(len(reqs)))
+	if err != nil {
+		c.pool.Discard(conn)
+		return nil, err
+	}
+	responses = make([][]byte, 0, len(reqs))
+	for range reqs {
+		res, err := readDataWithLength(conn)
 		if err != nil {
-			if retryableError(err) && tries < c.Retries {
+			c.pool.Discard(conn)
+			return responses, err
+		}
+		responses = append(responses, res)
+	}
+	c.pool.Return(conn)
+	return responses, nil
+}
+
+// Use adds an interceptor around every request made with SendRecv (and its
+// variants), for cross cutting concerns like authentication or logging.
+// Interceptors run in the order they were added, the first one added is the
+// outermost. Use isn't safe to call while the Client is making requests,
+// add interceptors before sharing it.
+//
+//        c.Use(func(req []byte, next func([]byte) ([]byte, error)) ([]byte, error) {
+//                return next(append([]byte("token:"), req...))
+//        })
+//
+func (c *Client) Use(interceptor Interceptor) {
+	c.interceptors = append(c.interceptors, interceptor)
+}
+
+func (c *Client) sendRecv(req []byte, o *requestOptions) (res []byte, info RequestInfo, err error) {
+	err = c.acquire()
+	if err != nil {
+		return nil, info, err
+	}
+	defer c.release()
+	if len(c.interceptors) == 0 {
+		return c.roundTrip(req, o)
+	}
+	send := func(req []byte) (res []byte, err error) {
+		res, info, err = c.roundTrip(req, o)
+		return res, err
+	}
+	for i := len(c.interceptors) - 1; i >= 0; i-- {
+		interceptor, next := c.interceptors[i], send
+		send = func(req []byte) ([]byte, error) {
+			return interceptor(req, next)
+		}
+	}
+	res, err = send(req)
+	return res, info, err
+}
+
+// acquire counts a request as in flight, failing if that takes the client
+// over MaxConcurrentRequests
+func (c *Client) acquire() error {
+	n := atomic.AddInt32(&c.inflight, 1)
+	if c.MaxConcurrentRequests > 0 && int(n) > c.MaxConcurrentRequests {
+		atomic.AddInt32(&c.inflight, -1)
+		c.Stats.Increment("client.request.overloaded")
+		return ErrClientOverloaded
+	}
+	return nil
+}
+
+func (c *Client) release() {
+	atomic.AddInt32(&c.inflight, -1)
+}
+
+// SendRecvMulti sends a request to a server whose handler is a
+// MultiRequestHandler and returns the frames of its response separately. A
+// StreamRequestHandler's response is read to its end, and a response from
+// any other handler is a single frame. The Client's
+// Interceptors are not applied to it.
+//
+//        frames, err := c.SendRecvMulti([]byte("SEARCH cats"))
+//        frames //=> [[]byte{"page 1"}, []byte{"page 2"}, []byte{"page 3"}]
+//
+func (c *Client) SendRecvMulti(req []byte) (frames [][]byte, err error) {
+	err = c.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer c.release()
+	_, err = c.exchange(req, c.newRequestOptions(nil), func(conn *PooledConn) (err error) {
+		frames, err = readMultiResponse(conn, conn.features)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return frames, nil
+}
+
+// SendRecvStream sends a request to a server whose handler is a
+// StreamRequestHandler and calls fn with each frame of its response as soon
+// as it arrives, rather than once the handler is done. It returns once the
+// stream has ended, with the RemoteError the handler failed with if it did.
+// The timeout applies to the wait for each frame, not to the whole stream.
+// If fn returns an error the rest of the stream is abandoned, along with
+// its connection, and SendRecvStream returns it. Streams aren't retried,
+// the frames already passed to fn can't be taken back. Of the Options
+// WithTimeout, WithBackend, WithMetadata and WithCompression apply to it.
+// The Client's Interceptors are not applied to it.
+//
+//        err := c.SendRecvStream([]byte("SEARCH cats"), func(frame []byte) error {
+//                fmt.Println(string(frame))
+//                return nil
+//        })
+//
+func (c *Client) SendRecvStream(req []byte, fn func(frame []byte) error, opts ...Option) (err error) {
+	err = c.acquire()
+	if err != nil {
+		return err
+	}
+	defer c.release()
+	o := c.newRequestOptions(opts)
+	o.retries = 0
+	_, err = c.exchange(req, o, func(conn *PooledConn) (err error) {
+		for {
+			frame, more, err := readStreamedFrame(conn, conn.features)
+			if err != nil || more == false {
+				return err
+			}
+			err = fn(frame)
+			if err != nil {
+				return err
+			}
+			conn.SetDeadline(time.Now().Add(o.timeout))
+		}
+	})
+	return err
+}
+
+// SendAndForget sends a one-way request, for requests whose response isn't
+// needed like log lines or metrics. It returns as soon as the request is
+// written, without waiting on the server, which handles it and answers
+// nothing. That also means a request that fails on the server goes
+// unnoticed. Of the Options WithTimeout, WithRetries, WithBackend,
+// WithMetadata and WithCompression apply to it. The Client's Interceptors
+// are not applied to it.
+//
+//        err := c.SendAndForget([]byte("LOG user signed in"))
+//
+// A server that doesn't support one-way requests is sent an ordinary
+// request instead, and its response is read and thrown away.
+func (c *Client) SendAndForget(req []byte, opts ...Option) (err error) {
+	err = c.acquire()
+	if err != nil {
+		return err
+	}
+	defer c.release()
+	o := c.newRequestOptions(opts)
+	o.oneWay = true
+	_, err = c.exchange(req, o, func(conn *PooledConn) (err error) {
+		if conn.features&featureOneWay == 0 {
+			_, err = c.readResponse(conn)
+		}
+		return err
+	})
+	return err
+}
+
+// roundTrip sends a request and reads its response, retrying on connection
+// errors
+func (c *Client) roundTrip(req []byte, o *requestOptions) (res []byte, info RequestInfo, err error) {
+	info, err = c.exchange(req, o, func(conn *PooledConn) (err error) {
+		res, err = c.readResponse(conn)
+		return err
+	})
+	if err != nil {
+		return nil, info, err
+	}
+	return res, info, nil
+}
+
+// exchange is roundTrip with the response read by read
+func (c *Client) exchange(req []byte, o *requestOptions, read func(*PooledConn) error) (info RequestInfo, err error) {
+	started := time.Now()
+	span := NewSpan(c.UUIDGenerator())
+	span.Stats = c.Stats
+	info.Span = span
+	defer func() {
+		c.Stats.DurationTimer("client.request", started, time.Now())
+		if err != nil {
+			c.Stats.Increment("client.request.failure")
+		} else {
+			c.Stats.Increment("client.request.success")
+		}
+		span.Attr("backend", info.Backend)
+		log.Debug("%s", span.JSON())
+		span.Record()
+	}()
+	retries := o.retries
+	if retries < 0 {
+		// the request is still sent once
+		retries = 0
+	}
+	for tries := 0; tries <= retries; tries++ {
+		info.Retries = tries
+		span.Start("client.take")
+		conn, dialed, err := c.pool.take(o.backend)
+		span.Finish("client.take")
+		if err != nil {
+			if err != ErrPoolClosed && tries < retries {
+				c.recordRetry(err)
+				continue
+			}
+			return info, requestError(err, tries > 0)
+		}
+		c.Stats.Increment("client.pool.take")
+		if dialed == true {
+			c.Stats.Increment("client.pool.dial")
+		}
+		info.Dialed = dialed
+		info.Backend = conn.Address
+		if c.Shedder != nil && c.Shedder.shed(conn.Address) == true {
+			c.pool.Return(conn)
+			c.Stats.Increment("client.request.shed")
+			return info, ErrLoadShed
+		}
+		conn.SetDeadline(time.Now().Add(o.timeout))
+		span.Start("client.write")
+		_, err = c.sendRequest(conn, req, o)
+		span.Finish("client.write")
+		if err != nil {
+			c.pool.Discard(conn)
+			if retryableError(err) && tries < retries {
+				c.recordRetry(err)
 				continue
 			} else {
-				return nil, err
+				return info, requestError(err, tries > 0 && retryableError(err))
 			}
 		}
-		res, err = c.readResponse(conn)
+		span.Start("client.read")
+		err = read(conn)
+		span.Finish("client.read")
+		var remoteErr *RemoteError
+		if errors.As(err, &remoteErr) {
+			// the server answered, just not with a response
+			c.pool.Return(conn)
+			if remoteErr.Code.Retryable() && tries < retries {
+				c.recordRetry(err)
+				continue
+			}
+			return info, requestError(err, tries > 0 && remoteErr.Code.Retryable())
+		}
 		if err != nil {
-			if retryableError(err) && tries < c.Retries {
+			c.pool.Discard(conn)
+			if retryableError(err) && tries < retries {
+				c.recordRetry(err)
 				continue
 			} else {
-				return nil, err
+				return info, requestError(err, tries > 0 && retryableError(err))
 			}
 		}
+		if c.Shedder != nil {
+			c.Shedder.observe(conn.Address, span.Duration("client.write")+span.Duration("client.read"))
+		}
 		// if theres no error, return it to the pool
 		c.pool.Return(conn)
-		return res, err
+		return info, nil
 	}
 	return
 }
 
 func retryableError(err error) bool {
-	// some crazy magic to get to the inner realm of the error and check
-	// what type of error this is. Is this really necessary?
-	if err, ok := err.(*net.OpError); ok == true {
-		e := err.Err
-		return e == syscall.EPIPE || e == syscall.ECONNREFUSED || e == syscall.ECONNRESET || e == syscall.EHOSTUNREACH
+	// the syscall error is wrapped in a *net.OpError (and usually an
+	// *os.SyscallError inside that) so unwrap it to check what type of
+	// error this is
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		e := opErr.Err
+		return errors.Is(e, syscall.EPIPE) || errors.Is(e, syscall.ECONNREFUSED) || errors.Is(e, syscall.ECONNRESET) || errors.Is(e, syscall.EHOSTUNREACH)
 	}
-	if err == io.EOF {
+	if err == io.EOF || errors.Is(err, ErrChecksumMismatch) {
 		return true
 	}
 	return false
 }
 
-func (c *Client) sendRequest(conn net.Conn, data []byte) (length int, err error) {
-	if err != nil {
-		return length, err
+func (c *Client) recordRetry(err error) {
+	c.Stats.Increment("client.retry")
+	c.Stats.Increment("client.retry." + retryReason(err))
+}
+
+// retryReason names the error a request is being retried for in stats
+func retryReason(err error) string {
+	switch {
+	case err == io.EOF:
+		return "eof"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connection_reset"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection_refused"
+	case errors.Is(err, syscall.EPIPE):
+		return "broken_pipe"
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return "host_unreachable"
+	case errors.Is(err, ErrPoolExhausted):
+		return "pool_exhausted"
+	case errors.Is(err, ErrChecksumMismatch):
+		return "checksum_mismatch"
 	}
-	length, err = writeDataWithLength(data, conn)
+	var remoteErr *RemoteError
+	if errors.As(err, &remoteErr) {
+		switch remoteErr.Code {
+		case CodeUnavailable:
+			return "unavailable"
+		case CodeResourceExhausted:
+			return "resource_exhausted"
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	return "other"
+}
+
+func (c *Client) sendRequest(conn *PooledConn, data []byte, o *requestOptions) (length int, err error) {
+	if o.oneWay == true && conn.features&featureOneWay != 0 {
+		err = writeControl(controlOneWay, conn)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(o.metadata) > 0 {
+		err = writeMetadata(o.metadata, conn)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if o.codec != CodecNone && conn.features&featureCompression != 0 && len(data) >= compressionMinLength {
+		codec := o.codec
+		if conn.features&featureCodecs == 0 {
+			// the server only knows gzip
+			codec = CodecGzip
+		}
+		data, err = codec.compress(data)
+		if err != nil {
+			return 0, err
+		}
+		_, err = conn.Write(codecFrame(codec))
+		if err != nil {
+			return 0, err
+		}
+	}
+	length, err = writeFrame(data, conn, conn.features)
 	return length, err
 }
 
-func (c *Client) readResponse(conn net.Conn) (response []byte, err error) {
-	response, err = readDataWithLength(conn)
+func (c *Client) readResponse(conn *PooledConn) (response []byte, err error) {
+	response, err = readResponse(conn, conn.features)
 	if err != nil {
 		return nil, err
 	}
 	return
 }
 
+// writeDataWithLength writes data with its length header in front. They are
+// written together as net.Buffers, which is a single writev on a connection,
+// rather than copying the data to put the header in front of it.
 func writeDataWithLength(data []byte, buf io.Writer) (length int, err error) {
-	err = binary.Write(buf, binary.BigEndian, int32(len(data)))
-	if err != nil {
-		return 0, err
-	}
-	n, err := buf.Write(data)
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(data)))
+	buffers := net.Buffers{header[:], data}
+	n, err := buffers.WriteTo(unwrapConn(buf))
 	if err != nil {
 		return 0, err
 	}
-	return n, nil
+	return int(n) - len(header), nil
 }
 
 func readDataWithLength(conn io.Reader) (data []byte, err error) {
@@ -136,6 +738,9 @@ func readDataWithLength(conn io.Reader) (data []byte, err error) {
 	if err != nil {
 		return nil, err
 	}
+	if size < 0 {
+		return nil, fmt.Errorf("%w: invalid frame length %d", ErrProtocol, size)
+	}
 	data = make([]byte, size)
 	_, err = io.ReadFull(conn, data)
 	if err != nil {
@@ -144,6 +749,60 @@ func readDataWithLength(conn io.Reader) (data []byte, err error) {
 	return
 }
 
+// ErrPipelineCountMismatch is returned when the server answers a pipeline with
+// a different number of responses than requests were sent. It matches
+// ErrProtocol too.
+var ErrPipelineCountMismatch = fmt.Errorf("%w: mismatched number of responses for pipeline request", ErrProtocol)
+
+// ErrPipelineDesync is returned when what the client reads back after sending
+// a pipeline isn't the responses to it, because they are another pipeline's
+// that were left on the connection or the pipeline's header was corrupted
+// on the way, rather than the server answering with the wrong number of
+// responses (ErrPipelineCountMismatch). Only servers that agree to pipeline
+// digests in the handshake are checked for it. It matches ErrProtocol too.
+var ErrPipelineDesync = fmt.Errorf("%w: pipeline responses out of step", ErrProtocol)
+
+// pipelineHeader returns the header of a pipeline of count requests on conn,
+// along with the pipelineDigest in front of it if the server agreed to them
+func pipelineHeader(conn *PooledConn, count int32) []byte {
+	var header []byte
+	if conn.features&featurePipelineDigest != 0 {
+		conn.pipelines++
+		header = digestFrame(pipelineDigest{sequence: conn.pipelines, count: count})
+	}
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(-count))
+	return append(header, length[:]...)
+}
+
+// readPipelineHeader reads the header of the responses to the last pipeline
+// of count requests sent on conn, and checks that they are its responses
+func readPipelineHeader(conn *PooledConn, count int32) (err error) {
+	var responseCount int32
+	if conn.features&featurePipelineDigest == 0 {
+		err = binary.Read(conn, binary.BigEndian, &responseCount)
+	} else {
+		var info frameInfo
+		responseCount, info, err = readHeader(conn)
+		switch {
+		case err != nil:
+		case info.digest == nil:
+			err = fmt.Errorf("%w: no digest in front of the responses", ErrPipelineDesync)
+		case info.digest.sequence != conn.pipelines:
+			err = fmt.Errorf("%w: got the responses to pipeline %d, expected %d", ErrPipelineDesync, info.digest.sequence, conn.pipelines)
+		case info.digest.count != count:
+			err = fmt.Errorf("%w: the server read %d requests, %d were sent", ErrPipelineDesync, info.digest.count, count)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if -responseCount != count {
+		return fmt.Errorf("%w, expected %d, got %d", ErrPipelineCountMismatch, count, -responseCount)
+	}
+	return nil
+}
+
 type Pipeline struct {
 	client *Client
 	buf    *bytes.Buffer
@@ -172,30 +831,59 @@ func (p *Pipeline) Send(req []byte) error {
 // Flush actually delivers all the buffered request data to the connection. It then
 // blocks waiting for all the responses from the server. These requests are returned
 // in order and stored in an slice and returned as responses
+//
+// If the connection fails the whole batch is sent again on a fresh connection,
+// up to the Client's Retries times. Requests that were already handled are
+// handled again, so like with SendRecv they need to be idempotent, set
+// Retries to 0 if they aren't.
+//
+// When the last try fails after some of the responses were read, like when
+// the connection drops partway through them, those responses are returned
+// along with the error, in order, so the requests they answer needn't be
+// sent again.
 func (p *Pipeline) Flush() (responses [][]byte, err error) {
+	for tries := 0; ; tries++ {
+		responses, err = p.flush()
+		if err == nil {
+			return responses, nil
+		}
+		if tries >= p.client.Retries || retryableError(err) == false {
+			return responses, requestError(err, tries > 0 && retryableError(err))
+		}
+		log.Debug("Retrying pipeline of %d requests: %s", p.count, err.Error())
+		p.client.recordRetry(err)
+	}
+}
+
+// flush sends the batch on a connection from the pool and reads its responses
+func (p *Pipeline) flush() (responses [][]byte, err error) {
 	conn, err := p.client.pool.Take()
 	if err != nil {
 		return nil, err
 	}
-	// Write the initial byte as -the count of the messages
-	err = binary.Write(conn, binary.BigEndian, int32(-p.count))
+	// Write the initial byte as -the count of the messages, then flush the
+	// whole buffer behind it
+	buffers := net.Buffers{pipelineHeader(conn, p.count), p.buf.Bytes()}
+	_, err = buffers.WriteTo(conn.Conn)
 	if err != nil {
+		p.client.pool.Discard(conn)
 		return nil, err
 	}
-	// Flush the whole buffer
-	conn.Write(p.buf.Bytes())
-	var responseCount int32
-	err = binary.Read(conn, binary.BigEndian, &responseCount)
+	err = readPipelineHeader(conn, p.count)
 	if err != nil {
+		// the responses on the connection can't be matched up with the
+		// requests anymore, so it can't go back in the pool
+		p.client.pool.Discard(conn)
 		return nil, err
 	}
-	if -responseCount != p.count {
-		return nil, errors.New(fmt.Sprintf("Mismatched number of responses for pipeline request. Expected %d, got %d", p.count, -responseCount))
-	}
-	responses = make([][]byte, -responseCount)
-	for i := int32(0); i < -responseCount; i++ {
-		responses[i], err = readDataWithLength(conn)
+	for i := int32(0); i < p.count; i++ {
+		res, err := readDataWithLength(conn)
+		if err != nil {
+			p.client.pool.Discard(conn)
+			return responses, err
+		}
+		responses = append(responses, res)
 	}
 	p.client.pool.Return(conn)
-	return
+	return responses, nil
 }
@@ -0,0 +1,94 @@
+package tcpez
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// A Codec is a compression algorithm a request can be sent with, see
+// WithCompression. Responses are always gzipped.
+type Codec byte
+
+const (
+	// CodecNone sends the request uncompressed.
+	CodecNone Codec = 0
+	// CodecGzip gzips the request, for a good ratio.
+	CodecGzip Codec = 1
+	// CodecFlate compresses the request with DEFLATE at its fastest level
+	// and without gzip's header and checksum, for latency sensitive
+	// requests that are still worth compressing.
+	CodecFlate Codec = 2
+)
+
+var codecNames = map[Codec]string{
+	CodecNone:  "none",
+	CodecGzip:  "gzip",
+	CodecFlate: "flate",
+}
+
+func (c Codec) String() string {
+	if name, ok := codecNames[c]; ok == true {
+		return name
+	}
+	return fmt.Sprintf("Codec(%d)", byte(c))
+}
+
+func (c Codec) compress(data []byte) (compressed []byte, err error) {
+	switch c {
+	case CodecGzip:
+		return compress(data)
+	case CodecFlate:
+		buf := bytes.NewBuffer(nil)
+		w, err := flate.NewWriter(buf, flate.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+		_, err = w.Write(data)
+		if err != nil {
+			return nil, err
+		}
+		err = w.Close()
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("tcpez: can't compress with %s", c)
+}
+
+// decompress fails with errDecompressedTooLarge once the data inflates past
+// limit bytes, a limit of 0 means no limit
+func (c Codec) decompress(compressed []byte, limit int64) (data []byte, err error) {
+	switch c {
+	case CodecGzip:
+		return decompress(compressed, limit)
+	case CodecFlate:
+		r := flate.NewReader(bytes.NewReader(compressed))
+		defer r.Close()
+		return readDecompressed(r, limit)
+	}
+	return nil, fmt.Errorf("%w: unknown codec %d", ErrProtocol, byte(c))
+}
+
+// errDecompressedTooLarge is what decompressing fails with when the data
+// inflates past the limit
+var errDecompressedTooLarge = errors.New("tcpez: decompressed data too large")
+
+// readDecompressed reads r to the end, or fails with errDecompressedTooLarge
+// as soon as it has read more than limit bytes, a limit of 0 means no limit
+func readDecompressed(r io.Reader, limit int64) (data []byte, err error) {
+	if limit <= 0 {
+		return io.ReadAll(r)
+	}
+	data, err = io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, errDecompressedTooLarge
+	}
+	return data, nil
+}
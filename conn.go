@@ -1,59 +1,473 @@
 package tcpez
 
 import (
+	"bufio"
+	"errors"
+	"io"
 	"math/rand"
 	"net"
 	"sync"
 	"time"
 )
 
+// ErrPoolClosed is returned when taking a connection from a ConnectionPool
+// that has been closed.
+var ErrPoolClosed = errors.New("tcpez: connection pool closed")
+
+// ErrPoolExhausted is returned when Take has waited MaxWait for a connection
+// and none became available.
+var ErrPoolExhausted = errors.New("tcpez: connection pool exhausted")
+
+// ErrNoAddresses is returned when creating a ConnectionPool (or a Client)
+// without any addresses to connect to.
+var ErrNoAddresses = errors.New("tcpez: no addresses to connect to")
+
+// ConnectionPool keeps a sub-pool of idle connections for each of its
+// Addresses. Keeping the connections grouped by the backend they were dialed
+// to lets the pool prefer backends it already has open connections to, and
+// lets Return put a connection back where it belongs.
 type ConnectionPool struct {
 	Addresses []string
 	Initial   int
 	Timeout   time.Duration
-	conns     []net.Conn
+	// MaxActive limits the number of connections, idle or checked out, the
+	// pool keeps open. When it is reached Take never dials past it, it
+	// blocks until a connection is returned or discarded (or MaxWait
+	// passes), and the waiting goroutines are served in the order they
+	// started waiting. 0 means no limit.
+	MaxActive int
+	// MaxWait limits how long Take blocks when MaxActive is reached before
+	// giving up with ErrPoolExhausted. 0 means Take blocks until a
+	// connection is available.
+	MaxWait time.Duration
+	// Dialer opens the pool's connections, net.DialTimeout by default. Set
+	// it to dial through a proxy, from a specific source address or to an
+	// in-memory connection in tests. To have it dial the initial connections
+	// too, create the pool with 0 initial connections and use
+	// NewClientWithPool.
+	Dialer Dialer
+	// Checksum asks the servers for a CRC32 on the requests and responses
+	// exchanged over the connections dialed after it's set, see
+	// Server.Checksum. Like Dialer, create the pool with 0 initial
+	// connections to have it apply to all of them.
+	Checksum bool
+	// Compression is the Codec the requests sent over the pool's
+	// connections are compressed with, unless WithCompression picks another
+	// for a request. CodecNone, the default, sends them uncompressed.
+	Compression Codec
+	// ConnMaxLifetime is how long a connection is used for after it was
+	// dialed, once it's older it is closed instead of being handed out or
+	// put back in the pool, and a fresh one dialed in its place. Recycling
+	// connections lets the load rebalance onto backends that were added or
+	// restarted. 0 means connections are kept for as long as they work.
+	ConnMaxLifetime time.Duration
+	// ReadBufferSize is the size of the buffer each connection reads its
+	// responses through, 4096 bytes by default. A bigger one saves reads
+	// on large pipelines of small responses. Like Dialer, create the pool
+	// with 0 initial connections to have it apply to all of them.
+	ReadBufferSize int
+	// OnDial, OnReturn and OnDiscard, when they're set, are called with
+	// the address of a connection when the pool dials it, when it's
+	// returned to the pool after use and when it's discarded because it
+	// failed, to keep an eye on how the pool's connections are used. They
+	// are called on the goroutine of the request, so they must be quick,
+	// and not while the pool is locked. Like Dialer, create the pool with 0
+	// initial connections to have OnDial called for all of them.
+	//
+	//        pool.OnDial = func(address string) { stats.Increment("pool.dial." + address) }
+	//
+	OnDial    func(address string)
+	OnReturn  func(address string)
+	OnDiscard func(address string)
+	pools     map[string][]*PooledConn
+	active    int
+	waiters   []chan *PooledConn
+	closed    bool
+	// done is closed by Close to stop the pool's background goroutines
+	done chan struct{}
 	sync.Mutex
 }
 
+// A Dialer opens a connection to address, like net.DialTimeout.
+type Dialer func(network, address string, timeout time.Duration) (net.Conn, error)
+
+// PooledConn is a connection handed out by a ConnectionPool. It carries the
+// address it was dialed to, which is the configured "host:port" rather than
+// whatever RemoteAddr() resolves to.
+type PooledConn struct {
+	net.Conn
+	Address  string
+	features features
+	// dialed is when the connection was opened, see ConnMaxLifetime
+	dialed time.Time
+	// pipelines is the sequence number of the last pipeline sent on the
+	// connection, see controlPipeline
+	pipelines uint32
+	// reader buffers the reads of the responses, so a frame's header and
+	// data (and those of the frames after it) come from one read. It stays
+	// with the connection for as long as it's open, since it may hold the
+	// start of the next response.
+	reader *bufio.Reader
+}
+
+// Read reads the responses through the connection's buffer
+func (c *PooledConn) Read(p []byte) (n int, err error) {
+	if c.reader == nil {
+		return c.Conn.Read(p)
+	}
+	return c.reader.Read(p)
+}
+
+// unwrapConn returns the connection underneath a PooledConn, net.Buffers
+// only uses writev when it's writing to the *net.TCPConn itself.
+func unwrapConn(w io.Writer) io.Writer {
+	if c, ok := w.(*PooledConn); ok == true {
+		return c.Conn
+	}
+	return w
+}
+
 func NewConnectionPool(addresses []string, initial int, timeout time.Duration) (p *ConnectionPool, err error) {
-	p = &ConnectionPool{Addresses: addresses, Initial: initial, Timeout: timeout}
+	if len(addresses) == 0 {
+		return nil, ErrNoAddresses
+	}
+	p = &ConnectionPool{Addresses: addresses, Initial: initial, Timeout: timeout, done: make(chan struct{})}
+	p.pools = make(map[string][]*PooledConn)
 	errs := make([]error, 0)
 	for i := 0; i < initial; i++ {
-		conn, err := p.dial()
+		conn, err := p.dialAddress(p.randomAddress())
 		if err != nil {
 			errs = append(errs, err)
 		} else {
-			p.conns = append(p.conns, conn)
+			p.active++
+			p.pools[conn.Address] = append(p.pools[conn.Address], conn)
 		}
 	}
 	// Only errors, no real connections
-	if len(p.conns) == 0 {
+	if len(errs) > 0 && p.Len() == 0 {
 		return nil, errs[0]
 	}
 	return p, nil
 }
 
-func (p *ConnectionPool) Take() (c net.Conn, err error) {
+// Take returns an idle connection from the pool, dialing a new one if
+// there are none. When several addresses have idle connections one of them
+// is picked at random so the load is still spread between backends.
+func (p *ConnectionPool) Take() (c *PooledConn, err error) {
+	c, _, err = p.take("")
+	return c, err
+}
+
+// TakeFrom returns an idle connection to address, dialing one if there are
+// none. address does not have to be one of the pool's Addresses, though
+// connections to other addresses are closed rather than pooled on Return.
+func (p *ConnectionPool) TakeFrom(address string) (c *PooledConn, err error) {
+	c, _, err = p.take(address)
+	return c, err
+}
+
+// take is Take (or TakeFrom if address is not empty) that also reports
+// whether the connection had to be dialed
+func (p *ConnectionPool) take(address string) (c *PooledConn, dialed bool, err error) {
+	p.Lock()
+	if p.closed == true {
+		p.Unlock()
+		return nil, false, ErrPoolClosed
+	}
+	// nobody can jump ahead of goroutines that are already waiting
+	if len(p.waiters) == 0 {
+		c = p.idle(address)
+		if c != nil {
+			p.Unlock()
+			return c, false, nil
+		}
+		if p.MaxActive <= 0 || p.active < p.MaxActive || p.closeIdle() {
+			p.active++
+			if address == "" {
+				address = p.randomAddress()
+			}
+			p.Unlock()
+			return p.dialReserved(address)
+		}
+	}
+	waiter := make(chan *PooledConn, 1)
+	p.waiters = append(p.waiters, waiter)
+	p.Unlock()
+	// a waiter is either handed a returned connection or, when a
+	// connection was discarded, nil and the discarded connection's slot
+	var timeout <-chan time.Time
+	if p.MaxWait > 0 {
+		timer := time.NewTimer(p.MaxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case c = <-waiter:
+	case <-timeout:
+		p.Lock()
+		if p.removeWaiter(waiter) == true {
+			p.Unlock()
+			return nil, false, ErrPoolExhausted
+		}
+		p.Unlock()
+		// it was served just as it timed out
+		c = <-waiter
+	}
+	if c != nil {
+		if address == "" || c.Address == address {
+			return c, false, nil
+		}
+		// it's for another backend, reuse the slot for our own
+		c.Close()
+	}
+	p.Lock()
+	if p.closed == true {
+		p.release()
+		p.Unlock()
+		return nil, false, ErrPoolClosed
+	}
+	if address == "" {
+		address = p.randomAddress()
+	}
+	p.Unlock()
+	return p.dialReserved(address)
+}
+
+// removeWaiter takes waiter out of the queue, it returns false if it had
+// already been served. It must be called with the pool locked.
+func (p *ConnectionPool) removeWaiter(waiter chan *PooledConn) bool {
+	for i, w := range p.waiters {
+		if w == waiter {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// idle shifts an idle connection off a sub-pool, address's if it is given,
+// closing the ones that are past ConnMaxLifetime on the way. It must be
+// called with the pool locked.
+func (p *ConnectionPool) idle(address string) (c *PooledConn) {
+	for {
+		c = p.shiftIdle(address)
+		if c == nil || p.expired(c) == false {
+			return c
+		}
+		c.Close()
+		p.active--
+	}
+}
+
+// expired reports whether c is past ConnMaxLifetime
+func (p *ConnectionPool) expired(c *PooledConn) bool {
+	return p.ConnMaxLifetime > 0 && time.Since(c.dialed) > p.ConnMaxLifetime
+}
+
+// shiftIdle shifts an idle connection off a sub-pool, address's if it is
+// given. When several addresses have idle connections one of them is picked
+// at random. It must be called with the pool locked.
+func (p *ConnectionPool) shiftIdle(address string) (c *PooledConn) {
+	if address == "" {
+		open := make([]string, 0, len(p.pools))
+		for a, conns := range p.pools {
+			if len(conns) > 0 {
+				open = append(open, a)
+			}
+		}
+		if len(open) == 0 {
+			return nil
+		}
+		address = open[rand.Intn(len(open))]
+	}
+	conns := p.pools[address]
+	if len(conns) == 0 {
+		return nil
+	}
+	c = conns[0]
+	p.pools[address] = conns[1:len(conns)]
+	return c
+}
+
+// closeIdle closes an idle connection to make room for a new one, it returns
+// false if there are none. It must be called with the pool locked.
+func (p *ConnectionPool) closeIdle() bool {
+	c := p.idle("")
+	if c == nil {
+		return false
+	}
+	c.Close()
+	p.active--
+	return true
+}
+
+// dialReserved dials address for a slot already counted in active, giving
+// the slot up if the dial fails
+func (p *ConnectionPool) dialReserved(address string) (c *PooledConn, dialed bool, err error) {
+	c, err = p.dialAddress(address)
+	if err != nil {
+		p.Lock()
+		p.release()
+		p.Unlock()
+		return nil, false, err
+	}
+	return c, true, nil
+}
+
+// release gives up the slot of a closed connection, handing it to the
+// first waiter if there is one. It must be called with the pool locked.
+func (p *ConnectionPool) release() {
+	if len(p.waiters) > 0 {
+		waiter := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		waiter <- nil
+		return
+	}
+	p.active--
+}
+
+// Return puts a connection taken from the pool back into the sub-pool of
+// the address it was dialed to, or hands it to the first goroutine waiting
+// in Take.
+func (p *ConnectionPool) Return(c *PooledConn) {
+	if p.OnReturn != nil {
+		p.OnReturn(c.Address)
+	}
+	p.Lock()
+	defer p.Unlock()
+	if p.closed == true || p.hasAddress(c.Address) == false || p.expired(c) == true {
+		// the pool was closed or the address was removed (or was never
+		// one of the pool's, see TakeFrom) while the connection was
+		// checked out, or the connection is too old to keep using
+		c.Close()
+		p.release()
+		return
+	}
+	if len(p.waiters) > 0 {
+		waiter := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		waiter <- c
+		return
+	}
+	p.pools[c.Address] = append(p.pools[c.Address], c)
+}
+
+// Discard closes a connection taken from the pool that is no longer usable
+// (for example after a network error) instead of returning it.
+func (p *ConnectionPool) Discard(c *PooledConn) {
+	if p.OnDiscard != nil {
+		p.OnDiscard(c.Address)
+	}
+	c.Close()
+	p.Lock()
+	defer p.Unlock()
+	p.release()
+}
+
+// SetAddresses replaces the set of addresses the pool dials to. Idle
+// connections to addresses that are no longer present are closed, and
+// connections that are currently checked out are closed when returned.
+func (p *ConnectionPool) SetAddresses(addresses []string) {
 	p.Lock()
 	defer p.Unlock()
-	if len(p.conns) > 0 {
-		// shift a conn off the array
-		c = p.conns[0]
-		p.conns = p.conns[1:len(p.conns)]
-		return c, nil
-	} else {
-		return p.dial()
+	p.Addresses = addresses
+	for address, conns := range p.pools {
+		if p.hasAddress(address) == false {
+			log.Debug("Removing address %s", address)
+			for _, conn := range conns {
+				conn.Close()
+				p.release()
+			}
+			delete(p.pools, address)
+		}
 	}
 }
 
-func (p *ConnectionPool) Return(c net.Conn) {
+// Close closes the pool's idle connections, stops its background goroutines
+// and fails any goroutines waiting in Take with ErrPoolClosed. Connections
+// that are checked out are closed when they are returned.
+func (p *ConnectionPool) Close() error {
 	p.Lock()
 	defer p.Unlock()
-	p.conns = append(p.conns, c)
+	if p.closed == true {
+		return ErrPoolClosed
+	}
+	p.closed = true
+	close(p.done)
+	for address, conns := range p.pools {
+		for _, conn := range conns {
+			conn.Close()
+			p.active--
+		}
+		delete(p.pools, address)
+	}
+	// each waiter is handed a slot which it gives back when it sees the
+	// pool is closed
+	for _, waiter := range p.waiters {
+		p.active++
+		waiter <- nil
+	}
+	p.waiters = nil
+	return nil
+}
+
+func (p *ConnectionPool) hasAddress(address string) bool {
+	for _, a := range p.Addresses {
+		if a == address {
+			return true
+		}
+	}
+	return false
 }
 
-func (p *ConnectionPool) dial() (c net.Conn, err error) {
-	address := p.Addresses[rand.Intn(len(p.Addresses))]
+// Len returns the number of idle connections across all addresses.
+func (p *ConnectionPool) Len() (n int) {
+	p.Lock()
+	defer p.Unlock()
+	for _, conns := range p.pools {
+		n += len(conns)
+	}
+	return n
+}
+
+// randomAddress must be called with the pool locked, or before the pool is shared
+func (p *ConnectionPool) randomAddress() string {
+	return p.Addresses[rand.Intn(len(p.Addresses))]
+}
+
+func (p *ConnectionPool) dialAddress(address string) (c *PooledConn, err error) {
 	log.Debug("Dial address %s", address)
-	return net.DialTimeout("tcp", address, p.Timeout)
+	dial := p.Dialer
+	if dial == nil {
+		dial = net.DialTimeout
+	}
+	conn, err := dial("tcp", address, p.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if p.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(p.Timeout))
+	}
+	// the client can always read compressed responses, it's up to the
+	// server whether it sends them, and streams are only used by a Mux
+	requested := featureCompression | featureStreams | featureCodecs | featurePipelineDigest | featureOneWay
+	if p.Checksum == true {
+		requested |= featureChecksum
+	}
+	f, err := clientHandshake(conn, requested)
+	if err != nil {
+		log.Warning("Handshake with %s failed: %s", address, err.Error())
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	if p.OnDial != nil {
+		p.OnDial(address)
+	}
+	size := p.ReadBufferSize
+	if size <= 0 {
+		size = readBufferSize
+	}
+	reader := bufio.NewReaderSize(conn, size)
+	return &PooledConn{Conn: conn, Address: address, features: f, dialed: time.Now(), reader: reader}, nil
 }
@@ -0,0 +1,382 @@
+package tcpez
+
+import (
+	"fmt"
+	"github.com/bmizerany/assert"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConnectionPoolPerAddress(t *testing.T) {
+	addrs := make([]string, 2)
+	for i := range addrs {
+		l, addr := newTestServer(new(EchoHandler))
+		defer l.Close()
+		addrs[i] = addr
+	}
+	p, err := NewConnectionPool(addrs, 10, 3*time.Second)
+	assert.T(t, err == nil)
+	assert.Equal(t, 10, p.Len())
+	for address, conns := range p.pools {
+		for _, conn := range conns {
+			assert.Equal(t, address, conn.Address)
+			assert.Equal(t, address, conn.RemoteAddr().String())
+		}
+	}
+	for i := 0; i < 10; i++ {
+		conn, err := p.Take()
+		assert.T(t, err == nil)
+		address := conn.Address
+		before := len(p.pools[address])
+		p.Return(conn)
+		assert.Equal(t, before+1, len(p.pools[address]))
+		assert.Equal(t, conn, p.pools[address][len(p.pools[address])-1])
+	}
+	assert.Equal(t, 10, p.Len())
+}
+
+func TestConnectionPoolDiscard(t *testing.T) {
+	l, addr := newTestServer(new(EchoHandler))
+	defer l.Close()
+	p, err := NewConnectionPool([]string{addr}, 2, 3*time.Second)
+	assert.T(t, err == nil)
+	conn, _ := p.Take()
+	p.Discard(conn)
+	assert.Equal(t, 1, p.Len())
+	_, err = conn.Write([]byte("PING"))
+	assert.T(t, err != nil)
+}
+
+func TestPooledConnAddress(t *testing.T) {
+	l, addr := newTestServer(new(EchoHandler))
+	defer l.Close()
+	// the configured address is kept even though the connection's
+	// RemoteAddr() is the resolved ip
+	port := l.Addr().(*net.TCPAddr).Port
+	address := fmt.Sprintf("localhost:%d", port)
+	p, err := NewConnectionPool([]string{address}, 1, 3*time.Second)
+	assert.T(t, err == nil)
+	conn, err := p.Take()
+	assert.T(t, err == nil)
+	assert.Equal(t, address, conn.Address)
+	assert.Equal(t, addr, conn.RemoteAddr().String())
+}
+
+type fakeResolver struct {
+	sync.Mutex
+	addresses []string
+}
+
+func (r *fakeResolver) Resolve(name string) ([]string, error) {
+	r.Lock()
+	defer r.Unlock()
+	return r.addresses, nil
+}
+
+func (r *fakeResolver) set(addresses ...string) {
+	r.Lock()
+	defer r.Unlock()
+	r.addresses = addresses
+}
+
+func TestResolvingConnectionPool(t *testing.T) {
+	addrs := make([]string, 2)
+	for i := range addrs {
+		l, addr := newTestServer(new(EchoHandler))
+		defer l.Close()
+		addrs[i] = addr
+	}
+	resolver := new(fakeResolver)
+	resolver.set(addrs...)
+	p, err := NewResolvingConnectionPool("backends", resolver, 10*time.Millisecond, 10, 3*time.Second)
+	assert.T(t, err == nil)
+	assert.Equal(t, addrs, p.Addresses)
+	// hold on to a connection to the address that is going away
+	var stale *PooledConn
+	for stale == nil {
+		conn, _ := p.Take()
+		if conn.Address == addrs[1] {
+			stale = conn
+		} else {
+			p.Return(conn)
+		}
+	}
+	var dropped []*PooledConn
+	p.Lock()
+	dropped = append(dropped, p.pools[addrs[1]]...)
+	p.Unlock()
+
+	resolver.set(addrs[0])
+	for i := 0; i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		p.Lock()
+		n := len(p.Addresses)
+		p.Unlock()
+		if n == 1 {
+			break
+		}
+	}
+	p.Lock()
+	assert.Equal(t, []string{addrs[0]}, p.Addresses)
+	_, ok := p.pools[addrs[1]]
+	p.Unlock()
+	assert.T(t, ok == false)
+	for _, conn := range dropped {
+		_, err := conn.Write([]byte("PING"))
+		assert.T(t, err != nil)
+	}
+	// checked out connections are closed instead of being pooled again
+	p.Return(stale)
+	_, err = stale.Write([]byte("PING"))
+	assert.T(t, err != nil)
+	for i := 0; i < 10; i++ {
+		conn, err := p.Take()
+		assert.T(t, err == nil)
+		assert.Equal(t, addrs[0], conn.Address)
+		defer p.Return(conn)
+	}
+}
+
+func TestConnectionPoolMaxActiveFIFO(t *testing.T) {
+	l, addr := newTestServer(new(EchoHandler))
+	defer l.Close()
+	p, err := NewConnectionPool([]string{addr}, 1, time.Second)
+	assert.T(t, err == nil)
+	p.MaxActive = 1
+	conn, err := p.Take()
+	assert.T(t, err == nil)
+	// queue up waiters one at a time so their order is known
+	n := 5
+	served := make(chan int, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			c, err := p.Take()
+			if err == nil {
+				served <- i
+				p.Return(c)
+			}
+		}(i)
+		for {
+			p.Lock()
+			waiting := len(p.waiters)
+			p.Unlock()
+			if waiting == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	p.Return(conn)
+	for i := 0; i < n; i++ {
+		assert.Equal(t, i, <-served)
+	}
+	assert.Equal(t, 1, p.Len())
+	assert.Equal(t, 1, p.active)
+}
+
+func TestConnectionPoolMaxActiveContention(t *testing.T) {
+	l, addr := newTestServer(new(EchoHandler))
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	c.pool.MaxActive = 2
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var longest time.Duration
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				started := time.Now()
+				_, err := c.SendRecv([]byte("PING"))
+				took := time.Since(started)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				lock.Lock()
+				if took > longest {
+					longest = took
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	// every goroutine got its turn without being starved
+	assert.T(t, longest < time.Second)
+	assert.T(t, c.pool.active <= 2)
+}
+
+func TestConnectionPoolCloseWakesWaiters(t *testing.T) {
+	l, addr := newTestServer(new(EchoHandler))
+	defer l.Close()
+	p, err := NewConnectionPool([]string{addr}, 1, time.Second)
+	assert.T(t, err == nil)
+	p.MaxActive = 1
+	conn, err := p.Take()
+	assert.T(t, err == nil)
+	errs := make(chan error)
+	go func() {
+		_, err := p.Take()
+		errs <- err
+	}()
+	for {
+		p.Lock()
+		waiting := len(p.waiters)
+		p.Unlock()
+		if waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.T(t, p.Close() == nil)
+	assert.Equal(t, ErrPoolClosed, <-errs)
+	p.Return(conn)
+	_, err = conn.Write([]byte("PING"))
+	assert.T(t, err != nil)
+	assert.Equal(t, 0, p.active)
+}
+
+func TestConnectionPoolCloseStopsGoroutines(t *testing.T) {
+	l, addr := newTestServer(new(EchoHandler))
+	defer l.Close()
+	resolver := new(fakeResolver)
+	resolver.set(addr)
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		p, err := NewResolvingConnectionPool("backends", resolver, time.Millisecond, 1, time.Second)
+		assert.T(t, err == nil)
+		assert.T(t, p.Close() == nil)
+	}
+	// the server's goroutines for the closed connections exit on their own time
+	after := runtime.NumGoroutine()
+	for i := 0; i < 100 && after > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+		after = runtime.NumGoroutine()
+	}
+	assert.T(t, after <= before, fmt.Sprintf("%d goroutines before, %d after", before, after))
+}
+
+func TestConnectionPoolMaxWait(t *testing.T) {
+	l, addr := newTestServer(new(EchoHandler))
+	defer l.Close()
+	p, err := NewConnectionPool([]string{addr}, 2, time.Second)
+	assert.T(t, err == nil)
+	p.MaxActive = 2
+	p.MaxWait = 20 * time.Millisecond
+	first, err := p.Take()
+	assert.T(t, err == nil)
+	second, err := p.Take()
+	assert.T(t, err == nil)
+	started := time.Now()
+	_, err = p.Take()
+	assert.Equal(t, ErrPoolExhausted, err)
+	assert.T(t, time.Since(started) >= 20*time.Millisecond)
+	p.Lock()
+	assert.Equal(t, 0, len(p.waiters))
+	assert.Equal(t, 2, p.active)
+	p.Unlock()
+	// a connection freed while waiting is still handed over
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		p.Return(first)
+	}()
+	c, err := p.Take()
+	assert.T(t, err == nil)
+	assert.Equal(t, first, c)
+	p.Return(c)
+	p.Return(second)
+}
+
+func TestConnectionPoolDialer(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0", new(EchoHandler))
+	assert.T(t, err == nil)
+	defer s.Close()
+	p, err := NewConnectionPool([]string{"in-memory:1"}, 0, time.Second)
+	assert.T(t, err == nil)
+	dialed := make(chan string, 1)
+	p.Dialer = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		dialed <- address
+		client, server := net.Pipe()
+		go s.handle(server, 1)
+		return client, nil
+	}
+	c := NewClientWithPool(p)
+	resp, err := c.SendRecv([]byte("PING"))
+	assert.T(t, err == nil)
+	assert.Equal(t, []byte("PING"), resp)
+	assert.Equal(t, "in-memory:1", <-dialed)
+}
+
+func TestConnectionPoolNoAddresses(t *testing.T) {
+	p, err := NewConnectionPool(nil, 1, time.Second)
+	assert.T(t, p == nil)
+	assert.Equal(t, ErrNoAddresses, err)
+	p, err = NewConnectionPool([]string{}, 0, time.Second)
+	assert.T(t, p == nil)
+	assert.Equal(t, ErrNoAddresses, err)
+	c, err := NewClient([]string{}, 1, time.Second)
+	assert.T(t, c == nil)
+	assert.Equal(t, ErrNoAddresses, err)
+}
+
+func TestConnectionPoolConnMaxLifetime(t *testing.T) {
+	l, addr := newTestServer(new(EchoHandler))
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	c.pool.ConnMaxLifetime = 50 * time.Millisecond
+	_, info, err := c.SendRecvWithInfo([]byte("PING"))
+	assert.T(t, err == nil)
+	assert.Equal(t, false, info.Dialed)
+	first := c.pool.pools[addr][0]
+	time.Sleep(60 * time.Millisecond)
+	// the idle connection got too old, it's replaced
+	_, info, err = c.SendRecvWithInfo([]byte("PING"))
+	assert.T(t, err == nil)
+	assert.Equal(t, true, info.Dialed)
+	_, err = first.Write([]byte("PING"))
+	assert.T(t, err != nil)
+	assert.Equal(t, 1, c.pool.active)
+
+	// a connection that gets too old while checked out isn't put back
+	conn, err := c.pool.Take()
+	assert.T(t, err == nil)
+	time.Sleep(60 * time.Millisecond)
+	c.pool.Return(conn)
+	assert.Equal(t, 0, c.pool.Len())
+	assert.Equal(t, 0, c.pool.active)
+}
+
+func TestConnectionPoolCallbacks(t *testing.T) {
+	l, addr := newTestServer(new(EchoHandler))
+	defer l.Close()
+	p, err := NewConnectionPool([]string{addr}, 0, time.Second)
+	assert.T(t, err == nil)
+	var events []string
+	p.OnDial = func(address string) { events = append(events, "dial "+address) }
+	p.OnReturn = func(address string) { events = append(events, "return "+address) }
+	p.OnDiscard = func(address string) { events = append(events, "discard "+address) }
+	c := NewClientWithPool(p)
+	// the pool is empty, so the first request dials
+	_, err = c.SendRecv([]byte("PING"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"dial " + addr, "return " + addr}, events)
+	// the next one reuses the connection
+	_, err = c.SendRecv([]byte("PING"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"dial " + addr, "return " + addr, "return " + addr}, events)
+
+	conn, err := p.Take()
+	assert.Equal(t, nil, err)
+	p.Discard(conn)
+	assert.Equal(t, "discard "+addr, events[len(events)-1])
+	_, err = c.SendRecv([]byte("PING"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"dial " + addr, "return " + addr}, events[4:])
+}
@@ -0,0 +1,124 @@
+package tcpez
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+)
+
+// Frame is a request or a response as a Framer reads and writes it, along
+// with what the control frames in front of it said about it.
+type Frame struct {
+	// Data is the request or response. It's empty for a keepalive, and for
+	// the header of a pipeline or multi-frame response (see Count).
+	Data []byte
+	// Metadata is the request's metadata, see WithMetadata.
+	Metadata map[string]string
+	// Compressed marks Data as compressed with Codec, or gzipped when Codec
+	// is CodecNone.
+	Compressed bool
+	Codec      Codec
+	// Multi marks the header of a response made up of Count frames.
+	Multi bool
+	// Error marks Data as an error instead of a response: a one byte Code
+	// followed by the error message.
+	Error bool
+	// Stream is the stream the frame is on, 0 if it isn't on one.
+	Stream uint32
+	// Count, when it's over 0, makes the frame the header of a pipeline, or
+	// of a multi-frame response, that many frames long. The frames follow
+	// it.
+	Count int32
+}
+
+// Framer reads and writes the frames requests and responses are sent in. A
+// Server with a Framer uses it instead of the tcpez framing (see
+// Server.Framer), so a client in another language can talk to it in a
+// framing that is easier to implement there.
+type Framer interface {
+	ReadFrame(r io.Reader) (Frame, error)
+	WriteFrame(w io.Writer, frame Frame) error
+}
+
+// LengthPrefixFramer is the tcpez framing (described in the README): each
+// frame is an int32 big-endian length followed by that many bytes, and
+// anything else about it is said by the control frames in front of it. A
+// negative length is the header of a pipeline (or, after a multi control
+// frame, of a multi-frame response) and the count of the frames that follow.
+type LengthPrefixFramer struct {
+	// Checksum reads and writes the CRC32 trailer of non empty frames, the
+	// checksum feature of the handshake. The frames of a pipeline don't
+	// have one, they're read and written without it.
+	Checksum bool
+}
+
+// DefaultFramer is the tcpez framing, without checksums.
+var DefaultFramer Framer = LengthPrefixFramer{}
+
+func (f LengthPrefixFramer) features() features {
+	if f.Checksum == true {
+		return featureChecksum
+	}
+	return 0
+}
+
+// ReadFrame fulfills the Framer interface.
+func (f LengthPrefixFramer) ReadFrame(r io.Reader) (frame Frame, err error) {
+	size, info, err := readHeader(r)
+	if err != nil {
+		return frame, err
+	}
+	frame = Frame{
+		Metadata:   info.metadata,
+		Compressed: info.compressed,
+		Codec:      info.codec,
+		Multi:      info.multi,
+		Error:      info.err,
+		Stream:     info.stream,
+	}
+	if size < 0 {
+		frame.Count = -size
+		return frame, nil
+	}
+	frame.Data, err = readFrame(r, size, f.features())
+	if err != nil {
+		return Frame{}, err
+	}
+	return frame, nil
+}
+
+// WriteFrame fulfills the Framer interface. The frame is written in one go.
+func (f LengthPrefixFramer) WriteFrame(w io.Writer, frame Frame) (err error) {
+	buffers := make(net.Buffers, 0, 8)
+	if frame.Stream != 0 {
+		buffers = append(buffers, streamFrame(frame.Stream))
+	}
+	if len(frame.Metadata) > 0 {
+		buf := bytes.NewBuffer(nil)
+		err = writeMetadata(frame.Metadata, buf)
+		if err != nil {
+			return err
+		}
+		buffers = append(buffers, buf.Bytes())
+	}
+	if frame.Compressed == true && frame.Codec != CodecNone {
+		buffers = append(buffers, codecFrame(frame.Codec))
+	} else if frame.Compressed == true {
+		buffers = append(buffers, controlFrame(controlCompressed))
+	}
+	if frame.Multi == true {
+		buffers = append(buffers, controlFrame(controlMulti))
+	}
+	if frame.Error == true {
+		buffers = append(buffers, controlFrame(controlError))
+	}
+	if frame.Count > 0 {
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint32(header, uint32(-frame.Count))
+		buffers = append(buffers, header)
+	} else {
+		buffers = append(buffers, frameBuffers(frame.Data, f.features())...)
+	}
+	return writeBuffers(buffers, w)
+}
@@ -0,0 +1,147 @@
+package tcpez
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/bmizerany/assert"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLengthPrefixFramerRoundTrip(t *testing.T) {
+	frames := []Frame{
+		{Data: []byte("PING")},
+		{Data: []byte{}},
+		{Data: []byte("PING"), Metadata: map[string]string{"user": "bob"}},
+		{Data: []byte("<gzipped>"), Compressed: true, Codec: CodecGzip},
+		{Data: []byte("<deflated>"), Compressed: true, Codec: CodecFlate},
+		{Data: errorFrame(CodeNotFound, "no such key"), Error: true},
+		{Data: []byte("PING"), Stream: 7},
+		{Multi: true, Count: 3},
+		{Count: 2},
+	}
+	for _, framer := range []LengthPrefixFramer{{}, {Checksum: true}} {
+		buf := bytes.NewBuffer(nil)
+		for _, frame := range frames {
+			assert.Equal(t, nil, framer.WriteFrame(buf, frame))
+		}
+		for _, frame := range frames {
+			read, err := framer.ReadFrame(buf)
+			assert.Equal(t, nil, err)
+			assert.Equal(t, frame, read)
+		}
+		_, err := framer.ReadFrame(buf)
+		assert.Equal(t, io.EOF, err)
+	}
+}
+
+func TestLengthPrefixFramerWireFormat(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	DefaultFramer.WriteFrame(buf, Frame{Data: []byte("PING")})
+	assert.Equal(t, []byte("\x00\x00\x00\x04PING"), buf.Bytes())
+	buf.Reset()
+	DefaultFramer.WriteFrame(buf, Frame{Count: 2})
+	assert.Equal(t, []byte("\xff\xff\xff\xfe"), buf.Bytes())
+	buf.Reset()
+	DefaultFramer.WriteFrame(buf, Frame{Data: []byte("PONG"), Compressed: true})
+	assert.Equal(t, []byte("\x80\x00\x00\x00\x02\x00\x00\x00\x04PONG"), buf.Bytes())
+}
+
+func TestLengthPrefixFramerChecksumMismatch(t *testing.T) {
+	framer := LengthPrefixFramer{Checksum: true}
+	buf := bytes.NewBuffer(nil)
+	framer.WriteFrame(buf, Frame{Data: []byte("PING")})
+	data := buf.Bytes()
+	data[5] = 'O'
+	_, err := framer.ReadFrame(bytes.NewReader(data))
+	assert.T(t, errors.Is(err, ErrChecksumMismatch))
+}
+
+// lineFramer frames requests and responses as lines, and errors as lines
+// starting with "ERR "
+type lineFramer struct{}
+
+func (lineFramer) ReadFrame(r io.Reader) (frame Frame, err error) {
+	var b [1]byte
+	for {
+		_, err = io.ReadFull(r, b[:])
+		if err != nil {
+			return Frame{}, err
+		}
+		if b[0] == '\n' {
+			return frame, nil
+		}
+		frame.Data = append(frame.Data, b[0])
+	}
+}
+
+func (lineFramer) WriteFrame(w io.Writer, frame Frame) (err error) {
+	if frame.Error == true {
+		_, err = fmt.Fprintf(w, "ERR %s\n", decodeError(frame.Data).(*RemoteError).Message)
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", frame.Data)
+	return err
+}
+
+func TestServerFramer(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0", StringHandler(func(req string, span *Span) (string, error) {
+		if req == "MISSING" {
+			return "", NewStatusError(CodeNotFound, "no such key")
+		}
+		return "PONG " + req, nil
+	}))
+	assert.T(t, err == nil)
+	s.Framer = lineFramer{}
+	go s.Start()
+	defer s.Close()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	assert.T(t, err == nil)
+	defer conn.Close()
+	f, err := clientHandshake(conn, featureCompression|featureChecksum|featureStreams)
+	assert.T(t, err == nil)
+	assert.Equal(t, features(0), f)
+
+	conn.Write([]byte("one\ntwo\nMISSING\n"))
+	var responses []string
+	for i := 0; i < 3; i++ {
+		frame, err := lineFramer{}.ReadFrame(conn)
+		assert.T(t, err == nil)
+		responses = append(responses, string(frame.Data))
+	}
+	assert.Equal(t, []string{"PONG one", "PONG two", "ERR no such key"}, responses)
+}
+
+func TestServerDefaultFramer(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0", StringHandler(func(req string, span *Span) (string, error) {
+		if req == "MISSING" {
+			return "", NewStatusError(CodeNotFound, "no such key")
+		}
+		return span.Metadata["user"] + " " + req, nil
+	}))
+	assert.T(t, err == nil)
+	s.Framer = DefaultFramer
+	go s.Start()
+	defer s.Close()
+	// the tcpez framing is the Client's, as long as it's only sent single
+	// requests
+	c, _ := NewClient([]string{s.Addr().String()}, 1, time.Second)
+	assert.T(t, c != nil)
+	res, err := c.SendRecvOpts([]byte("PING"), WithMetadata("user", "bob"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "bob PING", string(res))
+	var remoteErr *RemoteError
+	_, err = c.SendRecv([]byte("MISSING"))
+	assert.T(t, errors.As(err, &remoteErr))
+	assert.Equal(t, CodeNotFound, remoteErr.Code)
+	// the connection is still up for the next request
+	res, err = c.SendRecv([]byte("PING"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, " PING", string(res))
+	// but a pipeline isn't served
+	_, err = c.SendRecvBatch([][]byte{[]byte("PING1"), []byte("PING2")})
+	assert.T(t, err != nil)
+}
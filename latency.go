@@ -0,0 +1,80 @@
+package tcpez
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyWindowSize is the number of most recent requests LatencyStats are
+// computed over
+const latencyWindowSize = 1024
+
+// LatencyStats summarize the durations of the requests a Server handled
+// most recently, see Server.LatencyStats.
+type LatencyStats struct {
+	// Count is the number of requests the stats are computed over, at
+	// most the last 1024
+	Count int
+	P50   time.Duration
+	P95   time.Duration
+	P99   time.Duration
+	// Rate is the number of requests per second, from the oldest request
+	// in the window until now
+	Rate float64
+}
+
+// latencyWindow is a ring buffer of the durations of the latest requests and
+// when they finished
+type latencyWindow struct {
+	durations [latencyWindowSize]time.Duration
+	finished  [latencyWindowSize]time.Time
+	next      int
+	count     int
+	sync.Mutex
+}
+
+func (w *latencyWindow) add(duration time.Duration, finished time.Time) {
+	w.Lock()
+	defer w.Unlock()
+	w.durations[w.next] = duration
+	w.finished[w.next] = finished
+	w.next = (w.next + 1) % latencyWindowSize
+	if w.count < latencyWindowSize {
+		w.count++
+	}
+}
+
+func (w *latencyWindow) stats(now time.Time) (stats LatencyStats) {
+	w.Lock()
+	durations := make([]time.Duration, w.count)
+	copy(durations, w.durations[:w.count])
+	// the oldest entry is the one that gets overwritten next, unless the
+	// window hasn't filled up yet
+	oldest := w.finished[0]
+	if w.count == latencyWindowSize {
+		oldest = w.finished[w.next]
+	}
+	w.Unlock()
+	stats.Count = len(durations)
+	if stats.Count == 0 {
+		return stats
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	stats.P50 = percentile(durations, 50)
+	stats.P95 = percentile(durations, 95)
+	stats.P99 = percentile(durations, 99)
+	if elapsed := now.Sub(oldest); elapsed > 0 {
+		stats.Rate = float64(stats.Count) / elapsed.Seconds()
+	}
+	return stats
+}
+
+// percentile returns the nearest-rank p-th percentile of sorted
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
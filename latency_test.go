@@ -0,0 +1,50 @@
+package tcpez
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+	"time"
+)
+
+func TestLatencyWindow(t *testing.T) {
+	var w latencyWindow
+	assert.Equal(t, LatencyStats{}, w.stats(time.Now()))
+	start := time.Now()
+	for i := 1; i <= 100; i++ {
+		w.add(time.Duration(i)*time.Millisecond, start.Add(time.Duration(i)*time.Millisecond))
+	}
+	stats := w.stats(start.Add(time.Second))
+	assert.Equal(t, 100, stats.Count)
+	assert.Equal(t, 50*time.Millisecond, stats.P50)
+	assert.Equal(t, 95*time.Millisecond, stats.P95)
+	assert.Equal(t, 99*time.Millisecond, stats.P99)
+	// 100 requests in the 999ms since the first one finished
+	assert.T(t, stats.Rate > 100 && stats.Rate < 101)
+
+	// only the latest requests are kept once the window is full
+	for i := 0; i < latencyWindowSize; i++ {
+		w.add(time.Second, start.Add(2*time.Second))
+	}
+	stats = w.stats(start.Add(3 * time.Second))
+	assert.Equal(t, latencyWindowSize, stats.Count)
+	assert.Equal(t, time.Second, stats.P50)
+	assert.Equal(t, float64(latencyWindowSize), stats.Rate)
+}
+
+func TestServerLatencyStats(t *testing.T) {
+	l, err := NewServer("127.0.0.1:0", &NamedHandler{name: "slow", sleep: 20 * time.Millisecond})
+	assert.T(t, err == nil)
+	defer l.Close()
+	go l.Start()
+	c, _ := NewClient([]string{l.Addr().String()}, 1, time.Second)
+	assert.T(t, c != nil)
+	for i := 0; i < 5; i++ {
+		_, err := c.SendRecv([]byte("PING"))
+		assert.T(t, err == nil)
+	}
+	stats := l.LatencyStats()
+	assert.Equal(t, 5, stats.Count)
+	assert.T(t, stats.P50 >= 20*time.Millisecond && stats.P50 < time.Second)
+	assert.T(t, stats.P99 >= stats.P50)
+	assert.T(t, stats.Rate > 0)
+}
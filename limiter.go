@@ -0,0 +1,71 @@
+package tcpez
+
+import (
+	"sync"
+)
+
+// PriorityMetadataKey is the metadata key a client can mark a request as
+// high priority with, by sending PriorityHigh under it:
+//
+//        resp, err := c.SendRecvOpts(req, tcpez.WithMetadata(tcpez.PriorityMetadataKey, tcpez.PriorityHigh))
+//
+// When the Server's MaxInflight is reached, requests waiting for a slot are
+// admitted high priority first, each class in the order it arrived. Without
+// a MaxInflight the priority has no effect.
+const PriorityMetadataKey = "priority"
+
+// PriorityHigh is the PriorityMetadataKey value of a high priority request,
+// anything else is normal priority.
+const PriorityHigh = "high"
+
+// inflightLimiter is a semaphore of MaxInflight slots that hands slots that
+// free up to the waiting high priority requests before the normal ones.
+type inflightLimiter struct {
+	free int
+	// waiting holds the queued requests' channels by priority, high first
+	waiting [2][]chan struct{}
+	sync.Mutex
+}
+
+func newInflightLimiter(slots int) *inflightLimiter {
+	return &inflightLimiter{free: slots}
+}
+
+// acquire blocks until the request gets a slot
+func (l *inflightLimiter) acquire(high bool) {
+	l.Lock()
+	if l.free > 0 {
+		l.free--
+		l.Unlock()
+		return
+	}
+	class := 1
+	if high == true {
+		class = 0
+	}
+	ready := make(chan struct{})
+	l.waiting[class] = append(l.waiting[class], ready)
+	l.Unlock()
+	<-ready
+}
+
+// release gives the slot to the next waiting request, or frees it
+func (l *inflightLimiter) release() {
+	l.Lock()
+	defer l.Unlock()
+	for class, queue := range l.waiting {
+		if len(queue) > 0 {
+			l.waiting[class] = queue[1:]
+			close(queue[0])
+			return
+		}
+	}
+	l.free++
+}
+
+// queued returns the number of requests waiting for a slot
+func (l *inflightLimiter) queued() int {
+	l.Lock()
+	defer l.Unlock()
+	return len(l.waiting[0]) + len(l.waiting[1])
+}
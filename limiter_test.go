@@ -0,0 +1,31 @@
+package tcpez
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+	"time"
+)
+
+func TestInflightLimiterPriority(t *testing.T) {
+	l := newInflightLimiter(1)
+	l.acquire(false)
+	order := make(chan string, 3)
+	for i, name := range []string{"low1", "low2", "high"} {
+		go func(name string) {
+			l.acquire(name == "high")
+			order <- name
+			l.release()
+		}(name)
+		// wait for it to queue so the order they arrived in is known
+		for l.queued() < i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	l.release()
+	assert.Equal(t, "high", <-order)
+	assert.Equal(t, "low1", <-order)
+	assert.Equal(t, "low2", <-order)
+	// the slot is back once they're done
+	l.acquire(false)
+	assert.Equal(t, 0, l.queued())
+}
@@ -0,0 +1,72 @@
+package tcpez
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// A ServerOption configures the listener created by NewServer.
+type ServerOption func(*listenOptions)
+
+type listenOptions struct {
+	reusePort bool
+	backlog   int
+}
+
+// WithReusePort sets SO_REUSEPORT on the listener, so several processes
+// (each created with WithReusePort) can listen on the same port and the
+// kernel spreads the connections between them.
+func WithReusePort() ServerOption {
+	return func(o *listenOptions) {
+		o.reusePort = true
+	}
+}
+
+// WithBacklog sets the length of the listener's queue of connections that
+// have not been accepted yet. By default it is the system's maximum
+// (net.core.somaxconn on linux).
+func WithBacklog(backlog int) ServerOption {
+	return func(o *listenOptions) {
+		o.backlog = backlog
+	}
+}
+
+func listen(address string, opts []ServerOption) (l *net.TCPListener, err error) {
+	o := new(listenOptions)
+	for _, opt := range opts {
+		opt(o)
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	lc := net.ListenConfig{Control: o.control}
+	listener, err := lc.Listen(context.Background(), "tcp", tcpAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	l = listener.(*net.TCPListener)
+	if o.backlog > 0 {
+		err = setBacklog(l, o.backlog)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// control sets the socket options before the listener is bound
+func (o *listenOptions) control(network, address string, c syscall.RawConn) (err error) {
+	if o.reusePort == false {
+		return nil
+	}
+	cerr := c.Control(func(fd uintptr) {
+		err = setReusePort(fd)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
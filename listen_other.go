@@ -0,0 +1,16 @@
+//go:build !unix || solaris
+
+package tcpez
+
+import (
+	"errors"
+	"net"
+)
+
+func setReusePort(fd uintptr) error {
+	return errors.New("tcpez: SO_REUSEPORT is not supported on this platform")
+}
+
+func setBacklog(l *net.TCPListener, backlog int) error {
+	return errors.New("tcpez: setting the listen backlog is not supported on this platform")
+}
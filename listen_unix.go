@@ -0,0 +1,28 @@
+//go:build unix && !solaris
+
+package tcpez
+
+import (
+	"net"
+	"syscall"
+)
+
+func setReusePort(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+}
+
+// setBacklog listens again on the already listening socket, which only
+// changes the length of its queue
+func setBacklog(l *net.TCPListener, backlog int) (err error) {
+	rc, err := l.SyscallConn()
+	if err != nil {
+		return err
+	}
+	cerr := rc.Control(func(fd uintptr) {
+		err = syscall.Listen(int(fd), backlog)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
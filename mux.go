@@ -0,0 +1,188 @@
+package tcpez
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrMuxClosed is returned by the requests made on a Mux that has been
+// closed, or whose connection has failed.
+var ErrMuxClosed = errors.New("tcpez: mux closed")
+
+// ErrStreamsUnsupported is returned by Client.Mux when the server didn't
+// agree to streams in the handshake.
+var ErrStreamsUnsupported = errors.New("tcpez: server doesn't support streams")
+
+// Mux multiplexes concurrent requests over a single connection. Each request
+// is sent on a stream of its own, which the server handles independently of
+// the others and answers as soon as it can, so a slow request doesn't hold up
+// the ones sent after it like it would on a connection from the pool, and
+// many requests can be in flight without opening as many connections.
+//
+//        m, err := c.Mux()
+//        defer m.Close()
+//        go func() {
+//                report, err := m.SendRecv([]byte("REPORT"))
+//        }()
+//        pong, err := m.SendRecv([]byte("PING"))
+//
+// The server passes requests on streams to its Handler's Respond, like it
+// does pipelined requests. Nothing is retried: once the Mux's connection
+// fails every request on it fails too, and a new Mux is needed.
+type Mux struct {
+	client    *Client
+	conn      *PooledConn
+	lastId    uint32
+	pending   map[uint32]chan streamResponse
+	closed    bool
+	writeLock sync.Mutex
+	sync.Mutex
+}
+
+type streamResponse struct {
+	response []byte
+	err      error
+}
+
+// Mux takes a connection from the pool for a new Mux. The connection is
+// the Mux's until it's closed.
+func (c *Client) Mux() (m *Mux, err error) {
+	conn, err := c.pool.Take()
+	if err != nil {
+		return nil, err
+	}
+	if conn.features&featureStreams == 0 {
+		c.pool.Return(conn)
+		return nil, ErrStreamsUnsupported
+	}
+	m = &Mux{client: c, conn: conn, pending: make(map[uint32]chan streamResponse)}
+	go m.read()
+	return m, nil
+}
+
+// SendRecv sends req on a new stream and waits for its response. It's safe
+// to call from many goroutines at once. Of the Options only WithTimeout and
+// WithMetadata apply to it.
+func (m *Mux) SendRecv(req []byte, opts ...Option) (res []byte, err error) {
+	o := m.client.newRequestOptions(opts)
+	responses := make(chan streamResponse, 1)
+	m.Lock()
+	if m.closed == true {
+		m.Unlock()
+		return nil, ErrMuxClosed
+	}
+	m.lastId++
+	if m.lastId == 0 {
+		// 0 isn't a stream
+		m.lastId++
+	}
+	id := m.lastId
+	m.pending[id] = responses
+	m.Unlock()
+	err = m.send(id, req, o)
+	if err != nil {
+		// the other streams can't be written past a partly written
+		// request, read fails everything once the connection is closed
+		m.conn.Close()
+		return nil, requestError(err, false)
+	}
+	timer := time.NewTimer(o.timeout)
+	defer timer.Stop()
+	select {
+	case r := <-responses:
+		return r.response, r.err
+	case <-timer.C:
+		m.Lock()
+		delete(m.pending, id)
+		m.Unlock()
+		return nil, &RequestError{Kind: ErrTimeout, Err: os.ErrDeadlineExceeded}
+	}
+}
+
+// send writes a request on stream id in one go
+func (m *Mux) send(id uint32, req []byte, o *requestOptions) (err error) {
+	buf := bytes.NewBuffer(streamFrame(id))
+	if len(o.metadata) > 0 {
+		err = writeMetadata(o.metadata, buf)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = writeFrame(req, buf, m.conn.features)
+	if err != nil {
+		return err
+	}
+	m.writeLock.Lock()
+	defer m.writeLock.Unlock()
+	m.conn.SetWriteDeadline(time.Now().Add(o.timeout))
+	_, err = m.conn.Write(buf.Bytes())
+	return err
+}
+
+// Close fails the requests still waiting on their responses with
+// ErrMuxClosed and closes the connection.
+func (m *Mux) Close() error {
+	m.Lock()
+	if m.closed == true {
+		m.Unlock()
+		return ErrMuxClosed
+	}
+	m.closed = true
+	m.Unlock()
+	// read gives the connection up once it sees it's closed
+	return m.conn.Close()
+}
+
+// read hands each response to the request waiting on its stream, until the
+// connection fails or is closed
+func (m *Mux) read() {
+	for {
+		size, info, err := readHeader(m.conn)
+		if err == nil && (info.stream == 0 || size < 0) {
+			err = fmt.Errorf("%w: unexpected frame on a mux connection", ErrProtocol)
+		}
+		var data []byte
+		if err == nil {
+			data, err = readFrame(m.conn, size, m.conn.features)
+		}
+		if err != nil {
+			m.fail(err)
+			return
+		}
+		r := streamResponse{response: data}
+		if info.err == true {
+			r.response, r.err = nil, decodeError(data)
+		} else if info.compressed == true {
+			r.response, r.err = info.codec.decompress(data, 0)
+		}
+		m.Lock()
+		responses, ok := m.pending[info.stream]
+		delete(m.pending, info.stream)
+		m.Unlock()
+		// a request that timed out isn't waiting anymore
+		if ok == true {
+			responses <- r
+		}
+	}
+}
+
+// fail fails the requests waiting on their responses with err, or
+// ErrMuxClosed when the Mux was closed, and gives up the connection
+func (m *Mux) fail(err error) {
+	m.Lock()
+	if m.closed == true {
+		err = ErrMuxClosed
+	}
+	m.closed = true
+	pending := m.pending
+	m.pending = make(map[uint32]chan streamResponse)
+	m.Unlock()
+	for _, responses := range pending {
+		responses <- streamResponse{err: err}
+	}
+	m.client.pool.Discard(m.conn)
+}
@@ -0,0 +1,107 @@
+package tcpez
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bmizerany/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMuxSlowRequestDoesntBlock(t *testing.T) {
+	started := make(chan bool, 1)
+	release := make(chan bool)
+	l, addr := newTestServer(StringHandler(func(req string, span *Span) (string, error) {
+		if req == "SLOW" {
+			started <- true
+			<-release
+		}
+		return req, nil
+	}))
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	m, err := c.Mux()
+	assert.Equal(t, nil, err)
+	defer m.Close()
+
+	slow := make(chan string, 1)
+	go func() {
+		res, _ := m.SendRecv([]byte("SLOW"))
+		slow <- string(res)
+	}()
+	<-started
+	// the fast request is answered while the slow one is still running
+	res, err := m.SendRecv([]byte("FAST"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "FAST", string(res))
+	assert.Equal(t, 0, len(slow))
+	release <- true
+	assert.Equal(t, "SLOW", <-slow)
+	assert.Equal(t, 1, l.NumConnections())
+}
+
+func TestMuxConcurrentRequests(t *testing.T) {
+	l, addr := newTestServer(new(EchoHandler))
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	m, err := c.Mux()
+	assert.Equal(t, nil, err)
+	defer m.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := fmt.Sprintf("PING%d", i)
+			res, err := m.SendRecv([]byte(req))
+			assert.Equal(t, nil, err)
+			assert.Equal(t, req, string(res))
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 1, l.NumConnections())
+}
+
+func TestMuxErrors(t *testing.T) {
+	l, addr := newTestServer(StringHandler(func(req string, span *Span) (string, error) {
+		switch req {
+		case "MISSING":
+			return "", NewStatusError(CodeNotFound, "no such key")
+		case "BROKEN":
+			return "", errors.New("broken")
+		case "HANG":
+			time.Sleep(200 * time.Millisecond)
+		}
+		return req, nil
+	}))
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	m, err := c.Mux()
+	assert.Equal(t, nil, err)
+
+	var remoteErr *RemoteError
+	_, err = m.SendRecv([]byte("MISSING"))
+	assert.T(t, errors.As(err, &remoteErr))
+	assert.Equal(t, CodeNotFound, remoteErr.Code)
+	// any other error fails just the one stream
+	_, err = m.SendRecv([]byte("BROKEN"))
+	assert.T(t, errors.As(err, &remoteErr))
+	assert.Equal(t, CodeUnknown, remoteErr.Code)
+	_, err = m.SendRecv([]byte("HANG"), WithTimeout(20*time.Millisecond))
+	assert.T(t, errors.Is(err, ErrTimeout))
+	// the late response is dropped rather than handed to the next request
+	time.Sleep(250 * time.Millisecond)
+	res, err := m.SendRecv([]byte("PING"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "PING", string(res))
+
+	assert.Equal(t, nil, m.Close())
+	_, err = m.SendRecv([]byte("PING"))
+	assert.Equal(t, ErrMuxClosed, err)
+	assert.Equal(t, ErrMuxClosed, m.Close())
+}
@@ -0,0 +1,81 @@
+package tcpez
+
+import (
+	"time"
+)
+
+// DefaultRequestTimeout is the deadline for a request made by a Client,
+// writing the request and reading the response, unless WithTimeout is given.
+const DefaultRequestTimeout = 10 * time.Second
+
+// An Option configures a single request made with Client.SendRecvOpts.
+type Option func(*requestOptions)
+
+type requestOptions struct {
+	timeout  time.Duration
+	retries  int
+	backend  string
+	metadata map[string]string
+	codec    Codec
+	// oneWay sends the request without waiting on a response, see
+	// SendAndForget
+	oneWay bool
+}
+
+func (c *Client) newRequestOptions(opts []Option) *requestOptions {
+	o := &requestOptions{timeout: DefaultRequestTimeout, retries: c.Retries, codec: c.pool.Compression}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithTimeout sets the deadline for writing the request and reading its
+// response.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *requestOptions) {
+		o.timeout = timeout
+	}
+}
+
+// WithRetries overrides the Client's Retries for the request. Use 0 for
+// requests that should never be sent twice, a negative value is the same.
+func WithRetries(retries int) Option {
+	return func(o *requestOptions) {
+		o.retries = retries
+	}
+}
+
+// WithBackend sends the request to the server at address instead of letting
+// the pool choose one.
+func WithBackend(address string) Option {
+	return func(o *requestOptions) {
+		o.backend = address
+	}
+}
+
+// WithMetadata adds a key/value pair to the metadata sent along with the
+// request. The server makes it available to the handler as span.Metadata.
+func WithMetadata(key, value string) Option {
+	return func(o *requestOptions) {
+		if o.metadata == nil {
+			o.metadata = make(map[string]string)
+		}
+		o.metadata[key] = value
+	}
+}
+
+// WithCompression compresses the request with codec, instead of the
+// ConnectionPool's Compression, when the server has agreed to compression on
+// the connection (see Server.Compression). The server decompresses it before
+// the handler sees it. Requests too small to be worth compressing are sent as
+// is, and so are all requests with CodecNone.
+//
+//        res, err := c.SendRecvOpts(lookup, tcpez.WithCompression(tcpez.CodecFlate))
+//        res, err = c.SendRecvOpts(bulkLoad, tcpez.WithCompression(tcpez.CodecGzip))
+//
+func WithCompression(codec Codec) Option {
+	return func(o *requestOptions) {
+		o.codec = codec
+	}
+}
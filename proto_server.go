@@ -8,7 +8,10 @@
 package tcpez
 
 import (
+	"context"
+	"fmt"
 	"github.com/golang/protobuf/proto"
+	"math/rand"
 	"sync"
 )
 
@@ -22,35 +25,129 @@ type ProtoInitializerFunc func() proto.Message
 // sending the response as []byte, it has the request as an initialized and parsed
 // protobuf and the response in the protocol buffer schema that represents
 // the response. This is then marshalled into a []byte before being sent back
-// to the client
+// to the client. The span is the Server's Span for the request, so the
+// handler can read the client's address from span.RemoteAddr and the metadata
+// sent with the request from span.Metadata, for example to authenticate it.
 type ProtoHandlerFunc func(req proto.Message, res proto.Message, span *Span)
 
+// ProtoHandlerFuncCtx is a ProtoHandlerFunc that is also passed the request's
+// context, span.Context(), so the downstream calls it makes can respect the
+// request's deadline. An error it returns fails the request.
+//
+//        handlerFunc := tcpez.ProtoHandlerFuncCtx(func(ctx context.Context, req proto.Message, res proto.Message, span *tcpez.Span) error {
+//                user, err := users.Get(ctx, req.(*Request).GetArgs())
+//                if err != nil {
+//                        return err
+//                }
+//                res.(*Response).Message = proto.String(user.Name)
+//                return nil
+//        })
+//
+type ProtoHandlerFuncCtx func(ctx context.Context, req proto.Message, res proto.Message, span *Span) error
+
+// ProtoResponseFunc is a ProtoHandlerFuncCtx that returns the message to
+// respond with, so it can pick the type of the response per request. It can
+// fill in and return res as usual, return a message of another type instead,
+// or return nil to respond with res. Only res goes back in the ProtoServer's
+// pool, a message of its own is left to the garbage collector.
+//
+//        handlerFunc := tcpez.ProtoResponseFunc(func(ctx context.Context, req proto.Message, res proto.Message, span *tcpez.Span) (proto.Message, error) {
+//                if req.(*Request).GetCommand() == "STATS" {
+//                        return &StatsResponse{Requests: proto.Int64(requests)}, nil
+//                }
+//                res.(*Response).Status = proto.String("OK")
+//                return res, nil
+//        })
+//
+type ProtoResponseFunc func(ctx context.Context, req proto.Message, res proto.Message, span *Span) (proto.Message, error)
+
 type ProtoServer struct {
-	handler      ProtoHandlerFunc
+	// Validator, if it's set, checks each request once it's unmarshalled.
+	// A request it returns an error for fails with that error without
+	// reaching the ProtoHandlerFunc. Set it before the server is started,
+	// see Server.ProtoServer.
+	Validator    func(req proto.Message) error
+	handler      ProtoResponseFunc
 	requestPool  sync.Pool
 	responsePool sync.Pool
+	// unpooled allocates new messages for every request instead of reusing
+	// them, it's the baseline the pooling is benchmarked against
+	unpooled bool
+	// logSampleRate is set by LogMessages
+	logSampleRate float64
+	// logMessages logs a line of sampled messages, log.Info unless a test
+	// captures them
+	logMessages func(line string)
+}
+
+// LogMessages logs the request and response messages, as protobuf text, of a
+// sampleRate fraction of the requests: 1 logs every request and 0 (the
+// default) none. A request that fails is logged with its error instead of a
+// response. It's meant for debugging, and like the Validator should be set
+// before the server is started.
+//
+//        server.ProtoServer().LogMessages(0.01)
+//
+func (s *ProtoServer) LogMessages(sampleRate float64) {
+	s.logSampleRate = sampleRate
+}
+
+// logExchange logs req and res (or err) if the request is sampled
+func (s *ProtoServer) logExchange(span *Span, req proto.Message, res proto.Message, err error) {
+	if s.logSampleRate <= 0 || rand.Float64() >= s.logSampleRate {
+		return
+	}
+	var line string
+	if err != nil {
+		line = fmt.Sprintf("[pb] span %s request: %s error: %s", span.Id, proto.CompactTextString(req), err.Error())
+	} else {
+		line = fmt.Sprintf("[pb] span %s request: %s response: %s", span.Id, proto.CompactTextString(req), proto.CompactTextString(res))
+	}
+	if s.logMessages != nil {
+		s.logMessages(line)
+		return
+	}
+	log.Info("%s", line)
 }
 
 // Respond() does not need to be called by any outside objects, it is the method
 // that fullfills the RequestHandler interface for the tcpez.Server. It uses the
 // ProtoInitializerFunc and ProtoHandlerFunc to handle the actual request after
-// marshalling and unmarshalling the request and response objects
+// marshalling and unmarshalling the request and response objects. The time
+// spent unmarshalling the request, in the ProtoHandlerFunc and marshalling the
+// response are the pb.parse, pb.response and pb.encode SubSpans, which the
+// Server sends on to its StatsRecorder as timers along with the rest of the
+// Span.
 func (s *ProtoServer) Respond(req []byte, span *Span) (res []byte, err error) {
-	request := s.requestPool.Get().(proto.Message)
-	defer returnProtoToPool(s.requestPool, request)
+	request := s.getMessage(&s.requestPool)
+	defer s.putMessage(&s.requestPool, request)
 	span.Start("pb.parse")
 	err = proto.Unmarshal(req, request)
 	if err != nil {
 		return nil, err
 	}
+	if s.Validator != nil {
+		err = s.Validator(request)
+		if err != nil {
+			span.Increment("pb.invalid")
+			return nil, err
+		}
+	}
 	span.Start("pb.response")
 	span.Finish("pb.parse")
-	response := s.responsePool.Get().(proto.Message)
-	defer returnProtoToPool(s.responsePool, response)
-	s.handler(request, response, span)
+	response := s.getMessage(&s.responsePool)
+	defer s.putMessage(&s.responsePool, response)
+	message, err := s.handler(span.Context(), request, response, span)
 	span.Finish("pb.response")
+	if message == nil {
+		message = response
+	}
+	s.logExchange(span, request, message, err)
+	if err != nil {
+		return nil, err
+	}
 	span.Start("pb.encode")
-	res, err = proto.Marshal(response)
+	res, err = proto.Marshal(message)
 	span.Finish("pb.encode")
 	return
 }
@@ -84,20 +181,79 @@ func (s *ProtoServer) Respond(req []byte, span *Span) (res []byte, err error) {
 // 	go server.Start()
 //
 func NewProtoServer(address string, requestInitializer ProtoInitializerFunc, responseInitializer ProtoInitializerFunc, handler ProtoHandlerFunc) (s *Server, err error) {
-	requestPool := sync.Pool{
-		New: func() interface{} {
-			return requestInitializer()
-		},
+	return NewServer(address, NewProtoHandler(requestInitializer, responseInitializer, handler))
+}
+
+// ProtoServer returns the ProtoServer a Server created with NewProtoServer
+// serves, to configure it after the fact, or nil if the Server's Handler
+// isn't a ProtoServer.
+//
+//        server, _ := tcpez.NewProtoServer(":2222", requestFunc, responseFunc, handlerFunc)
+//        server.ProtoServer().Validator = validateRequest
+//
+func (s *Server) ProtoServer() *ProtoServer {
+	p, _ := s.Handler.(*ProtoServer)
+	return p
+}
+
+// NewProtoHandler creates the ProtoServer that NewProtoServer serves, without
+// binding to an address. Use it to serve protobufs from a Server created some
+// other way, or to test a ProtoHandlerFunc with TestClient.
+func NewProtoHandler(requestInitializer ProtoInitializerFunc, responseInitializer ProtoInitializerFunc, handler ProtoHandlerFunc) *ProtoServer {
+	return NewProtoHandlerCtx(requestInitializer, responseInitializer, func(ctx context.Context, req proto.Message, res proto.Message, span *Span) error {
+		handler(req, res, span)
+		return nil
+	})
+}
+
+// NewProtoServerCtx is NewProtoServer for a ProtoHandlerFuncCtx.
+func NewProtoServerCtx(address string, requestInitializer ProtoInitializerFunc, responseInitializer ProtoInitializerFunc, handler ProtoHandlerFuncCtx) (s *Server, err error) {
+	return NewServer(address, NewProtoHandlerCtx(requestInitializer, responseInitializer, handler))
+}
+
+// NewProtoHandlerCtx is NewProtoHandler for a ProtoHandlerFuncCtx.
+func NewProtoHandlerCtx(requestInitializer ProtoInitializerFunc, responseInitializer ProtoInitializerFunc, handler ProtoHandlerFuncCtx) *ProtoServer {
+	return NewProtoResponseHandler(requestInitializer, responseInitializer, func(ctx context.Context, req proto.Message, res proto.Message, span *Span) (proto.Message, error) {
+		return res, handler(ctx, req, res, span)
+	})
+}
+
+// NewProtoResponseServer is NewProtoServer for a ProtoResponseFunc.
+func NewProtoResponseServer(address string, requestInitializer ProtoInitializerFunc, responseInitializer ProtoInitializerFunc, handler ProtoResponseFunc) (s *Server, err error) {
+	return NewServer(address, NewProtoResponseHandler(requestInitializer, responseInitializer, handler))
+}
+
+// NewProtoResponseHandler is NewProtoHandler for a ProtoResponseFunc.
+func NewProtoResponseHandler(requestInitializer ProtoInitializerFunc, responseInitializer ProtoInitializerFunc, handler ProtoResponseFunc) *ProtoServer {
+	s := &ProtoServer{handler: handler}
+	// the pools are set up in place, a sync.Pool must not be copied
+	s.requestPool.New = func() interface{} {
+		return requestInitializer()
+	}
+	s.responsePool.New = func() interface{} {
+		return responseInitializer()
 	}
-	responsePool := sync.Pool{
-		New: func() interface{} {
-			return responseInitializer()
-		},
+	return s
+}
+
+// getMessage takes a message from pool, or makes a new one if s is unpooled
+func (s *ProtoServer) getMessage(pool *sync.Pool) proto.Message {
+	if s.unpooled == true {
+		return pool.New().(proto.Message)
+	}
+	return pool.Get().(proto.Message)
+}
+
+// putMessage puts a message from getMessage back in pool
+func (s *ProtoServer) putMessage(pool *sync.Pool, p proto.Message) {
+	if s.unpooled == true {
+		return
 	}
-	return NewServer(address, &ProtoServer{handler, requestPool, responsePool})
+	returnProtoToPool(pool, p)
 }
 
-func returnProtoToPool(pool sync.Pool, p proto.Message) {
+// returnProtoToPool resets p and puts it back in pool for the next request
+func returnProtoToPool(pool *sync.Pool, p proto.Message) {
 	p.Reset()
 	pool.Put(p)
 }
@@ -0,0 +1,140 @@
+package tcpez
+
+import (
+	"github.com/golang/protobuf/proto"
+	"sync"
+)
+
+// ProtoStreamHandlerFunc is the ProtoHandlerFunc of a request that is answered
+// with many messages instead of one, like the results of a search. It calls
+// send with each message, which marshals it into a frame of its own and
+// writes it to the client straight away. An error returned by send or by the
+// handler fails the request, ending the stream.
+type ProtoStreamHandlerFunc func(req proto.Message, send func(proto.Message) error, span *Span) error
+
+// ProtoStreamServer is the StreamRequestHandler that serves a
+// ProtoStreamHandlerFunc, see NewProtoStreamServer.
+type ProtoStreamServer struct {
+	handler     ProtoStreamHandlerFunc
+	requestPool sync.Pool
+}
+
+// RespondStream fulfills the StreamRequestHandler interface. The time spent
+// unmarshalling the request and in the ProtoStreamHandlerFunc are the
+// pb.parse and pb.response SubSpans, and the number of messages sent is the
+// pb.messages counter.
+func (s *ProtoStreamServer) RespondStream(req []byte, sendFrame func([]byte) error, span *Span) (err error) {
+	request := s.requestPool.Get().(proto.Message)
+	defer returnProtoToPool(&s.requestPool, request)
+	span.Start("pb.parse")
+	err = proto.Unmarshal(req, request)
+	if err != nil {
+		return err
+	}
+	span.Start("pb.response")
+	span.Finish("pb.parse")
+	send := func(message proto.Message) error {
+		frame, err := proto.Marshal(message)
+		if err != nil {
+			return err
+		}
+		err = sendFrame(frame)
+		if err != nil {
+			return err
+		}
+		span.Increment("pb.messages")
+		return nil
+	}
+	err = s.handler(request, send, span)
+	span.Finish("pb.response")
+	return err
+}
+
+// NewProtoStreamHandler creates the handler NewProtoStreamServer serves,
+// without binding to an address.
+func NewProtoStreamHandler(requestInitializer ProtoInitializerFunc, handler ProtoStreamHandlerFunc) RequestHandler {
+	s := &ProtoStreamServer{handler: handler}
+	s.requestPool.New = func() interface{} {
+		return requestInitializer()
+	}
+	return StreamHandler(s)
+}
+
+// NewProtoStreamServer initializes a tcpez.Server that answers each protobuf
+// request with the stream of messages its ProtoStreamHandlerFunc sends. Read
+// them with a ProtoClient's DoStream.
+//
+//        handlerFunc := tcpez.ProtoStreamHandlerFunc(func(req proto.Message, send func(proto.Message) error, span *tcpez.Span) error {
+//                for _, result := range search(req.(*SearchRequest)) {
+//                        if err := send(result); err != nil {
+//                                return err
+//                        }
+//                }
+//                return nil
+//        })
+//        server, err := tcpez.NewProtoStreamServer(":2222", requestFunc, handlerFunc)
+//
+func NewProtoStreamServer(address string, requestInitializer ProtoInitializerFunc, handler ProtoStreamHandlerFunc) (s *Server, err error) {
+	return NewServer(address, NewProtoStreamHandler(requestInitializer, handler))
+}
+
+// ProtoClient sends protobuf requests with a Client and unmarshals the
+// responses into messages from its ProtoInitializerFunc.
+type ProtoClient struct {
+	*Client
+	responseInitializer ProtoInitializerFunc
+}
+
+// NewProtoClient creates a ProtoClient that makes its requests with client.
+func NewProtoClient(client *Client, responseInitializer ProtoInitializerFunc) *ProtoClient {
+	return &ProtoClient{Client: client, responseInitializer: responseInitializer}
+}
+
+// ProtoStreamMessage is a message read off a stream by DoStream, or the error
+// the stream failed with.
+type ProtoStreamMessage struct {
+	Message proto.Message
+	Err     error
+}
+
+// protoStreamBuffer is how many of the messages DoStream has read can wait
+// on the caller, past that it stops reading until they're taken
+const protoStreamBuffer = 16
+
+// DoStream sends req to a ProtoStreamServer and returns a channel its
+// messages are delivered on as they arrive, in the order they were sent. If
+// the stream fails part way through, its last ProtoStreamMessage has the
+// error. The channel is closed once the stream has ended, and has to be read
+// until then, the connection is held up until it is.
+//
+//        results, err := c.DoStream(&SearchRequest{Query: proto.String("cats")})
+//        for result := range results {
+//                if result.Err != nil {
+//                        return result.Err
+//                }
+//                result.Message.(*SearchResult)
+//        }
+//
+func (c *ProtoClient) DoStream(req proto.Message) (<-chan ProtoStreamMessage, error) {
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	messages := make(chan ProtoStreamMessage, protoStreamBuffer)
+	go func() {
+		defer close(messages)
+		err := c.SendRecvStream(data, func(frame []byte) error {
+			message := c.responseInitializer()
+			err := proto.Unmarshal(frame, message)
+			if err != nil {
+				return err
+			}
+			messages <- ProtoStreamMessage{Message: message}
+			return nil
+		})
+		if err != nil {
+			messages <- ProtoStreamMessage{Err: err}
+		}
+	}()
+	return messages, nil
+}
@@ -0,0 +1,80 @@
+package tcpez
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bmizerany/assert"
+	"github.com/golang/protobuf/proto"
+	"testing"
+)
+
+func TestProtoStream(t *testing.T) {
+	requestFunc := ProtoInitializerFunc(func() proto.Message {
+		return new(Request)
+	})
+	responseFunc := ProtoInitializerFunc(func() proto.Message {
+		return new(Response)
+	})
+	handlerFunc := ProtoStreamHandlerFunc(func(req proto.Message, send func(proto.Message) error, span *Span) error {
+		r := req.(*Request)
+		for i := 0; i < 10; i++ {
+			err := send(&Response{Status: proto.String("OK"), Message: proto.String(fmt.Sprintf("%s %d", r.GetArgs(), i))})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	c := NewProtoClient(TestClient(NewProtoStreamHandler(requestFunc, handlerFunc)), responseFunc)
+	defer c.Close()
+
+	messages, err := c.DoStream(&Request{Command: proto.String("SEARCH"), Args: proto.String("cats")})
+	assert.Equal(t, nil, err)
+	i := 0
+	for message := range messages {
+		assert.Equal(t, nil, message.Err)
+		assert.Equal(t, fmt.Sprintf("cats %d", i), message.Message.(*Response).GetMessage())
+		i++
+	}
+	assert.Equal(t, 10, i)
+}
+
+func TestProtoStreamIncremental(t *testing.T) {
+	requestFunc := ProtoInitializerFunc(func() proto.Message {
+		return new(Request)
+	})
+	responseFunc := ProtoInitializerFunc(func() proto.Message {
+		return new(Response)
+	})
+	received := make(chan bool)
+	handlerFunc := ProtoStreamHandlerFunc(func(req proto.Message, send func(proto.Message) error, span *Span) error {
+		for i := 0; i < 3; i++ {
+			err := send(&Response{Status: proto.String("OK"), Message: proto.String(fmt.Sprintf("%d", i))})
+			if err != nil {
+				return err
+			}
+			// the client has the message before the next one is made
+			<-received
+		}
+		return NewStatusError(CodeAborted, "search interrupted")
+	})
+	c := NewProtoClient(TestClient(NewProtoStreamHandler(requestFunc, handlerFunc)), responseFunc)
+	defer c.Close()
+
+	messages, err := c.DoStream(&Request{Command: proto.String("SEARCH"), Args: proto.String("cats")})
+	assert.Equal(t, nil, err)
+	for i := 0; i < 3; i++ {
+		message := <-messages
+		assert.Equal(t, nil, message.Err)
+		assert.Equal(t, fmt.Sprintf("%d", i), message.Message.(*Response).GetMessage())
+		received <- true
+	}
+	// the error the stream ended with comes last
+	message, ok := <-messages
+	assert.T(t, ok)
+	var remoteErr *RemoteError
+	assert.T(t, errors.As(message.Err, &remoteErr))
+	assert.Equal(t, CodeAborted, remoteErr.Code)
+	_, ok = <-messages
+	assert.T(t, !ok)
+}
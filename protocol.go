@@ -0,0 +1,553 @@
+package tcpez
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"net"
+)
+
+// ProtocolVersion is the version of the tcpez protocol spoken by this package.
+// Clients and servers only talk to peers with the same version.
+const ProtocolVersion byte = 1
+
+// ErrProtocol is matched (with errors.Is) by the errors returned when the
+// peer sends something that isn't valid tcpez protocol.
+var ErrProtocol = errors.New("tcpez: protocol error")
+
+// ErrProtocolMismatch is returned when the peer on the other end of a
+// connection is not speaking a compatible version of the tcpez protocol.
+var ErrProtocolMismatch = fmt.Errorf("%w: version mismatch", ErrProtocol)
+
+// ErrChecksumMismatch is returned when a frame's data doesn't match the
+// checksum sent with it, meaning it was corrupted on the way. It matches
+// ErrProtocol too, and the Client retries requests that fail with it.
+var ErrChecksumMismatch = fmt.Errorf("%w: checksum mismatch", ErrProtocol)
+
+// Every connection starts with a handshake so an incompatible peer is
+// detected up front instead of showing up as garbled frames later. The
+// client sends a hello and the server answers with its own, both in the form
+// |magic|version|features|. The server always answers, even if it rejects
+// the client, so the client can report the mismatch before disconnecting.
+var handshakeMagic = [4]byte{'t', 'c', 'p', 'z'}
+
+const helloLength = 6
+
+// features are negotiated during the handshake, the features of a connection
+// are the ones both the client and the server asked for.
+type features byte
+
+const (
+	// featureCompression lets the server gzip the responses it sends
+	featureCompression features = 1 << iota
+	// featureChecksum adds a CRC32 trailer to the frames the client and the
+	// server send, see writeFrame
+	featureChecksum
+	// featureStreams lets the client tag requests with a stream id, see
+	// controlStream
+	featureStreams
+	// featureCodecs lets the client compress requests with any Codec, see
+	// controlCodec
+	featureCodecs
+	// featurePipelineDigest has the client put a pipelineDigest in front of
+	// its pipelines and the server echo it in front of the responses, see
+	// controlPipeline
+	featurePipelineDigest
+	// featureOneWay lets the client send requests the server doesn't
+	// answer, see controlOneWay
+	featureOneWay
+)
+
+func writeHello(w io.Writer, f features) (err error) {
+	hello := make([]byte, 0, helloLength)
+	hello = append(hello, handshakeMagic[:]...)
+	hello = append(hello, ProtocolVersion, byte(f))
+	_, err = w.Write(hello)
+	return err
+}
+
+func readHello(r io.Reader) (f features, err error) {
+	hello := make([]byte, helloLength)
+	_, err = io.ReadFull(r, hello)
+	if err != nil {
+		return 0, err
+	}
+	if bytes.Equal(hello[:4], handshakeMagic[:]) == false {
+		return 0, fmt.Errorf("%w: unexpected handshake %q", ErrProtocolMismatch, hello)
+	}
+	if hello[4] != ProtocolVersion {
+		return 0, fmt.Errorf("%w: peer speaks version %d, expected %d", ErrProtocolMismatch, hello[4], ProtocolVersion)
+	}
+	return features(hello[5]), nil
+}
+
+// clientHandshake sends the client's hello and returns the features the
+// server agreed to.
+func clientHandshake(rw io.ReadWriter, f features) (negotiated features, err error) {
+	err = writeHello(rw, f)
+	if err != nil {
+		return 0, err
+	}
+	return readHello(rw)
+}
+
+// serverHandshake reads the client's hello and answers it, agreeing to the
+// features that both sides support.
+func serverHandshake(rw io.ReadWriter, supported features) (negotiated features, err error) {
+	requested, err := readHello(rw)
+	negotiated = requested & supported
+	if werr := writeHello(rw, negotiated); err == nil {
+		err = werr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return negotiated, nil
+}
+
+// Control frames extend the protocol without changing how plain requests and
+// responses are framed. A control frame is a header of frameControl (which
+// can never be a valid pipeline count) followed by a one byte kind and the
+// kind's payload. It applies to the frame that follows it.
+const frameControl int32 = math.MinInt32
+
+const (
+	// |frameControl|controlMetadata|int32 count|count x (|length|key|length|value|)|
+	controlMetadata byte = 1
+	// |frameControl|controlCompressed|, the data of the next frame is gzipped
+	controlCompressed byte = 2
+	// |frameControl|controlMulti|, the next frame is a response made up of
+	// several frames, framed like a pipeline response: |-count| followed by
+	// count x (|length|data|)
+	controlMulti byte = 3
+	// |frameControl|controlError|, the next frame is an error instead of a
+	// response, its data is |code|message| with a one byte Code
+	controlError byte = 4
+	// |frameControl|controlStream|uint32 id|, the next frame is a request
+	// on the stream id, or the response to it. The server handles the
+	// requests of different streams concurrently and answers each one as
+	// soon as it's ready, so the responses can arrive out of order.
+	controlStream byte = 5
+	// |frameControl|controlCodec|codec|, the data of the next frame is
+	// compressed with the one byte Codec. controlCompressed is the same as
+	// a controlCodec for CodecGzip.
+	controlCodec byte = 6
+	// |frameControl|controlPipeline|uint32 sequence|int32 count|, in front
+	// of a pipeline the client's sequence number of the pipeline on the
+	// connection and its count of requests. The server echoes the sequence
+	// number in front of the responses, with the count of requests it read
+	// from the pipeline's header, so the client can tell responses that
+	// aren't the ones to its pipeline (or a pipeline header that was
+	// corrupted) from a server answering with the wrong number of them.
+	controlPipeline byte = 7
+	// |frameControl|controlOneWay|, the next frame is a request the client
+	// isn't waiting on a response to. The server handles it and answers
+	// nothing, not even an error.
+	controlOneWay byte = 8
+	// |frameControl|controlMore|, the next frame is one of the frames of a
+	// streamed response, written as soon as the handler sends it, and more
+	// follow. The stream ends with a frame without it: an empty response,
+	// or an error.
+	controlMore byte = 9
+)
+
+// pipelineDigest is the payload of a controlPipeline
+type pipelineDigest struct {
+	sequence uint32
+	count    int32
+}
+
+// frameInfo is what the control frames in front of a frame said about it
+type frameInfo struct {
+	metadata   map[string]string
+	compressed bool
+	// codec is what the frame is compressed with, when it's compressed
+	codec Codec
+	multi bool
+	err   bool
+	// stream is the id of the stream the frame is on, 0 if it isn't
+	stream uint32
+	// digest is the pipelineDigest in front of a pipeline, or of the
+	// responses to one
+	digest *pipelineDigest
+	oneWay bool
+	// more marks a frame of a streamed response that isn't the last
+	more bool
+}
+
+func writeControl(kind byte, w io.Writer) (err error) {
+	_, err = w.Write(controlFrame(kind))
+	return err
+}
+
+// streamFrame returns the bytes of the control frame that puts the next
+// frame on stream id
+func streamFrame(id uint32) []byte {
+	frame := make([]byte, 9)
+	copy(frame, controlFrame(controlStream))
+	binary.BigEndian.PutUint32(frame[5:], id)
+	return frame
+}
+
+// codecFrame returns the bytes of the control frame that marks the next frame
+// as compressed with codec
+func codecFrame(codec Codec) []byte {
+	if codec == CodecGzip {
+		return controlFrame(controlCompressed)
+	}
+	return append(controlFrame(controlCodec), byte(codec))
+}
+
+// digestFrame returns the bytes of the control frame that puts digest in
+// front of a pipeline
+func digestFrame(digest pipelineDigest) []byte {
+	frame := make([]byte, 13)
+	copy(frame, controlFrame(controlPipeline))
+	binary.BigEndian.PutUint32(frame[5:], digest.sequence)
+	binary.BigEndian.PutUint32(frame[9:], uint32(digest.count))
+	return frame
+}
+
+// controlFrame returns the bytes of a control frame without a payload
+func controlFrame(kind byte) []byte {
+	frame := make([]byte, 5)
+	header := frameControl
+	binary.BigEndian.PutUint32(frame, uint32(header))
+	frame[4] = kind
+	return frame
+}
+
+func writeMetadata(metadata map[string]string, w io.Writer) (err error) {
+	err = writeControl(controlMetadata, w)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(w, binary.BigEndian, int32(len(metadata)))
+	if err != nil {
+		return err
+	}
+	for k, v := range metadata {
+		_, err = writeDataWithLength([]byte(k), w)
+		if err != nil {
+			return err
+		}
+		_, err = writeDataWithLength([]byte(v), w)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readMetadata(r io.Reader) (metadata map[string]string, err error) {
+	var count int32
+	err = binary.Read(r, binary.BigEndian, &count)
+	if err != nil {
+		return nil, err
+	}
+	metadata = make(map[string]string, count)
+	for i := int32(0); i < count; i++ {
+		k, err := readDataWithLength(r)
+		if err != nil {
+			return nil, err
+		}
+		v, err := readDataWithLength(r)
+		if err != nil {
+			return nil, err
+		}
+		metadata[string(k)] = string(v)
+	}
+	return metadata, nil
+}
+
+// When featureChecksum is negotiated the data of a single (not pipelined)
+// request or response, and of each frame of a multi-frame response, is
+// followed by its CRC32 (IEEE): |length|data|crc32|. Zero length frames,
+// keepalives and empty responses, have no trailer.
+
+// writeFrame writes data with its length header, and its checksum trailer if
+// f includes featureChecksum
+func writeFrame(data []byte, w io.Writer, f features) (length int, err error) {
+	if f&featureChecksum == 0 || len(data) == 0 {
+		return writeDataWithLength(data, w)
+	}
+	buffers := frameBuffers(data, f)
+	_, err = buffers.WriteTo(unwrapConn(w))
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// frameBuffers returns the length header, the data and, if f includes
+// featureChecksum, the checksum trailer of a frame
+func frameBuffers(data []byte, f features) net.Buffers {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(data)))
+	if f&featureChecksum == 0 || len(data) == 0 {
+		return net.Buffers{header, data}
+	}
+	trailer := make([]byte, 4)
+	binary.BigEndian.PutUint32(trailer, crc32.ChecksumIEEE(data))
+	return net.Buffers{header, data, trailer}
+}
+
+// writeBuffers writes buffers to w in one go, so they aren't sent as
+// separate packets. On a TCP (or unix) connection that is a single writev,
+// anything else gets them copied together into a single Write.
+func writeBuffers(buffers net.Buffers, w io.Writer) (err error) {
+	switch w.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		_, err = buffers.WriteTo(w)
+		return err
+	}
+	_, err = w.Write(bytes.Join(buffers, nil))
+	return err
+}
+
+// readFrame reads the size bytes of data of a frame whose header has already
+// been read, and checks its checksum trailer if f includes featureChecksum
+func readFrame(r io.Reader, size int32, f features) (data []byte, err error) {
+	data = make([]byte, size)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, err
+	}
+	if f&featureChecksum != 0 && size > 0 {
+		err = verifyChecksum(crc32.ChecksumIEEE(data), r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// verifyChecksum reads a checksum trailer and compares it with sum, the
+// checksum of the data that was read
+func verifyChecksum(sum uint32, r io.Reader) (err error) {
+	var expected uint32
+	err = binary.Read(r, binary.BigEndian, &expected)
+	if err != nil {
+		return err
+	}
+	if sum != expected {
+		return fmt.Errorf("%w: got %08x, expected %08x", ErrChecksumMismatch, sum, expected)
+	}
+	return nil
+}
+
+// compressionMinLength is the smallest response worth compressing, below it
+// the gzip header and footer outweigh whatever is saved
+const compressionMinLength = 128
+
+func compress(data []byte) (compressed []byte, err error) {
+	buf := bytes.NewBuffer(nil)
+	w := gzip.NewWriter(buf)
+	_, err = w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(compressed []byte, limit int64) (data []byte, err error) {
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readDecompressed(r, limit)
+}
+
+// readHeader reads the next frame header, consuming any control frames in
+// front of it.
+func readHeader(r io.Reader) (header int32, info frameInfo, err error) {
+	for {
+		err = binary.Read(r, binary.BigEndian, &header)
+		if err != nil {
+			return 0, info, err
+		}
+		if header != frameControl {
+			return header, info, nil
+		}
+		var kind [1]byte
+		_, err = io.ReadFull(r, kind[:])
+		if err != nil {
+			return 0, info, err
+		}
+		switch kind[0] {
+		case controlMetadata:
+			info.metadata, err = readMetadata(r)
+			if err != nil {
+				return 0, info, err
+			}
+		case controlCompressed:
+			info.compressed = true
+			info.codec = CodecGzip
+		case controlCodec:
+			_, err = io.ReadFull(r, kind[:])
+			if err != nil {
+				return 0, info, err
+			}
+			info.compressed = true
+			info.codec = Codec(kind[0])
+			if _, ok := codecNames[info.codec]; ok == false || info.codec == CodecNone {
+				return 0, info, fmt.Errorf("%w: unknown codec %d", ErrProtocol, kind[0])
+			}
+		case controlMulti:
+			info.multi = true
+		case controlError:
+			info.err = true
+		case controlStream:
+			err = binary.Read(r, binary.BigEndian, &info.stream)
+			if err != nil {
+				return 0, info, err
+			}
+			if info.stream == 0 {
+				return 0, info, fmt.Errorf("%w: invalid stream id 0", ErrProtocol)
+			}
+		case controlOneWay:
+			info.oneWay = true
+		case controlMore:
+			info.more = true
+		case controlPipeline:
+			var payload [8]byte
+			_, err = io.ReadFull(r, payload[:])
+			if err != nil {
+				return 0, info, err
+			}
+			info.digest = &pipelineDigest{
+				sequence: binary.BigEndian.Uint32(payload[:4]),
+				count:    int32(binary.BigEndian.Uint32(payload[4:])),
+			}
+		default:
+			return 0, info, fmt.Errorf("%w: unknown control frame kind %d", ErrProtocol, kind[0])
+		}
+	}
+}
+
+// readResponse reads a single (not pipelined) response, decompressing it if
+// the server compressed it. The frames of a multi-frame response are joined
+// together.
+func readResponse(r io.Reader, f features) (response []byte, err error) {
+	frames, err := readMultiResponse(r, f)
+	if err != nil {
+		return nil, err
+	}
+	if len(frames) == 1 {
+		return frames[0], nil
+	}
+	return bytes.Join(frames, nil), nil
+}
+
+// readMultiResponse reads a single (not pipelined) response as the frames it
+// is made up of, a response that isn't multi-frame is a single frame. A
+// streamed response is read to its end.
+func readMultiResponse(r io.Reader, f features) (frames [][]byte, err error) {
+	size, info, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if info.more == true {
+		// a streamed response, read to its end
+		if size < 0 {
+			return nil, fmt.Errorf("%w: invalid frame length %d", ErrProtocol, size)
+		}
+		frame, err := readFrame(r, size, f)
+		if err != nil {
+			return nil, err
+		}
+		frames = [][]byte{frame}
+		for {
+			frame, more, err := readStreamedFrame(r, f)
+			if err != nil {
+				return nil, err
+			}
+			if more == false {
+				return frames, nil
+			}
+			frames = append(frames, frame)
+		}
+	}
+	if info.multi == true {
+		if size > 0 {
+			return nil, fmt.Errorf("%w: invalid frame count %d", ErrProtocol, -size)
+		}
+		frames = make([][]byte, -size)
+		for i := range frames {
+			var length int32
+			err = binary.Read(r, binary.BigEndian, &length)
+			if err != nil {
+				return nil, err
+			}
+			if length < 0 {
+				return nil, fmt.Errorf("%w: invalid frame length %d", ErrProtocol, length)
+			}
+			frames[i], err = readFrame(r, length, f)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return frames, nil
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("%w: invalid frame length %d", ErrProtocol, size)
+	}
+	response, err := readFrame(r, size, f)
+	if err != nil {
+		return nil, err
+	}
+	if info.err == true {
+		return nil, decodeError(response)
+	}
+	if info.compressed == true {
+		response, err = info.codec.decompress(response, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return [][]byte{response}, nil
+}
+
+// readStreamedFrame reads the next frame of a streamed response, more is
+// false once it has ended
+func readStreamedFrame(r io.Reader, f features) (frame []byte, more bool, err error) {
+	size, info, err := readHeader(r)
+	if err != nil {
+		return nil, false, err
+	}
+	if size < 0 {
+		return nil, false, fmt.Errorf("%w: invalid frame length %d", ErrProtocol, size)
+	}
+	frame, err = readFrame(r, size, f)
+	if err != nil {
+		return nil, false, err
+	}
+	if info.err == true {
+		return nil, false, decodeError(frame)
+	}
+	return frame, info.more, nil
+}
+
+// errorFrame returns the data of an error frame
+func errorFrame(code Code, message string) []byte {
+	return append([]byte{byte(code)}, message...)
+}
+
+// decodeError turns the data of an error frame into the RemoteError it
+// stands for
+func decodeError(data []byte) error {
+	if len(data) == 0 {
+		return fmt.Errorf("%w: empty error frame", ErrProtocol)
+	}
+	return &RemoteError{Code: Code(data[0]), Message: string(data[1:])}
+}
@@ -0,0 +1,99 @@
+package tcpez
+
+import (
+	"bytes"
+	"errors"
+	"github.com/bmizerany/assert"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReadHeaderWithMetadata(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	err := writeMetadata(map[string]string{"user": "bob", "role": "admin"}, buf)
+	assert.T(t, err == nil)
+	writeDataWithLength([]byte("PING"), buf)
+	header, info, err := readHeader(buf)
+	assert.T(t, err == nil)
+	assert.Equal(t, int32(4), header)
+	assert.Equal(t, map[string]string{"user": "bob", "role": "admin"}, info.metadata)
+	assert.Equal(t, "PING", buf.String())
+}
+
+func TestHandshake(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go serverHandshake(server, 0)
+	f, err := clientHandshake(client, 0)
+	assert.T(t, err == nil)
+	assert.Equal(t, features(0), f)
+}
+
+func TestHandshakeMismatchedServer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.T(t, err == nil)
+	defer l.Close()
+	addr := l.Addr().String()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		hello := make([]byte, helloLength)
+		io.ReadFull(conn, hello)
+		conn.Write([]byte{'t', 'c', 'p', 'z', ProtocolVersion + 1, 0})
+	}()
+	c, err := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c == nil)
+	assert.T(t, errors.Is(err, ErrProtocolMismatch))
+}
+
+func TestHandshakeMismatchedClient(t *testing.T) {
+	l, addr := newTestServer(new(EchoHandler))
+	defer l.Close()
+	conn, err := net.Dial("tcp", addr)
+	assert.T(t, err == nil)
+	defer conn.Close()
+	// a client that doesn't handshake gets the server's hello and is
+	// disconnected rather than getting a garbled response
+	_, err = writeDataWithLength([]byte("PING"), conn)
+	assert.T(t, err == nil)
+	_, err = readHello(conn)
+	assert.T(t, err == nil)
+	_, err = conn.Read(make([]byte, 1))
+	assert.T(t, err != nil)
+	// the same goes for a client speaking another version
+	conn, err = net.Dial("tcp", addr)
+	assert.T(t, err == nil)
+	defer conn.Close()
+	conn.Write([]byte{'t', 'c', 'p', 'z', ProtocolVersion + 1, 0})
+	_, err = readHello(conn)
+	assert.T(t, err == nil)
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestKeepalive(t *testing.T) {
+	l, addr := newTestServer(new(EchoHandler))
+	defer l.Close()
+	conn, err := net.Dial("tcp", addr)
+	assert.T(t, err == nil)
+	defer conn.Close()
+	_, err = clientHandshake(conn, 0)
+	assert.T(t, err == nil)
+	for i := 0; i < 3; i++ {
+		_, err = writeDataWithLength(nil, conn)
+		assert.T(t, err == nil)
+		res, err := readDataWithLength(conn)
+		assert.T(t, err == nil)
+		assert.Equal(t, 0, len(res))
+	}
+	// the stream is still in sync for a real request
+	writeDataWithLength([]byte("PING"), conn)
+	res, err := readDataWithLength(conn)
+	assert.T(t, err == nil)
+	assert.Equal(t, "PING", string(res))
+}
@@ -0,0 +1,95 @@
+package tcpez
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Resolver looks up the current set of backend addresses ("host:port")
+// behind a single name. A ConnectionPool created with NewResolvingConnectionPool
+// periodically asks its Resolver for the current set and updates its Addresses.
+type Resolver interface {
+	Resolve(name string) ([]string, error)
+}
+
+// DNSResolver resolves a "host:port" name through its A/AAAA records, returning
+// one address per ip with the port kept as is.
+type DNSResolver struct{}
+
+func (r *DNSResolver) Resolve(name string) (addresses []string, err error) {
+	host, port, err := net.SplitHostPort(name)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.LookupHost(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		addresses = append(addresses, net.JoinHostPort(ip, port))
+	}
+	return addresses, nil
+}
+
+// SRVResolver resolves a name through its SRV records, returning the target
+// and port of each record. Service and Proto are passed to net.LookupSRV
+// (e.g. "tcpez" and "tcp" for _tcpez._tcp.name), leave them empty to lookup
+// the name directly.
+type SRVResolver struct {
+	Service string
+	Proto   string
+}
+
+func (r *SRVResolver) Resolve(name string) (addresses []string, err error) {
+	_, srvs, err := net.LookupSRV(r.Service, r.Proto, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, srv := range srvs {
+		target := strings.TrimSuffix(srv.Target, ".")
+		addresses = append(addresses, net.JoinHostPort(target, strconv.Itoa(int(srv.Port))))
+	}
+	return addresses, nil
+}
+
+// NewResolvingConnectionPool creates a ConnectionPool for the addresses that name
+// resolves to and re-resolves it every refresh, updating the pool's addresses
+// with SetAddresses as backends come and go.
+func NewResolvingConnectionPool(name string, resolver Resolver, refresh time.Duration, initial int, timeout time.Duration) (p *ConnectionPool, err error) {
+	addresses, err := resolver.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	p, err = NewConnectionPool(addresses, initial, timeout)
+	if err != nil {
+		return nil, err
+	}
+	go p.refresh(name, resolver, refresh)
+	return p, nil
+}
+
+func (p *ConnectionPool) refresh(name string, resolver Resolver, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		addresses, err := resolver.Resolve(name)
+		if err != nil {
+			log.Warning("Resolving %s: %s", name, err.Error())
+			continue
+		}
+		// an empty answer is more likely a resolver hiccup than every
+		// backend disappearing, so keep the addresses we have
+		if len(addresses) == 0 {
+			log.Warning("Resolving %s returned no addresses", name)
+			continue
+		}
+		p.SetAddresses(addresses)
+	}
+}
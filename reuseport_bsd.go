@@ -0,0 +1,9 @@
+//go:build unix && !linux && !solaris
+
+package tcpez
+
+import (
+	"syscall"
+)
+
+const soReusePort = syscall.SO_REUSEPORT
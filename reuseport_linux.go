@@ -0,0 +1,5 @@
+package tcpez
+
+// soReusePort is SO_REUSEPORT, which syscall doesn't define for every linux
+// architecture
+const soReusePort = 0xf
@@ -0,0 +1,96 @@
+package tcpez
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrUnknownCommand is what a Router without a default handler fails a
+// request whose command wasn't registered with. It's returned as a
+// CodeUnimplemented StatusError, so the client is answered with an error
+// frame and the connection stays up, that matches it with errors.Is.
+var ErrUnknownCommand = errors.New("tcpez: unknown command")
+
+// errUnknownCommand is the StatusError a Router fails a request for an
+// unknown command with
+var errUnknownCommand = &StatusError{Code: CodeUnimplemented, Message: ErrUnknownCommand.Error(), err: ErrUnknownCommand}
+
+// Router is a RequestHandler that dispatches each request on its command, the
+// bytes before the first space (or the whole request if it has none), to the
+// handler registered for it. Requests for commands that weren't registered go
+// to the default handler. The handlers are passed the whole request, command
+// included.
+//
+//        router := tcpez.NewRouter(notFoundHandler)
+//        router.Handle("GET", getHandler)
+//        router.Handle("SET", setHandler)
+//        s, err := tcpez.NewServer(":2222", router)
+//
+// The command is set as the span's "command" attr.
+type Router struct {
+	defaultHandler RequestHandler
+	handlers       map[string]RequestHandler
+	sync.RWMutex
+}
+
+// NewRouter creates a Router that sends requests for unregistered commands
+// to defaultHandler. If defaultHandler is nil they fail with
+// ErrUnknownCommand.
+func NewRouter(defaultHandler RequestHandler) *Router {
+	return &Router{defaultHandler: defaultHandler, handlers: make(map[string]RequestHandler)}
+}
+
+// Handle registers handler for the requests whose command is command,
+// replacing the handler registered before it if there was one.
+func (r *Router) Handle(command string, handler RequestHandler) {
+	r.Lock()
+	defer r.Unlock()
+	r.handlers[command] = handler
+}
+
+// Routes returns the commands that have a handler registered, sorted.
+func (r *Router) Routes() (commands []string) {
+	r.RLock()
+	defer r.RUnlock()
+	commands = make([]string, 0, len(r.handlers))
+	for command := range r.handlers {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	return commands
+}
+
+// HandleRoutes registers a handler for command that answers with the
+// registered commands, one per line, so a client can discover what the
+// server supports.
+//
+//        router.HandleRoutes("COMMANDS")
+//        res, err := c.SendRecvString("COMMANDS")
+//        res //=> "COMMANDS\nGET\nSET"
+//
+func (r *Router) HandleRoutes(command string) {
+	r.Handle(command, RequestHandlerFunc(func(req []byte, span *Span) ([]byte, error) {
+		return []byte(strings.Join(r.Routes(), "\n")), nil
+	}))
+}
+
+func (r *Router) Respond(req []byte, span *Span) ([]byte, error) {
+	command := req
+	if i := bytes.IndexByte(req, ' '); i >= 0 {
+		command = req[:i]
+	}
+	span.Attr("command", string(command))
+	r.RLock()
+	handler, ok := r.handlers[string(command)]
+	r.RUnlock()
+	if ok == false {
+		handler = r.defaultHandler
+	}
+	if handler == nil {
+		return nil, errUnknownCommand
+	}
+	return handler.Respond(req, span)
+}
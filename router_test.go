@@ -0,0 +1,80 @@
+package tcpez
+
+import (
+	"errors"
+	"github.com/bmizerany/assert"
+	"testing"
+	"time"
+)
+
+func TestRouter(t *testing.T) {
+	named := func(name string) RequestHandler {
+		return RequestHandlerFunc(func(req []byte, span *Span) ([]byte, error) {
+			return []byte(name + ":" + string(req)), nil
+		})
+	}
+	router := NewRouter(named("default"))
+	router.Handle("GET", named("get"))
+	router.Handle("SET", named("set"))
+	l, addr := newTestServer(router)
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	for req, expected := range map[string]string{
+		"GET key":       "get:GET key",
+		"SET key value": "set:SET key value",
+		"GET":           "get:GET",
+		"DEL key":       "default:DEL key",
+		"GETS key":      "default:GETS key",
+	} {
+		res, err := c.SendRecv([]byte(req))
+		assert.T(t, err == nil)
+		assert.Equal(t, expected, string(res))
+	}
+
+	span := NewSpan("test")
+	_, err := NewRouter(nil).Respond([]byte("DEL key"), span)
+	assert.T(t, errors.Is(err, ErrUnknownCommand))
+	command, _ := span.GetAttr("command")
+	assert.Equal(t, "DEL", command)
+}
+
+func TestRouterUnknownCommand(t *testing.T) {
+	router := NewRouter(nil)
+	router.Handle("GET", new(EchoHandler))
+	l, addr := newTestServer(router)
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	conn := c.pool.pools[addr][0]
+
+	_, err := c.SendRecvString("DEL key")
+	var remoteErr *RemoteError
+	assert.T(t, errors.As(err, &remoteErr))
+	assert.Equal(t, CodeUnimplemented, remoteErr.Code)
+	assert.Equal(t, "tcpez: unknown command", remoteErr.Message)
+	// the connection is still good for the next request
+	res, err := c.SendRecvString("GET key")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "GET key", res)
+	assert.Equal(t, 1, c.pool.Len())
+	assert.Equal(t, conn, c.pool.pools[addr][0])
+}
+
+func TestRouterRoutes(t *testing.T) {
+	router := NewRouter(nil)
+	assert.Equal(t, []string{}, router.Routes())
+	for _, command := range []string{"SET", "GET", "DEL"} {
+		router.Handle(command, new(EchoHandler))
+	}
+	router.HandleRoutes("COMMANDS")
+	assert.Equal(t, []string{"COMMANDS", "DEL", "GET", "SET"}, router.Routes())
+
+	l, addr := newTestServer(router)
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	res, err := c.SendRecvString("COMMANDS")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "COMMANDS\nDEL\nGET\nSET", res)
+}
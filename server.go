@@ -8,13 +8,19 @@
 package tcpez
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"github.com/op/go-logging"
+	"hash/crc32"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -45,13 +51,284 @@ type Server struct {
 	// a simple hash function but can be swapped out for something more
 	// complex (a vector-clock style UUID generator for example)
 	UUIDGenerator UUIDGenerator
+	// UUIDGeneratorWithContext is used instead of UUIDGenerator when it is
+	// set. The parent it is passed is the id the client sent under
+	// ParentIdMetadataKey, which also becomes the Span's ParentId.
+	UUIDGeneratorWithContext UUIDGeneratorWithContext
+	// SpanSink is handed the Span of each request once it's finished, by
+	// default a NopSpanSink. Use it to ship the spans to a collector or a
+	// file, see JSONFileSpanSink.
+	SpanSink SpanSink
+	// SpanFilter, when it's set, is asked whether each request should get
+	// a Span. For a request it returns false for the Handler is passed a
+	// bare Span that is never given an id, logged, recorded, handed to the
+	// SpanSink or counted in LatencyStats, which saves the overhead for
+	// frequent trivial requests like health checks. It isn't consulted for
+	// a ReaderRequestHandler, that reads the request itself.
+	//
+	//        s.SpanFilter = func(req []byte) bool { return string(req) != "PING" }
+	//
+	SpanFilter func(req []byte) bool
+	// Compression gzips the responses sent to clients that support it.
+	// Small responses are always sent as is, and a handler can opt out for
+	// a response that wouldn't compress well with span.DisableCompression().
+	// Pipelined responses are not compressed.
+	Compression bool
+	// MaxInflight limits the number of requests handled at once across all
+	// connections, requests over the limit wait for a slot. The time each
+	// request waited is recorded as its "queue_wait" SubSpan. Requests
+	// marked high priority (see PriorityMetadataKey) get the slots that free
+	// up before the others. 0 means no limit. It must be set before the
+	// server is started.
+	MaxInflight int
+	// AdmissionController, when it's set, is asked whether to handle each
+	// request given how busy the server is, and the requests it turns away
+	// are answered with a CodeUnavailable error right away, see
+	// ThresholdAdmissionController.
+	AdmissionController AdmissionController
+	// MaxBatchBytes limits the total size of the requests in a pipelined
+	// batch. A batch that goes over it is aborted, by closing the
+	// connection, as soon as the sub-request that crosses the limit is seen
+	// and before it is read. 0 means no limit.
+	MaxBatchBytes int64
+	// WorkerPoolSize, when it's over 0, has pipelined requests and requests
+	// on streams handled by a fixed pool of that many goroutines rather
+	// than a new goroutine each, which saves creating goroutines at very
+	// high request rates and bounds how many of them are handled at once.
+	// When every worker is busy the connection waits for one to be free.
+	// Other requests are still handled on their connection's goroutine. It
+	// must be set before the server is started.
+	WorkerPoolSize int
+	// PipelineResponseWarnBytes is the size the responses to a pipelined
+	// batch can add up to before a warning naming the client is logged and
+	// the pipeline.large_response stat is counted, to catch clients pulling
+	// huge batches. The batch is still answered. 0 means no warning.
+	PipelineResponseWarnBytes int64
+	// MaxBytesPerConnection limits the total size of the requests a client
+	// can send over a connection in its lifetime, so one client can't keep
+	// a connection busy with an endless stream of huge requests. The
+	// connection is closed, with the reason logged and counted as the
+	// connection.bytes_exceeded stat, as soon as a request that crosses the
+	// limit is seen and before it is read. 0 means no limit.
+	MaxBytesPerConnection int64
+	// MaxDecompressedBytes limits the size a compressed request can inflate
+	// to, so a small request can't be decompressed into one that exhausts
+	// the server's memory. A request that goes over it fails with a
+	// CodeResourceExhausted error, counted as the
+	// request.decompressed_too_large stat, without its Handler being
+	// called. Compressed requests count toward MaxBytesPerConnection at
+	// their decompressed size. 0 means DefaultMaxDecompressedBytes.
+	MaxDecompressedBytes int64
+	// Checksum adds a CRC32 to the requests and responses exchanged with
+	// clients that ask for it too (see ConnectionPool.Checksum), so data
+	// corrupted on the way is detected rather than handled. A corrupted
+	// request fails with ErrChecksumMismatch and the connection is closed.
+	// Pipelined requests and responses are not checksummed.
+	Checksum bool
+	// HandlerTimeout is how long the Handler has to respond to a request.
+	// When it runs over the client gets an error that matches
+	// ErrRemoteTimeout instead of a response, and the connection stays up
+	// for the client's next requests. The Handler isn't stopped, it carries
+	// on in the background and its response is thrown away, it keeps its
+	// MaxInflight slot and its Span isn't recorded until it returns. Pipelined
+	// requests that time out get an empty response, like any other failed
+	// request in a pipeline, and a ReaderRequestHandler that times out has
+	// its connection closed since it may still be reading the request.
+	// 0 means no timeout.
+	HandlerTimeout time.Duration
+	// TLSConfig, when it's set, serves the connections over TLS. Clients
+	// connect with a ConnectionPool Dialer that speaks TLS:
+	//
+	//        pool.Dialer = func(network, address string, timeout time.Duration) (net.Conn, error) {
+	//                return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, network, address, clientConfig)
+	//        }
+	//
+	TLSConfig *tls.Config
+	// SNIHandlers picks the handler of each TLS connection by the server
+	// name the client asked for in its TLS hello, so several services can
+	// be hosted on one port. Connections for a name that isn't in it are
+	// served by Handler, or closed if Handler is nil. It must be set before
+	// the server is started.
+	//
+	//        s.SNIHandlers = map[string]tcpez.RequestHandler{
+	//                "users.internal":  usersHandler,
+	//                "orders.internal": ordersHandler,
+	//        }
+	//
+	SNIHandlers map[string]RequestHandler
+	// Framer, when it's set, reads the requests and writes the responses
+	// instead of the tcpez framing, so a client that finds the tcpez
+	// framing awkward can be served in one of its own. The connections
+	// still start with the handshake, but the server agrees to none of the
+	// features since they're part of the tcpez framing. Only single
+	// requests are served with a Framer: a pipeline, or a request on a
+	// stream, closes the connection. It must be set before the server is
+	// started.
+	//
+	//        s.Framer = &MyFramer{}
+	//
+	Framer Framer
+	// WriteTimeout is how long writing a response may take before the
+	// connection is closed, so a client that stops reading can't hold on
+	// to a goroutine forever. 0 means no timeout.
+	WriteTimeout time.Duration
 
 	// The underlying TCP listener, access if you need to set timeouts, etc
 	Conn *net.TCPListener
 
-	isClosed    bool
-	connId      int
-	clientConns map[int]net.Conn
+	closed         int32
+	closeOnce      sync.Once
+	listenerClosed int32
+	connId         int
+	clientConns    map[int]net.Conn
+	connsLock      sync.Mutex
+	requestId      uint64
+	handling       int64
+	inflight       map[uint64]*Span
+	inflightLock   sync.Mutex
+	slots          *inflightLimiter
+	workers        *workerPool
+	running        int32
+	latency        latencyWindow
+	// onWarning is passed the warnings logged with warn, for tests
+	onWarning func(line string)
+	// onSpanLog is passed the lines handlers log with Span.Logger, for tests
+	onSpanLog func(level logging.Level, line string)
+}
+
+// ErrBatchTooLarge is the error a connection is closed with when a client
+// sends a pipelined batch bigger than the Server's MaxBatchBytes.
+var ErrBatchTooLarge = errors.New("tcpez: pipelined batch too large")
+
+// ErrServerClosed is returned by the calls to Server.Close after the first.
+var ErrServerClosed = errors.New("tcpez: server already closed")
+
+// ErrUnknownServerName is the error a TLS connection is closed with when the
+// client asked for a server name that has no handler in the Server's
+// SNIHandlers and the Server has no default Handler.
+var ErrUnknownServerName = errors.New("tcpez: no handler for server name")
+
+// ErrConnectionBytesExceeded is the error a connection is closed with when
+// its client has sent more than the Server's MaxBytesPerConnection.
+var ErrConnectionBytesExceeded = errors.New("tcpez: connection byte limit exceeded")
+
+// DefaultMaxDecompressedBytes is the Server's MaxDecompressedBytes when it
+// isn't set.
+const DefaultMaxDecompressedBytes = 64 << 20
+
+// errDecompressedRequestTooLarge is what a compressed request that inflates
+// past the MaxDecompressedBytes fails with
+var errDecompressedRequestTooLarge = &StatusError{Code: CodeResourceExhausted, Message: "tcpez: decompressed request too large"}
+
+// errHandlerTimeout is what a request fails with when its Handler runs over
+// the HandlerTimeout
+var errHandlerTimeout = errors.New("tcpez: handler timed out")
+
+// SpanIdMetadataKey is the metadata key a client can send a correlation id
+// under (see WithMetadata). The server's Span for the request then uses it as
+// its Id instead of generating one, so the request can be followed through
+// the logs of every service it passes through. The requests of a pipeline
+// share their metadata, and so their id.
+const SpanIdMetadataKey = "id"
+
+// ParentIdMetadataKey is the metadata key a client can send the id of the
+// Span its request is part of under. It becomes the ParentId of the server's
+// Span for the request.
+const ParentIdMetadataKey = "parent"
+
+// TimeoutMetadataKey is the metadata key a client can send how long it will
+// wait for the response under, as a time.ParseDuration string like "250ms".
+// The request's context (see Span.Context) then has a deadline that's no
+// later than that.
+const TimeoutMetadataKey = "timeout"
+
+// serverConn is the server side state of a single client connection
+type serverConn struct {
+	net.Conn
+	// handler serves the requests on the connection, it's the Server's
+	// Handler unless SNIHandlers picked another
+	handler    RequestHandler
+	id         int
+	remoteAddr string
+	features   features
+	// closing is set when a handler asks for the connection to be closed
+	closing int32
+	// received is the total size of the requests read from the connection
+	received int64
+	// writeLock is held while writing to the connection, so the responses
+	// of concurrent streams don't interleave
+	writeLock sync.Mutex
+	// streams are the stream requests still being handled
+	streams sync.WaitGroup
+	// reader buffers the reads of the request being served, it comes from
+	// readerPool and is only held while there's a request to read so idle
+	// connections don't each tie up a buffer
+	reader *bufio.Reader
+	raw    connReader
+}
+
+// readBufferSize is the size of the buffers in readerPool
+const readBufferSize = 4096
+
+var readerPool = sync.Pool{
+	New: func() interface{} {
+		return bufio.NewReaderSize(nil, readBufferSize)
+	},
+}
+
+// connReader reads from a connection, starting with the byte waitForRequest
+// read to find out that a request was coming
+type connReader struct {
+	conn     net.Conn
+	first    [1]byte
+	hasFirst bool
+}
+
+func (r *connReader) Read(p []byte) (n int, err error) {
+	if r.hasFirst == true && len(p) > 0 {
+		p[0] = r.first[0]
+		r.hasFirst = false
+		return 1, nil
+	}
+	return r.conn.Read(p)
+}
+
+// Read reads the request through the connection's buffer
+func (c *serverConn) Read(p []byte) (n int, err error) {
+	if c.reader == nil {
+		return c.Conn.Read(p)
+	}
+	return c.reader.Read(p)
+}
+
+// waitForRequest blocks until the next request starts arriving, then takes
+// a buffer from readerPool to read it with. When the buffer still holds the
+// start of the next request it is kept.
+func (c *serverConn) waitForRequest() (err error) {
+	if c.reader != nil {
+		return nil
+	}
+	_, err = io.ReadFull(c.Conn, c.raw.first[:])
+	if err != nil {
+		return err
+	}
+	c.raw.hasFirst = true
+	c.reader = readerPool.Get().(*bufio.Reader)
+	c.reader.Reset(&c.raw)
+	return nil
+}
+
+// releaseReader puts the connection's buffer back in readerPool once a
+// request has been served, unless the client has already sent more. It must
+// not be called after a failed request, a ReaderRequestHandler that timed
+// out may still be reading from the buffer.
+func (c *serverConn) releaseReader() {
+	if c.reader == nil || c.reader.Buffered() > 0 {
+		return
+	}
+	c.reader.Reset(nil)
+	readerPool.Put(c.reader)
+	c.reader = nil
 }
 
 // RequestHandler is the basic interface for setting up the request handling
@@ -70,32 +347,207 @@ type Server struct {
 //              }
 //        }
 //
+// A handler must return either a response or an error. An empty response
+// should be returned as an empty, non-nil, slice. Returning (nil, nil) is
+// treated as a bug in the handler: it is logged, counted as the
+// "handler.nil_response" stat, and answered with an empty response.
 type RequestHandler interface {
 	Respond([]byte, *Span) ([]byte, error)
 }
 
-// NewServer is the tcpez server intializer. It only requires two parameters,
-// an address to bind to (same format as net.ListenTCP) and a RequestHandler
-// which serves the requests.
-func NewServer(address string, handler RequestHandler) (s *Server, err error) {
-	tcpAddr, err := net.ResolveTCPAddr("tcp", address)
+// RequestHandlerFunc lets an ordinary function be used as a RequestHandler.
+type RequestHandlerFunc func([]byte, *Span) ([]byte, error)
+
+func (f RequestHandlerFunc) Respond(req []byte, span *Span) ([]byte, error) {
+	return f(req, span)
+}
+
+// StringHandler lets a function that works with strings be used as a
+// RequestHandler, for text protocols.
+//
+//        s, err := tcpez.NewServer(":2222", tcpez.StringHandler(func(req string, span *tcpez.Span) (string, error) {
+//                return strings.ToUpper(req), nil
+//        }))
+//
+type StringHandler func(string, *Span) (string, error)
+
+func (f StringHandler) Respond(req []byte, span *Span) ([]byte, error) {
+	res, err := f(string(req), span)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(res), nil
+}
+
+// Middleware wraps a RequestHandler to add behaviour around every request,
+// it's applied by wrapping the handler before creating the Server.
+//
+//        s, err := tcpez.NewServer(":2222", tcpez.CacheMiddleware(1000, time.Minute)(handler))
+//
+type Middleware func(RequestHandler) RequestHandler
+
+// ReaderRequestHandler is implemented by handlers that would rather read the
+// request from the connection as they parse it than have the server read the
+// whole request first. The Server uses RespondReader instead of Respond for
+// handlers that implement both, see ReaderHandler. r is limited to the size
+// bytes of the request, whatever the handler doesn't read is skipped. The
+// request is read from the connection as the handler reads r, it is never
+// buffered whole, so a handler that consumes it in chunks can take requests
+// of any size in bounded memory.
+// Pipelined requests are read before they're handled so they are still
+// passed to Respond.
+type ReaderRequestHandler interface {
+	RespondReader(r io.Reader, size int, span *Span) ([]byte, error)
+}
+
+// ReaderHandler turns a ReaderRequestHandler into a RequestHandler that can
+// be used as a Server's Handler.
+//
+//        s, err := tcpez.NewServer(":2222", tcpez.ReaderHandler(myReaderHandler))
+//
+func ReaderHandler(h ReaderRequestHandler) RequestHandler {
+	return &readerHandler{h}
+}
+
+type readerHandler struct {
+	ReaderRequestHandler
+}
+
+func (h *readerHandler) Respond(req []byte, span *Span) ([]byte, error) {
+	return h.RespondReader(bytes.NewReader(req), len(req), span)
+}
+
+// MultiRequestHandler is implemented by handlers whose response is made up of
+// several frames that the client reads separately with SendRecvMulti, for
+// example a page of search results per frame. The Server uses RespondMulti
+// instead of Respond for handlers that implement both, see MultiHandler.
+// Pipelined requests can only be answered with a single frame so they are
+// still passed to Respond.
+type MultiRequestHandler interface {
+	RespondMulti([]byte, *Span) ([][]byte, error)
+}
+
+// MultiHandler turns a MultiRequestHandler into a RequestHandler that can be
+// used as a Server's Handler. Its Respond joins the frames together.
+//
+//        s, err := tcpez.NewServer(":2222", tcpez.MultiHandler(mySearchHandler))
+//
+func MultiHandler(h MultiRequestHandler) RequestHandler {
+	return &multiHandler{h}
+}
+
+type multiHandler struct {
+	MultiRequestHandler
+}
+
+func (h *multiHandler) Respond(req []byte, span *Span) ([]byte, error) {
+	frames, err := h.RespondMulti(req, span)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Join(frames, nil), nil
+}
+
+// StreamRequestHandler is implemented by handlers that answer a request with
+// a stream of frames, which the client reads with SendRecvStream as they
+// arrive, for example the results of a search as they're found. Each frame
+// passed to send is written to the connection straight away, so neither end
+// holds on to the whole response. send fails once the frame can't be
+// written, or once RespondStream has returned. The stream ends when
+// RespondStream returns, with an error frame if it returned a StatusError.
+// Any other error closes the connection, which the client sees as the
+// stream failing part way through. SendRecv and SendRecvMulti can read the
+// stream too, they wait for the end of it. The Server uses RespondStream instead of
+// Respond for handlers that implement both, see StreamHandler. Pipelined
+// requests, requests on streams and one-way requests are still passed to
+// Respond.
+type StreamRequestHandler interface {
+	RespondStream(req []byte, send func(frame []byte) error, span *Span) error
+}
+
+// StreamHandler turns a StreamRequestHandler into a RequestHandler that can
+// be used as a Server's Handler. Its Respond joins the frames together.
+//
+//        s, err := tcpez.NewServer(":2222", tcpez.StreamHandler(mySearchHandler))
+//
+func StreamHandler(h StreamRequestHandler) RequestHandler {
+	return &streamHandler{h}
+}
+
+type streamHandler struct {
+	StreamRequestHandler
+}
+
+func (h *streamHandler) Respond(req []byte, span *Span) ([]byte, error) {
+	var frames [][]byte
+	err := h.RespondStream(req, func(frame []byte) error {
+		frames = append(frames, frame)
+		return nil
+	}, span)
 	if err != nil {
 		return nil, err
 	}
-	l, err := net.ListenTCP("tcp", tcpAddr)
+	return bytes.Join(frames, nil), nil
+}
+
+// errStreamEnded is what sending a frame of a streamed response fails with
+// once its handler has returned, which a handler that timed out may still
+// try
+var errStreamEnded = errors.New("tcpez: streamed response already ended")
+
+// NewServer is the tcpez server intializer. It only requires two parameters,
+// an address to bind to (same format as net.ListenTCP) and a RequestHandler
+// which serves the requests. ServerOptions tune the listener, for example to
+// share the port between processes:
+//
+//        s, err := tcpez.NewServer(":2222", handler, tcpez.WithReusePort(), tcpez.WithBacklog(1024))
+//
+// SO_REUSEADDR doesn't need an option, Go always sets it on listeners so a
+// restarted server can bind while old connections are in TIME_WAIT.
+func NewServer(address string, handler RequestHandler, opts ...ServerOption) (s *Server, err error) {
+	l, err := listen(address, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Server{Address: address, Conn: l, Handler: handler, Stats: new(DebugStatsRecorder), UUIDGenerator: DefaultUUIDGenerator, clientConns: make(map[int]net.Conn)}, nil
+	s = newServer(handler)
+	s.Address = address
+	s.Conn = l
+	return s, nil
+}
+
+// newServer returns a Server with its defaults set but no listener, that's
+// up to the caller.
+func newServer(handler RequestHandler) *Server {
+	return &Server{Handler: handler, Stats: new(DebugStatsRecorder), UUIDGenerator: DefaultUUIDGenerator, SpanSink: NopSpanSink{}, clientConns: make(map[int]net.Conn), inflight: make(map[uint64]*Span)}
 }
 
 // Start starts the Connection handling and request processing loop.
 // This is a blocking operation and can be started in a goroutine.
 func (s *Server) Start() {
 	log.Debug("Listening on %s", s.Conn.Addr().String())
+	if s.MaxInflight > 0 {
+		s.slots = newInflightLimiter(s.MaxInflight)
+	}
+	// checked under the connsLock so a Close that races with Start either
+	// sees the workers and running to undo, or is seen here
+	s.connsLock.Lock()
+	if atomic.LoadInt32(&s.closed) == 0 {
+		if s.WorkerPoolSize > 0 {
+			s.workers = newWorkerPool(s.WorkerPoolSize)
+		}
+		atomic.StoreInt32(&s.running, 1)
+	}
+	s.connsLock.Unlock()
+	defer func() {
+		// a server that stopped accepting is still running until it's
+		// closed, which is what stops it running
+		if atomic.LoadInt32(&s.listenerClosed) == 0 || atomic.LoadInt32(&s.closed) == 1 {
+			atomic.StoreInt32(&s.running, 0)
+		}
+	}()
 	for {
-		if s.isClosed == true {
+		if atomic.LoadInt32(&s.closed) == 1 {
 			break
 		}
 		clientConn, err := s.Conn.Accept()
@@ -103,47 +555,178 @@ func (s *Server) Start() {
 			log.Warning(err.Error())
 			break
 		}
+		if s.TLSConfig != nil {
+			clientConn = tls.Server(clientConn, s.TLSConfig)
+		}
 		s.connId++
 		go s.handle(clientConn, s.connId)
 	}
 	log.Debug("Closing %s", s.Conn.Addr().String())
 }
 
+// Addr returns the address the server's listener is actually bound to. This
+// differs from Address when binding to port 0 to get a port from the OS.
+func (s *Server) Addr() net.Addr {
+	return s.Conn.Addr()
+}
+
+// InflightSpans returns the Spans of the requests that are currently being
+// handled, how long each has been running is time.Since(span.Started). This
+// is useful for a debug view of slow or stuck requests. The spans are still
+// being used by their handlers and should be treated as read only.
+func (s *Server) InflightSpans() (spans []*Span) {
+	s.inflightLock.Lock()
+	defer s.inflightLock.Unlock()
+	spans = make([]*Span, 0, len(s.inflight))
+	for _, span := range s.inflight {
+		spans = append(spans, span)
+	}
+	return spans
+}
+
+// LatencyStats returns the percentiles of the durations of the last 1024
+// requests the server handled, and the rate they came in at. It's cheap
+// enough to call from a health check.
+func (s *Server) LatencyStats() LatencyStats {
+	return s.latency.stats(time.Now())
+}
+
+func (s *Server) addInflight(span *Span) (id uint64) {
+	s.inflightLock.Lock()
+	defer s.inflightLock.Unlock()
+	s.requestId++
+	s.inflight[s.requestId] = span
+	return s.requestId
+}
+
+func (s *Server) removeInflight(id uint64) {
+	s.inflightLock.Lock()
+	defer s.inflightLock.Unlock()
+	delete(s.inflight, id)
+}
+
 func (s *Server) NumConnections() int {
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
 	return len(s.clientConns)
 }
 
-// Close closes the server listener to any more Connections
+// addConn tracks a newly accepted connection, counting it as
+// connection.accepted and updating the connection.active gauge. It closes
+// the connection instead, and returns false, once the server is closed.
+func (s *Server) addConn(id int, conn net.Conn) bool {
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+	if atomic.LoadInt32(&s.closed) == 1 {
+		// accepted just before Close, which didn't see it
+		conn.Close()
+		return false
+	}
+	s.clientConns[id] = conn
+	s.Stats.Increment("connection.accepted")
+	s.Stats.Gauge("connection.active", int64(len(s.clientConns)))
+	return true
+}
+
+// removeConn stops tracking a connection once it's been closed, counting it
+// as connection.closed and updating the connection.active gauge
+func (s *Server) removeConn(id int) {
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+	delete(s.clientConns, id)
+	s.Stats.Increment("connection.closed")
+	s.Stats.Gauge("connection.active", int64(len(s.clientConns)))
+}
+
+// IsRunning reports whether the server is running, that is Start has been
+// called and the server hasn't been closed since. It stays true after
+// StopAccepting, while the connections the server has are still served (see
+// IsAccepting). It's safe to call from any goroutine, for example to answer
+// a liveness probe.
+func (s *Server) IsRunning() bool {
+	return atomic.LoadInt32(&s.running) == 1
+}
+
+// IsAccepting reports whether the server is accepting new connections. It
+// turns false once StopAccepting is called, while the connections the server
+// already has are still being served. It's safe to call from any goroutine,
+// for example to answer a readiness probe.
+func (s *Server) IsAccepting() bool {
+	return s.IsRunning() == true && atomic.LoadInt32(&s.listenerClosed) == 0
+}
+
+// StopAccepting closes the server listener to any more Connections but
+// leaves the ones it has open, serving their requests for as long as their
+// clients keep them, which lets long lived connections bleed off naturally
+// during a cutover. Close still closes them all.
+func (s *Server) StopAccepting() error {
+	return s.closeListener()
+}
+
+// closeListener closes the listener the first time it's called
+func (s *Server) closeListener() error {
+	if atomic.CompareAndSwapInt32(&s.listenerClosed, 0, 1) == false {
+		return nil
+	}
+	return s.Conn.Close()
+}
+
+// Close closes the server listener to any more Connections and closes the
+// Connections it has. It's safe to call from several goroutines at once, a
+// signal handler and a deferred cleanup say, only the first call closes
+// anything and the others return ErrServerClosed.
 func (s *Server) Close() (err error) {
-	if s.isClosed == false {
-		err = s.Conn.Close()
-		s.isClosed = true
+	err = ErrServerClosed
+	s.closeOnce.Do(func() {
+		atomic.StoreInt32(&s.closed, 1)
+		err = s.closeListener()
+		s.connsLock.Lock()
+		defer s.connsLock.Unlock()
+		atomic.StoreInt32(&s.running, 0)
+		if s.workers != nil {
+			s.workers.close()
+		}
 		for id, conn := range s.clientConns {
 			delete(s.clientConns, id)
 			conn.Close()
 		}
-		return
-	}
-	return errors.New("Closing already closed Connection")
+	})
+	return err
 }
 
 func (s *Server) handle(clientConn net.Conn, id int) {
 	log.Debug("[tcpez] New client(%s)", clientConn.RemoteAddr())
-	s.clientConns[id] = clientConn
+	if s.addConn(id, clientConn) == false {
+		return
+	}
+	conn := &serverConn{Conn: clientConn, id: id, remoteAddr: clientConn.RemoteAddr().String()}
+	conn.raw.conn = clientConn
+	clientConn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+	var err error
+	conn.handler, err = s.connHandler(clientConn)
+	if err != nil {
+		log.Warning("Rejected TLS connection from %s: %s", clientConn.RemoteAddr(), err.Error())
+		clientConn.Close()
+		s.removeConn(id)
+		return
+	}
+	conn.features, err = serverHandshake(clientConn, s.supportedFeatures())
+	if err != nil {
+		log.Warning("Handshake with %s failed: %s", clientConn.RemoteAddr(), err.Error())
+		s.Stats.Increment("connection.handshake_failure")
+		clientConn.Close()
+		s.removeConn(id)
+		return
+	}
 	for {
 		// Timeout the connection after 5 mins
 		clientConn.SetReadDeadline(time.Now().Add(5 * time.Minute))
-		header, response, err := s.readHeaderAndHandleRequest(clientConn)
-		if err != nil {
-			if closableError(err) {
-				// EOF the client has disconnected
-				break
-			}
-			log.Error(err.Error())
-			s.Stats.Increment("operation.failure")
-			return
+		err = conn.waitForRequest()
+		if err == nil && s.Framer != nil {
+			err = s.serveFrame(conn)
+		} else if err == nil {
+			err = s.serveRequest(conn)
 		}
-		err = s.sendResponse(clientConn, header, response)
 		if err != nil {
 			if closableError(err) {
 				// EOF the client has disconnected
@@ -151,13 +734,37 @@ func (s *Server) handle(clientConn net.Conn, id int) {
 			}
 			log.Error(err.Error())
 			s.Stats.Increment("operation.failure")
-			return
+			// the stream can't be trusted after an error, hang up
+			break
 		}
 		s.Stats.Increment("operation.success")
+		conn.releaseReader()
+		if atomic.LoadInt32(&conn.closing) == 1 {
+			log.Debug("Handler asked to close connection %v", clientConn)
+			break
+		}
 	}
+	// let the streams still being handled answer
+	conn.streams.Wait()
 	log.Debug("Closing connection %v", clientConn)
 	clientConn.Close()
-	delete(s.clientConns, id)
+	s.removeConn(id)
+}
+
+func (s *Server) supportedFeatures() (f features) {
+	if s.Framer != nil {
+		return 0
+	}
+	// streams, codecs, pipeline digests and one-way requests don't need
+	// anything set up, so they're always supported
+	f = featureStreams | featureCodecs | featurePipelineDigest | featureOneWay
+	if s.Compression == true {
+		f |= featureCompression
+	}
+	if s.Checksum == true {
+		f |= featureChecksum
+	}
+	return f
 }
 
 func closableError(err error) bool {
@@ -167,71 +774,649 @@ func closableError(err error) bool {
 	return err == io.EOF || err == io.ErrClosedPipe || err == io.ErrUnexpectedEOF
 }
 
-func (s *Server) readHeaderAndHandleRequest(buf io.Reader) (header int32, response []byte, err error) {
-	var size int32
-	err = binary.Read(buf, binary.BigEndian, &size)
+// serveRequest reads the next request (or pipeline of requests) from conn,
+// handles it and writes the response
+func (s *Server) serveRequest(conn *serverConn) (err error) {
+	size, info, err := readHeader(conn)
 	if err != nil {
-		return 0, nil, err
+		return err
+	}
+	if info.stream != 0 {
+		return s.serveStream(conn, size, info)
+	}
+	if info.oneWay == true {
+		return s.serveOneWay(conn, size, info)
+	}
+	metadata := info.metadata
+	if size == 0 {
+		// a zero length request is a keepalive, it's answered with a zero
+		// length response without bothering the handler
+		s.setWriteDeadline(conn)
+		return s.sendResponse(conn, 0, nil, false)
 	}
 	if size < 0 {
 		// this is a pipelined request
-		var wg sync.WaitGroup
-		count := -size
-		requests := make([][]byte, count)
-		responses := make([][]byte, count)
-		for r := 0; int32(r) < count; r++ {
-			request, err := s.parseRequest(buf, 0)
+		return s.servePipeline(conn, -size, info)
+	}
+	err = s.countReceived(conn, int64(size))
+	if err != nil {
+		return err
+	}
+	var response []byte
+	var compress bool
+	var after []func()
+	if handler, ok := conn.handler.(ReaderRequestHandler); ok == true {
+		var body io.Reader = io.LimitReader(conn, int64(size))
+		sum := crc32.NewIEEE()
+		if conn.features&featureChecksum != 0 {
+			body = io.TeeReader(body, sum)
+		}
+		length := int(size)
+		if info.compressed == true {
+			// the handler is given the decompressed request, which means
+			// reading all of it up front
+			var request []byte
+			request, err = io.ReadAll(body)
 			if err == nil {
-				requests[r] = request
-				wg.Add(1)
-				go func(index int) {
-					res, err := s.handleRequest(requests[index], true)
-					if err == nil {
-						responses[index] = res
+				request, err = s.decompressRequest(conn, request, info.codec)
+			}
+			if failed := statusError(err); failed != nil {
+				// the request was read in full, only its checksum is left
+				if conn.features&featureChecksum != 0 {
+					err = verifyChecksum(sum.Sum32(), conn)
+					if err != nil {
+						return err
 					}
-					wg.Done()
-				}(r)
+				}
+				s.setWriteDeadline(conn)
+				return s.sendError(conn, 0, failed.Code, failed.Message)
 			}
-		}
-		wg.Wait()
-		output := bytes.NewBuffer(nil)
-		for j := 0; int32(j) < count; j++ {
-			length := int32(len(responses[j]))
-			err = binary.Write(output, binary.BigEndian, length)
-			if err == nil {
-				output.Write(responses[j])
+			if err != nil {
+				return err
 			}
+			body = bytes.NewReader(request)
+			length = len(request)
+		}
+		response, compress, after, err = s.handleRequest(conn, nil, func(span *Span) ([]byte, error) {
+			return handler.RespondReader(body, length, span)
+		}, metadata, false)
+		failed := statusError(err)
+		if err != nil && (failed == nil || err == errHandlerTimeout) {
+			// a handler that timed out may still be reading the request
+			return err
+		}
+		// skip whatever the handler didn't read to get to the next request
+		_, err = io.Copy(io.Discard, body)
+		if err == nil && conn.features&featureChecksum != 0 {
+			// the handler has already seen the request, but at least the
+			// response to a corrupted one isn't sent
+			err = verifyChecksum(sum.Sum32(), conn)
+		}
+		if err == nil && failed != nil {
+			s.setWriteDeadline(conn)
+			return s.sendError(conn, 0, failed.Code, failed.Message)
+		}
+	} else if handler, ok := conn.handler.(StreamRequestHandler); ok == true {
+		var request []byte
+		request, err = s.readRequest(conn, size, info)
+		if failed := statusError(err); failed != nil {
+			s.setWriteDeadline(conn)
+			return s.sendError(conn, 0, failed.Code, failed.Message)
+		}
+		if err != nil {
+			return err
+		}
+		return s.serveStreamedResponse(conn, request, handler, metadata)
+	} else if handler, ok := conn.handler.(MultiRequestHandler); ok == true {
+		var request []byte
+		request, err = s.readRequest(conn, size, info)
+		if failed := statusError(err); failed != nil {
+			s.setWriteDeadline(conn)
+			return s.sendError(conn, 0, failed.Code, failed.Message)
+		}
+		if err != nil {
+			return err
+		}
+		var frames [][]byte
+		_, _, after, err = s.handleRequest(conn, request, func(span *Span) (res []byte, err error) {
+			frames, err = handler.RespondMulti(request, span)
+			return []byte{}, err
+		}, metadata, false)
+		if failed := statusError(err); failed != nil {
+			s.setWriteDeadline(conn)
+			return s.sendError(conn, 0, failed.Code, failed.Message)
+		}
+		if err != nil {
+			return err
+		}
+		s.setWriteDeadline(conn)
+		err = s.sendMultiResponse(conn, frames)
+		if err == nil {
+			s.runAfterResponse(after)
 		}
-		return int32(-count), output.Bytes(), err
+		return err
 	} else {
-		request, err := s.parseRequest(buf, size)
+		var request []byte
+		request, err = s.readRequest(conn, size, info)
+		if failed := statusError(err); failed != nil {
+			s.setWriteDeadline(conn)
+			return s.sendError(conn, 0, failed.Code, failed.Message)
+		}
 		if err != nil {
-			return 0, nil, err
+			return err
+		}
+		response, compress, after, err = s.handleRequest(conn, request, s.respondTo(conn, request), metadata, false)
+		if failed := statusError(err); failed != nil {
+			s.setWriteDeadline(conn)
+			return s.sendError(conn, 0, failed.Code, failed.Message)
 		}
-		response, err := s.handleRequest(request, false)
+	}
+	if err != nil {
+		return err
+	}
+	if compress == true {
+		response, err = s.compressResponse(response)
 		if err != nil {
-			return 0, nil, err
+			return err
 		}
-		return int32(len(response)), response, nil
 	}
+	s.setWriteDeadline(conn)
+	err = s.sendResponse(conn, 0, response, compress)
+	if err == nil {
+		s.runAfterResponse(after)
+	}
+	return err
 }
 
-func (s *Server) sendResponse(w io.Writer, header int32, data []byte) (err error) {
-	err = binary.Write(w, binary.BigEndian, header)
+// serveStreamedResponse has a StreamRequestHandler answer request, writing
+// each frame it sends as soon as it's sent and ending the stream once it
+// returns
+func (s *Server) serveStreamedResponse(conn *serverConn, request []byte, handler StreamRequestHandler, metadata map[string]string) (err error) {
+	// a handler that timed out carries on in the background, it mustn't
+	// write in the middle of the responses to the requests after it
+	var lock sync.Mutex
+	ended := false
+	send := func(frame []byte) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if ended == true {
+			return errStreamEnded
+		}
+		s.setWriteDeadline(conn)
+		buffers := append(net.Buffers{controlFrame(controlMore)}, frameBuffers(frame, conn.features)...)
+		return conn.writeBuffers(buffers)
+	}
+	_, _, after, err := s.handleRequest(conn, request, func(span *Span) ([]byte, error) {
+		return []byte{}, handler.RespondStream(request, send, span)
+	}, metadata, false)
+	lock.Lock()
+	ended = true
+	lock.Unlock()
+	s.setWriteDeadline(conn)
+	if failed := statusError(err); failed != nil {
+		return s.sendError(conn, 0, failed.Code, failed.Message)
+	}
 	if err != nil {
 		return err
 	}
-	_, err = w.Write(data)
-	return
+	// the empty response that ends the stream
+	err = s.sendResponse(conn, 0, nil, false)
+	if err == nil {
+		s.runAfterResponse(after)
+	}
+	return err
 }
 
-func (s *Server) parseRequest(buf io.Reader, size int32) (request []byte, err error) {
-	if size == int32(0) {
-		err = binary.Read(buf, binary.BigEndian, &size)
+// serveFrame reads the next request from conn with the Server's Framer,
+// handles it and writes the response with it
+func (s *Server) serveFrame(conn *serverConn) (err error) {
+	frame, err := s.Framer.ReadFrame(conn)
+	if err != nil {
+		return err
+	}
+	if frame.Count != 0 || frame.Stream != 0 {
+		return fmt.Errorf("%w: only single requests can be served with a Framer", ErrProtocol)
+	}
+	s.setWriteDeadline(conn)
+	if len(frame.Data) == 0 {
+		// keepalive
+		return s.writeFrames(conn, Frame{})
+	}
+	err = s.countReceived(conn, int64(len(frame.Data)))
+	if err != nil {
+		return err
+	}
+	request := frame.Data
+	if frame.Compressed == true {
+		codec := frame.Codec
+		if codec == CodecNone {
+			codec = CodecGzip
+		}
+		request, err = s.decompressRequest(conn, request, codec)
+		if failed := statusError(err); failed != nil {
+			return s.writeFrames(conn, Frame{Error: true, Data: errorFrame(failed.Code, failed.Message)})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	var frames [][]byte
+	respond := s.respondToRead(conn, request, &frames)
+	response, _, after, err := s.handleRequest(conn, request, respond, frame.Metadata, false)
+	s.setWriteDeadline(conn)
+	if failed := statusError(err); failed != nil {
+		return s.writeFrames(conn, Frame{Error: true, Data: errorFrame(failed.Code, failed.Message)})
+	}
+	if err != nil {
+		return err
+	}
+	_, multi := conn.handler.(MultiRequestHandler)
+	_, streamed := conn.handler.(StreamRequestHandler)
+	if multi == true || streamed == true {
+		// a Framer can't stream, a StreamRequestHandler's frames are sent
+		// together like a MultiRequestHandler's
+		responses := []Frame{{Multi: true, Count: int32(len(frames))}}
+		for _, data := range frames {
+			responses = append(responses, Frame{Data: data})
+		}
+		err = s.writeFrames(conn, responses...)
+	} else {
+		err = s.writeFrames(conn, Frame{Data: response})
+	}
+	if err == nil {
+		s.runAfterResponse(after)
+	}
+	return err
+}
+
+// respondToRead is respondTo for a request that has already been read, which
+// any kind of handler can respond to. The frames of a MultiRequestHandler's
+// response, or those a StreamRequestHandler sent, are put in frames.
+func (s *Server) respondToRead(conn *serverConn, request []byte, frames *[][]byte) func(*Span) ([]byte, error) {
+	switch handler := conn.handler.(type) {
+	case ReaderRequestHandler:
+		return func(span *Span) ([]byte, error) {
+			return handler.RespondReader(bytes.NewReader(request), len(request), span)
+		}
+	case MultiRequestHandler:
+		return func(span *Span) (res []byte, err error) {
+			*frames, err = handler.RespondMulti(request, span)
+			return []byte{}, err
+		}
+	case StreamRequestHandler:
+		return func(span *Span) (res []byte, err error) {
+			return []byte{}, handler.RespondStream(request, func(frame []byte) error {
+				*frames = append(*frames, frame)
+				return nil
+			}, span)
+		}
+	}
+	return s.respondTo(conn, request)
+}
+
+// serveOneWay reads a one-way request and handles it without answering, the
+// client isn't waiting on a response. A request that fails is only logged
+// and counted as the request.one_way_failure stat, there's no one to tell.
+func (s *Server) serveOneWay(conn *serverConn, size int32, info frameInfo) (err error) {
+	if size < 0 {
+		return fmt.Errorf("%w: one-way pipelined request", ErrProtocol)
+	}
+	if size == 0 {
+		// a keepalive that doesn't need answering
+		return nil
+	}
+	err = s.countReceived(conn, int64(size))
+	if err != nil {
+		return err
+	}
+	request, err := s.readRequest(conn, size, info)
+	if statusError(err) != nil {
+		log.Warning("One-way request from %s failed: %s", conn.remoteAddr, err.Error())
+		s.Stats.Increment("request.one_way_failure")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.Stats.Increment("request.one_way")
+	var frames [][]byte
+	_, _, after, err := s.handleRequest(conn, request, s.respondToRead(conn, request, &frames), info.metadata, false)
+	if err != nil {
+		log.Warning("One-way request from %s failed: %s", conn.remoteAddr, err.Error())
+		s.Stats.Increment("request.one_way_failure")
+		return nil
+	}
+	s.runAfterResponse(after)
+	return nil
+}
+
+// writeFrames writes frames to the connection with the Server's Framer, in
+// one go
+func (s *Server) writeFrames(conn *serverConn, frames ...Frame) (err error) {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	w := bufio.NewWriter(conn.Conn)
+	for _, frame := range frames {
+		err = s.Framer.WriteFrame(w, frame)
+		if err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// serveStream reads a request on a stream and handles it in the background,
+// its response is sent on the stream as soon as it's ready so the requests
+// on other streams don't wait on it. A request that fails is answered with
+// an error frame, with CodeUnknown unless the handler returned a
+// StatusError, rather than closing the connection and every other stream on
+// it along with it.
+func (s *Server) serveStream(conn *serverConn, size int32, info frameInfo) (err error) {
+	if size < 0 {
+		return fmt.Errorf("%w: pipelined request on stream %d", ErrProtocol, info.stream)
+	}
+	err = s.countReceived(conn, int64(size))
+	if err != nil {
+		return err
+	}
+	request, err := s.readRequest(conn, size, info)
+	if failed := statusError(err); failed != nil {
+		s.setWriteDeadline(conn)
+		return s.sendError(conn, info.stream, failed.Code, failed.Message)
+	}
+	if err != nil {
+		return err
+	}
+	conn.streams.Add(1)
+	s.dispatch(func() {
+		defer conn.streams.Done()
+		response, compress, after, err := s.handleRequest(conn, request, s.respondTo(conn, request), info.metadata, false)
+		if err == nil && compress == true {
+			response, err = s.compressResponse(response)
+		}
+		s.setWriteDeadline(conn)
+		if err != nil {
+			failed := statusError(err)
+			if failed == nil {
+				failed = &StatusError{Code: CodeUnknown, Message: err.Error()}
+			}
+			err = s.sendError(conn, info.stream, failed.Code, failed.Message)
+		} else {
+			err = s.sendResponse(conn, info.stream, response, compress)
+			if err == nil {
+				s.runAfterResponse(after)
+			}
+		}
+		if err != nil {
+			// the other streams can't be read past a partly written
+			// response, hang up
+			log.Error(err.Error())
+			conn.Close()
+		}
+	})
+	return nil
+}
+
+// dispatch runs task on one of the workers when there's a WorkerPoolSize,
+// or on a goroutine of its own
+func (s *Server) dispatch(task func()) {
+	if s.workers != nil {
+		s.workers.submit(task)
+		return
+	}
+	go task()
+}
+
+// readRequest reads a request of size bytes, decompressing it if the client
+// compressed it
+func (s *Server) readRequest(conn *serverConn, size int32, info frameInfo) (request []byte, err error) {
+	request, err = readFrame(conn, size, conn.features)
+	if err != nil {
+		return nil, err
+	}
+	if info.compressed == true {
+		return s.decompressRequest(conn, request, info.codec)
+	}
+	return request, nil
+}
+
+// decompressRequest decompresses a request the client compressed with codec,
+// counting it in the request.compressed stat and in a stat of the codec's.
+// It fails with errDecompressedRequestTooLarge when the request inflates
+// past the MaxDecompressedBytes, and with ErrConnectionBytesExceeded if
+// what it inflated by takes the connection over MaxBytesPerConnection.
+func (s *Server) decompressRequest(conn *serverConn, request []byte, codec Codec) ([]byte, error) {
+	s.Stats.Increment("request.compressed")
+	s.Stats.Increment("request.compressed." + codec.String())
+	limit := s.MaxDecompressedBytes
+	if limit <= 0 {
+		limit = DefaultMaxDecompressedBytes
+	}
+	decompressed, err := codec.decompress(request, limit)
+	if err == errDecompressedTooLarge {
+		s.Stats.Increment("request.decompressed_too_large")
+		return nil, errDecompressedRequestTooLarge
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the compressed size was already counted
+	err = s.countReceived(conn, int64(len(decompressed)-len(request)))
+	if err != nil {
+		return nil, err
+	}
+	return decompressed, nil
+}
+
+func (s *Server) setWriteDeadline(conn net.Conn) {
+	if s.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
+	}
+}
+
+// servePipeline handles count pipelined requests concurrently. The
+// responses are written in order, each one as soon as it and all the ones
+// before it are ready, so only the responses that finished ahead of their
+// turn are held in memory at once. The number of goroutines the batch
+// spawned (or tasks it gave the workers, see WorkerPoolSize) and the total
+// time spent in the Handler are recorded as the pipeline.goroutines and
+// pipeline.handler_time stats.
+func (s *Server) servePipeline(conn *serverConn, count int32, info frameInfo) (err error) {
+	metadata := info.metadata
+	responses := make([][]byte, count)
+	afters := make([][]func(), count)
+	done := make([]chan struct{}, count)
+	var batchBytes int64
+	var goroutines, handlerTime, responseBytes int64
+	for r := 0; int32(r) < count; r++ {
+		done[r] = make(chan struct{})
+		request, err := s.readBatchRequest(conn, &batchBytes)
+		if err == ErrBatchTooLarge {
+			s.Stats.Increment("pipeline.batch_too_large")
+		}
 		if err != nil {
-			return nil, err
+			// the rest of the batch can't be found past a request that
+			// couldn't be read, the connection is closed like it is for a
+			// single request
+			return err
 		}
+		goroutines++
+		index := r
+		s.dispatch(func() {
+			respond := s.respondTo(conn, request)
+			res, _, after, err := s.handleRequest(conn, request, func(span *Span) ([]byte, error) {
+				start := time.Now()
+				defer func() { atomic.AddInt64(&handlerTime, int64(time.Since(start))) }()
+				return respond(span)
+			}, metadata, true)
+			if err == nil {
+				responses[index] = res
+				afters[index] = after
+			}
+			close(done[index])
+		})
 	}
+	// the responses are written as they're ready, so the connection is
+	// held until the last one is
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	w := bufio.NewWriter(conn)
+	if info.digest != nil {
+		_, err = w.Write(digestFrame(pipelineDigest{sequence: info.digest.sequence, count: count}))
+	}
+	if err == nil {
+		err = binary.Write(w, binary.BigEndian, -count)
+	}
+	for j := 0; int32(j) < count; j++ {
+		select {
+		case <-done[j]:
+		default:
+			// flush what's ready rather than sit on it while waiting
+			if err == nil {
+				s.setWriteDeadline(conn)
+				err = w.Flush()
+			}
+			<-done[j]
+		}
+		if err == nil {
+			s.setWriteDeadline(conn)
+			_, err = writeDataWithLength(responses[j], w)
+		}
+		responseBytes += int64(len(responses[j]))
+		// let it be collected as soon as it's written
+		responses[j] = nil
+	}
+	// every goroutine has finished by now, they were all waited for above
+	s.Stats.Timer("pipeline.goroutines", goroutines)
+	s.Stats.Timer("pipeline.handler_time", atomic.LoadInt64(&handlerTime)/int64(time.Millisecond))
+	if s.PipelineResponseWarnBytes > 0 && responseBytes > s.PipelineResponseWarnBytes {
+		s.Stats.Increment("pipeline.large_response")
+		s.warn(fmt.Sprintf("Responses to a pipeline of %d requests from %s add up to %d bytes, over PipelineResponseWarnBytes", count, conn.remoteAddr, responseBytes))
+	}
+	if err == nil {
+		s.setWriteDeadline(conn)
+		err = w.Flush()
+	}
+	if err == nil {
+		for _, after := range afters {
+			s.runAfterResponse(after)
+		}
+	}
+	return err
+}
+
+// warn logs a warning
+func (s *Server) warn(line string) {
+	if s.onWarning != nil {
+		s.onWarning(line)
+	}
+	log.Warning("%s", line)
+}
+
+// runAfterResponse starts the work a handler left to do after its response
+// was sent, see Span.AfterResponse
+func (s *Server) runAfterResponse(after []func()) {
+	if len(after) == 0 {
+		return
+	}
+	go func() {
+		for _, fn := range after {
+			fn()
+		}
+	}()
+}
+
+// readBatchRequest reads a sub-request of a pipelined batch, adding its size
+// to batchBytes. It fails with ErrBatchTooLarge without reading the request
+// if that takes the batch over MaxBatchBytes.
+func (s *Server) readBatchRequest(conn *serverConn, batchBytes *int64) (request []byte, err error) {
+	var size int32
+	err = binary.Read(conn, binary.BigEndian, &size)
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("%w: invalid frame length %d", ErrProtocol, size)
+	}
+	*batchBytes += int64(size)
+	if s.MaxBatchBytes > 0 && *batchBytes > s.MaxBatchBytes {
+		return nil, ErrBatchTooLarge
+	}
+	err = s.countReceived(conn, int64(size))
+	if err != nil {
+		return nil, err
+	}
+	return s.parseRequest(conn, size)
+}
+
+// countReceived adds a request of size bytes to the total the connection
+// has received, failing with ErrConnectionBytesExceeded if that takes it
+// over MaxBytesPerConnection
+func (s *Server) countReceived(conn *serverConn, size int64) error {
+	conn.received += size
+	if s.MaxBytesPerConnection > 0 && conn.received > s.MaxBytesPerConnection {
+		s.Stats.Increment("connection.bytes_exceeded")
+		return fmt.Errorf("%w: %s sent %d bytes, the limit is %d", ErrConnectionBytesExceeded, conn.remoteAddr, conn.received, s.MaxBytesPerConnection)
+	}
+	return nil
+}
+
+// sendResponse writes a single response, control frames, header, data and
+// checksum all in one write. stream is the stream the request came in on, 0
+// if it didn't.
+func (s *Server) sendResponse(conn *serverConn, stream uint32, data []byte, compressed bool) (err error) {
+	buffers := make(net.Buffers, 0, 5)
+	if stream != 0 {
+		buffers = append(buffers, streamFrame(stream))
+	}
+	if compressed == true {
+		buffers = append(buffers, controlFrame(controlCompressed))
+	}
+	buffers = append(buffers, frameBuffers(data, conn.features)...)
+	return conn.writeBuffers(buffers)
+}
+
+// sendError answers a request with an error frame instead of a response
+func (s *Server) sendError(conn *serverConn, stream uint32, code Code, message string) (err error) {
+	buffers := make(net.Buffers, 0, 5)
+	if stream != 0 {
+		buffers = append(buffers, streamFrame(stream))
+	}
+	buffers = append(buffers, controlFrame(controlError))
+	buffers = append(buffers, frameBuffers(errorFrame(code, message), conn.features)...)
+	return conn.writeBuffers(buffers)
+}
+
+// writeBuffers writes buffers to the connection in one go, holding the
+// writeLock
+func (c *serverConn) writeBuffers(buffers net.Buffers) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return writeBuffers(buffers, c.Conn)
+}
+
+// sendMultiResponse writes the frames of a MultiRequestHandler's response
+func (s *Server) sendMultiResponse(conn *serverConn, frames [][]byte) (err error) {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	w := bufio.NewWriter(conn)
+	err = writeControl(controlMulti, w)
+	if err == nil {
+		err = binary.Write(w, binary.BigEndian, -int32(len(frames)))
+	}
+	for _, frame := range frames {
+		if err != nil {
+			break
+		}
+		_, err = writeFrame(frame, w, conn.features)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	return err
+}
+
+func (s *Server) parseRequest(buf io.Reader, size int32) (request []byte, err error) {
 	request = make([]byte, size)
 	_, err = io.ReadFull(buf, request)
 	if err != nil {
@@ -240,17 +1425,200 @@ func (s *Server) parseRequest(buf io.Reader, size int32) (request []byte, err er
 	return
 }
 
-func (s *Server) handleRequest(request []byte, multi bool) (response []byte, err error) {
-	span := NewSpan(s.UUIDGenerator())
-	if multi == true {
-		span.Attr("multi", "true")
+func (s *Server) compressResponse(response []byte) (compressed []byte, err error) {
+	compressed, err = compress(response)
+	if err != nil {
+		return nil, err
 	}
-	span.Stats = s.Stats
-	span.Start("duration")
-	span.Add("num_connections", int64(s.NumConnections()))
-	response, err = s.Handler.Respond(request, span)
-	span.Finish("duration")
-	log.Info("%s", span.JSON())
-	span.Record()
-	return
+	s.Stats.Counter("response.compression_saved_bytes", int64(len(response)-len(compressed)))
+	return compressed, nil
+}
+
+// respondTo returns a func that passes request to the connection's handler
+func (s *Server) respondTo(conn *serverConn, request []byte) func(*Span) ([]byte, error) {
+	return func(span *Span) ([]byte, error) {
+		return conn.handler.Respond(request, span)
+	}
+}
+
+// connHandler returns the handler for a connection, for a TLS one that
+// means finishing the TLS handshake to find out which server name the
+// client asked for
+func (s *Server) connHandler(clientConn net.Conn) (handler RequestHandler, err error) {
+	tlsConn, ok := clientConn.(*tls.Conn)
+	if ok == false {
+		return s.Handler, nil
+	}
+	err = tlsConn.Handshake()
+	if err != nil {
+		s.Stats.Increment("connection.tls_failure")
+		return nil, err
+	}
+	serverName := tlsConn.ConnectionState().ServerName
+	handler, ok = s.SNIHandlers[serverName]
+	if ok == false {
+		handler = s.Handler
+	}
+	if handler == nil {
+		s.Stats.Increment("connection.unknown_server_name")
+		return nil, fmt.Errorf("%w: %q", ErrUnknownServerName, serverName)
+	}
+	return handler, nil
+}
+
+// handleRequest sets up the request's Span and calls respond with it to get
+// the response from the Handler, it also reports whether the response should
+// be compressed and what the Handler left to run after it is sent. request is
+// only used to consult the SpanFilter, it's nil when the Handler reads the
+// request itself. A request the AdmissionController rejects fails with
+// errOverloaded without respond being called.
+func (s *Server) handleRequest(conn *serverConn, request []byte, respond func(*Span) ([]byte, error), metadata map[string]string, multi bool) (response []byte, compress bool, after []func(), err error) {
+	if s.admit() == false {
+		return nil, false, nil, errOverloaded
+	}
+	atomic.AddInt64(&s.handling, 1)
+	spanned := s.SpanFilter == nil || request == nil || s.SpanFilter(request) == true
+	var span *Span
+	var inflightId uint64
+	if spanned == true {
+		span = s.newRequestSpan(conn, metadata)
+		inflightId = s.addInflight(span)
+		if multi == true {
+			span.Attr("multi", "true")
+		}
+		span.Stats = s.Stats
+	} else {
+		// the handler still gets a Span to use, it's just never recorded
+		span = NewSpan("")
+		span.RemoteAddr = conn.remoteAddr
+		span.features = conn.features
+		span.onLog = s.onSpanLog
+		if metadata != nil {
+			span.Metadata = metadata
+		}
+	}
+	if s.slots != nil {
+		waitStart := time.Now()
+		s.slots.acquire(metadata[PriorityMetadataKey] == PriorityHigh)
+		span.SubSpanWithDuration("queue_wait", float64(time.Since(waitStart))/float64(time.Millisecond))
+	}
+	if spanned == true {
+		span.Start("duration")
+		span.Add("num_connections", int64(s.NumConnections()))
+	}
+	timeout := s.requestTimeout(metadata)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		span.ctx, cancel = context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+	}
+	response, running, err := s.callHandler(respond, span)
+	if err == errHandlerTimeout {
+		span.Attr("timeout", "true")
+		s.Stats.Increment("handler.timeout")
+	}
+	if response == nil && err == nil {
+		log.Warning("Handler returned a nil response without an error for span %s", span.Id)
+		s.Stats.Increment("handler.nil_response")
+		response = []byte{}
+	}
+	// finish records the span and gives up the request's slot, which has to
+	// wait for a handler that timed out to return since it may still be
+	// using the span
+	finish := func() {
+		if spanned == true {
+			span.Finish("duration")
+			s.latency.add(span.Duration("duration"), time.Now())
+			log.Info("%s", span.JSON())
+			span.Record()
+			if s.SpanSink != nil {
+				s.SpanSink.Record(span)
+			}
+			s.removeInflight(inflightId)
+		}
+		if s.slots != nil {
+			s.slots.release()
+		}
+		atomic.AddInt64(&s.handling, -1)
+	}
+	if running != nil {
+		go func() {
+			<-running
+			finish()
+		}()
+	} else {
+		finish()
+	}
+	if span.connectionCloseRequested() == true {
+		atomic.StoreInt32(&conn.closing, 1)
+	}
+	compress = conn.features&featureCompression != 0 && span.compressionDisabled() == false && len(response) >= compressionMinLength
+	return response, compress, span.afterResponseFuncs(), err
+}
+
+// requestTimeout is how long the handler has to answer the request, the
+// shorter of the HandlerTimeout and the timeout the client sent, or 0 when
+// there's neither
+func (s *Server) requestTimeout(metadata map[string]string) time.Duration {
+	timeout := s.HandlerTimeout
+	if value, ok := metadata[TimeoutMetadataKey]; ok == true {
+		client, err := time.ParseDuration(value)
+		if err == nil && client > 0 && (timeout <= 0 || client < timeout) {
+			timeout = client
+		}
+	}
+	return timeout
+}
+
+// callHandler calls respond, giving up on it once it has taken longer than
+// the HandlerTimeout. When it gives up, running is closed once respond has
+// returned.
+func (s *Server) callHandler(respond func(*Span) ([]byte, error), span *Span) (response []byte, running <-chan struct{}, err error) {
+	if s.HandlerTimeout <= 0 {
+		response, err = respond(span)
+		return response, nil, err
+	}
+	type result struct {
+		response []byte
+		err      error
+	}
+	// buffered so the handler's goroutine can finish after a timeout
+	done := make(chan result, 1)
+	returned := make(chan struct{})
+	go func() {
+		defer close(returned)
+		response, err := respond(span)
+		done <- result{response, err}
+	}()
+	timer := time.NewTimer(s.HandlerTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.response, nil, r.err
+	case <-timer.C:
+		return nil, returned, errHandlerTimeout
+	}
+}
+
+// newRequestSpan creates the Span for a request, with the id and parent id
+// the client sent or a generated id
+func (s *Server) newRequestSpan(conn *serverConn, metadata map[string]string) *Span {
+	parentId := metadata[ParentIdMetadataKey]
+	spanId, ok := metadata[SpanIdMetadataKey]
+	if ok == false || spanId == "" {
+		if s.UUIDGeneratorWithContext != nil {
+			spanId = s.UUIDGeneratorWithContext(conn.remoteAddr, parentId)
+		} else {
+			spanId = s.UUIDGenerator()
+		}
+	}
+	span := NewSpan(spanId)
+	span.ParentId = parentId
+	span.RemoteAddr = conn.remoteAddr
+	span.features = conn.features
+	span.onLog = s.onSpanLog
+	if metadata != nil {
+		span.Metadata = metadata
+	}
+	return span
 }
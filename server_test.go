@@ -1,14 +1,31 @@
 package tcpez
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
 	"github.com/golang/protobuf/proto"
 	json "encoding/json"
 	"errors"
 	"fmt"
 	"github.com/bmizerany/assert"
 	"github.com/op/go-logging"
+	"io"
 	math "math"
+	"math/big"
 	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -23,6 +40,74 @@ func (h *EchoHandler) Respond(req []byte, span *Span) (response []byte, err erro
 func (h *EchoHandler) Record(span *Span) {
 }
 
+type NilHandler struct{}
+
+func (h *NilHandler) Respond(req []byte, span *Span) (response []byte, err error) {
+	return nil, nil
+}
+
+// testStatsRecorder captures the stats it is sent so tests can assert on them
+type testStatsRecorder struct {
+	sync.Mutex
+	counters map[string]int64
+	timers   map[string][]int64
+	gauges   map[string]int64
+}
+
+func newTestStatsRecorder() *testStatsRecorder {
+	return &testStatsRecorder{counters: make(map[string]int64), timers: make(map[string][]int64), gauges: make(map[string]int64)}
+}
+
+func (s *testStatsRecorder) Timer(stat string, amount int64) {
+	s.Lock()
+	defer s.Unlock()
+	s.timers[stat] = append(s.timers[stat], amount)
+}
+
+func (s *testStatsRecorder) DurationTimer(stat string, begin time.Time, end time.Time) {
+	s.Timer(stat, int64(end.Sub(begin)/time.Millisecond))
+}
+
+func (s *testStatsRecorder) Gauge(stat string, amount int64) {
+	s.Lock()
+	defer s.Unlock()
+	s.gauges[stat] = amount
+}
+
+func (s *testStatsRecorder) Counter(stat string, amount int64) {
+	s.Lock()
+	defer s.Unlock()
+	s.counters[stat] += amount
+}
+
+func (s *testStatsRecorder) Increment(stat string) {
+	s.Counter(stat, 1)
+}
+
+func (s *testStatsRecorder) counter(stat string) int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.counters[stat]
+}
+
+func (s *testStatsRecorder) gauge(stat string) int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.gauges[stat]
+}
+
+func (s *testStatsRecorder) timerCount(stat string) int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.timers[stat])
+}
+
+func (s *testStatsRecorder) timer(stat string) []int64 {
+	s.Lock()
+	defer s.Unlock()
+	return append([]int64(nil), s.timers[stat]...)
+}
+
 // Reference proto, json, and math imports to suppress error if they are not otherwise used.
 var _ = proto.Marshal
 var _ = &json.SyntaxError{}
@@ -80,14 +165,22 @@ func init() {
 	logging.SetLevel(logging.ERROR, "tcpez")
 }
 
-func TestEchoServer(t *testing.T) {
-	addr := "127.0.0.1:2001"
-	l, err := NewServer(addr, new(EchoHandler))
+// newTestServer starts a server for handler on a free port, configured by
+// configure before it's started so the settings don't race with it
+func newTestServer(handler RequestHandler, configure ...func(*Server)) (s *Server, addr string) {
+	s, err := NewServer("127.0.0.1:0", handler)
 	if err != nil {
-		log.Error(err.Error())
+		panic(err)
 	}
-	assert.T(t, l != nil)
-	go l.Start()
+	for _, c := range configure {
+		c(s)
+	}
+	go s.Start()
+	return s, s.Addr().String()
+}
+
+func TestEchoServer(t *testing.T) {
+	l, addr := newTestServer(new(EchoHandler))
 	defer l.Close()
 	c, err := NewClient([]string{addr}, 3, 3*time.Second)
 	assert.T(t, c != nil)
@@ -100,10 +193,7 @@ func TestEchoServer(t *testing.T) {
 }
 
 func TestEchoServerPipelined(t *testing.T) {
-	addr := "127.0.0.1:2001"
-	l, _ := NewServer(addr, new(EchoHandler))
-	assert.T(t, l != nil)
-	go l.Start()
+	l, addr := newTestServer(new(EchoHandler))
 	defer l.Close()
 	c, _ := NewClient([]string{addr}, 3, 3*time.Second)
 	assert.T(t, c != nil)
@@ -118,7 +208,6 @@ func TestEchoServerPipelined(t *testing.T) {
 }
 
 func TestProtoServer(t *testing.T) {
-	addr := "127.0.0.1:2001"
 	requestFunc := ProtoInitializerFunc(func() proto.Message {
 		return new(Request)
 	})
@@ -133,9 +222,10 @@ func TestProtoServer(t *testing.T) {
 		response.Status = proto.String("OK")
 		response.Message = proto.String(message)
 	})
-	l, _ := NewProtoServer(addr, requestFunc, responseFunc, handlerFunc)
+	l, _ := NewProtoServer("127.0.0.1:0", requestFunc, responseFunc, handlerFunc)
 	assert.T(t, l != nil)
-	assert.Equal(t, addr, l.Address)
+	assert.Equal(t, "127.0.0.1:0", l.Address)
+	addr := l.Addr().String()
 	go l.Start()
 	defer l.Close()
 	c, _ := NewClient([]string{addr}, 3, 3*time.Second)
@@ -164,13 +254,7 @@ func TestProtoServer(t *testing.T) {
 }
 
 func TestEchoServerReconnect(t *testing.T) {
-	addr := "127.0.0.1:2001"
-	l, err := NewServer(addr, new(EchoHandler))
-	if err != nil {
-		log.Error(err.Error())
-	}
-	assert.T(t, l != nil)
-	go l.Start()
+	l, addr := newTestServer(new(EchoHandler))
 	c, err := NewClient([]string{addr}, 3, 3*time.Second)
 	assert.T(t, c != nil)
 	var resp []byte
@@ -191,6 +275,7 @@ func TestEchoServerReconnect(t *testing.T) {
 	}
 	assert.T(t, l != nil)
 	go l.Start()
+	defer l.Close()
 	for i := 0; i < 10; i++ {
 		resp, err = c.SendRecv([]byte("PING"))
 		if err != nil {
@@ -205,3 +290,2693 @@ func TestBreakingRetryableError(t *testing.T) {
 	assert.T(t, retryableError(errors.New("Sup")) == false)
 	assert.T(t, retryableError(&net.OpError{Err: syscall.EPIPE}) == true)
 }
+
+func TestSendRecvWithInfo(t *testing.T) {
+	l, addr := newTestServer(new(EchoHandler))
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 3, 3*time.Second)
+	assert.T(t, c != nil)
+	resp, info, err := c.SendRecvWithInfo([]byte("PING"))
+	assert.T(t, err == nil)
+	assert.Equal(t, []byte("PING"), resp)
+	assert.Equal(t, false, info.Dialed)
+	assert.Equal(t, 0, info.Retries)
+	assert.Equal(t, addr, info.Backend)
+	// drain the pool so the next request has to dial
+	for c.pool.Len() > 0 {
+		conn, _ := c.pool.Take()
+		c.pool.Discard(conn)
+	}
+	resp, info, err = c.SendRecvWithInfo([]byte("PING"))
+	assert.T(t, err == nil)
+	assert.Equal(t, []byte("PING"), resp)
+	assert.Equal(t, true, info.Dialed)
+	assert.Equal(t, addr, info.Backend)
+	_, info, _ = c.SendRecvWithInfo([]byte("PING"))
+	assert.Equal(t, false, info.Dialed)
+}
+
+func TestSendRecvRetries(t *testing.T) {
+	l, addr := newTestServer(new(EchoHandler))
+	c, _ := NewClient([]string{addr}, 3, 3*time.Second)
+	assert.T(t, c != nil)
+	resp, err := c.SendRecvRetries([]byte("PING"), 0)
+	assert.T(t, err == nil)
+	assert.Equal(t, []byte("PING"), resp)
+	// a negative count still sends the request once
+	resp, err = c.SendRecvRetries([]byte("PING"), -1)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []byte("PING"), resp)
+	c.Retries = -1
+	resp, err = c.SendRecv([]byte("PING"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []byte("PING"), resp)
+	c.Retries = 2
+	l.Close()
+	// with no retries only the first (dead) pooled connection is tried
+	resp, err = c.SendRecvRetries([]byte("PING"), 0)
+	assert.T(t, resp == nil)
+	assert.T(t, err != nil)
+	assert.T(t, retryableError(err))
+	assert.Equal(t, 2, c.pool.Len())
+	// with retries the rest of the pool is tried too
+	_, info, err := c.SendRecvWithInfo([]byte("PING"))
+	assert.T(t, err != nil)
+	assert.Equal(t, 2, info.Retries)
+	assert.Equal(t, 0, c.pool.Len())
+}
+
+type NamedHandler struct {
+	name  string
+	sleep time.Duration
+}
+
+func (h *NamedHandler) Respond(req []byte, span *Span) (response []byte, err error) {
+	time.Sleep(h.sleep)
+	return []byte(h.name + ":" + span.Metadata["user"]), nil
+}
+
+func TestSendRecvOpts(t *testing.T) {
+	addrs := make([]string, 2)
+	for i := range addrs {
+		l, addr := newTestServer(&NamedHandler{name: fmt.Sprintf("server%d", i), sleep: 10 * time.Millisecond})
+		defer l.Close()
+		addrs[i] = addr
+	}
+	c, _ := NewClient(addrs, 2, 3*time.Second)
+	assert.T(t, c != nil)
+	for i := 0; i < 10; i++ {
+		resp, err := c.SendRecvOpts([]byte("PING"), WithBackend(addrs[1]), WithMetadata("user", "bob"), WithRetries(0))
+		assert.T(t, err == nil)
+		assert.Equal(t, "server1:bob", string(resp))
+	}
+	resp, err := c.SendRecvOpts([]byte("PING"), WithBackend(addrs[0]), WithMetadata("user", "alice"), WithMetadata("role", "admin"))
+	assert.T(t, err == nil)
+	assert.Equal(t, "server0:alice", string(resp))
+	resp, err = c.SendRecvOpts([]byte("PING"), WithTimeout(time.Millisecond), WithRetries(0))
+	assert.T(t, resp == nil)
+	assert.T(t, err.(net.Error).Timeout())
+}
+
+func TestServerAddr(t *testing.T) {
+	l, err := NewServer("127.0.0.1:0", new(EchoHandler))
+	assert.T(t, err == nil)
+	defer l.Close()
+	assert.Equal(t, "127.0.0.1:0", l.Address)
+	addr := l.Addr().(*net.TCPAddr)
+	assert.T(t, addr.Port != 0)
+	go l.Start()
+	c, err := NewClient([]string{addr.String()}, 1, time.Second)
+	assert.T(t, err == nil)
+	resp, err := c.SendRecv([]byte("PING"))
+	assert.T(t, err == nil)
+	assert.Equal(t, []byte("PING"), resp)
+}
+
+func TestNilResponse(t *testing.T) {
+	stats := newTestStatsRecorder()
+	l, addr := newTestServer(new(NilHandler), func(s *Server) { s.Stats = stats })
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	for i := 0; i < 3; i++ {
+		resp, err := c.SendRecv([]byte("PING"))
+		assert.T(t, err == nil)
+		assert.Equal(t, 0, len(resp))
+	}
+	pipe := c.Pipeline()
+	pipe.Send([]byte("PING1"))
+	pipe.Send([]byte("PING2"))
+	responses, err := pipe.Flush()
+	assert.T(t, err == nil)
+	assert.Equal(t, 2, len(responses))
+	assert.Equal(t, int64(5), stats.counter("handler.nil_response"))
+}
+
+func TestStreamingPipeline(t *testing.T) {
+	l, addr := newTestServer(new(EchoHandler))
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	p, err := c.StreamingPipeline()
+	assert.T(t, err == nil)
+	n := 100
+	sending := make(chan bool, 1)
+	go func() {
+		for i := 0; i < n; i++ {
+			p.Send([]byte(fmt.Sprintf("PING%d", i)))
+			time.Sleep(time.Millisecond)
+		}
+		sending <- false
+		p.Close()
+	}()
+	i := 0
+	overlapped := false
+	for r := range p.Responses() {
+		assert.T(t, r.Err == nil)
+		assert.Equal(t, fmt.Sprintf("PING%d", i), string(r.Response))
+		if i == 0 {
+			// the first response arrives while requests are still being sent
+			overlapped = len(sending) == 0
+		}
+		i++
+	}
+	assert.Equal(t, n, i)
+	assert.T(t, overlapped)
+	assert.Equal(t, ErrPipelineClosed, p.Send([]byte("PING")))
+	// the connection goes back to the pool once everything is read
+	assert.Equal(t, 1, c.pool.Len())
+}
+
+func TestStreamingPipelineMaxInflight(t *testing.T) {
+	handler := &BlockingHandler{started: make(chan bool, 3), release: make(chan bool)}
+	l, addr := newTestServer(handler)
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	p, err := c.StreamingPipeline()
+	assert.T(t, err == nil)
+	p.MaxInflight = 2
+	assert.T(t, p.Send([]byte("PING1")) == nil)
+	assert.T(t, p.Send([]byte("PING2")) == nil)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- p.Send([]byte("PING3"))
+	}()
+	// the window is full until the first response arrives
+	select {
+	case <-sent:
+		t.Fatal("Send didn't block with a full window")
+	case <-time.After(50 * time.Millisecond):
+	}
+	handler.release <- true
+	select {
+	case err = <-sent:
+		assert.T(t, err == nil)
+	case <-time.After(time.Second):
+		t.Fatal("Send didn't unblock after a response arrived")
+	}
+	handler.release <- true
+	handler.release <- true
+	p.Close()
+	i := 0
+	for r := range p.Responses() {
+		i++
+		assert.T(t, r.Err == nil)
+		assert.Equal(t, fmt.Sprintf("PING%d", i), string(r.Response))
+	}
+	assert.Equal(t, 3, i)
+}
+
+func TestStreamingPipelineZeroMaxInflight(t *testing.T) {
+	c := TestClient(new(EchoHandler))
+	defer c.Close()
+	p, err := c.StreamingPipeline()
+	assert.T(t, err == nil)
+	// falls back to the default rather than never having room
+	p.MaxInflight = 0
+	sent := make(chan error, 1)
+	go func() {
+		sent <- p.Send([]byte("PING"))
+	}()
+	select {
+	case err = <-sent:
+		assert.T(t, err == nil)
+	case <-time.After(time.Second):
+		t.Fatal("Send blocked with a MaxInflight of 0")
+	}
+	p.Close()
+	r := <-p.Responses()
+	assert.T(t, r.Err == nil)
+	assert.Equal(t, "PING", string(r.Response))
+}
+
+func TestStreamingPipelineMaxInflightClamped(t *testing.T) {
+	p := &StreamingPipeline{MaxInflight: 4 * streamingPipelineWindow}
+	assert.Equal(t, streamingPipelineWindow, p.maxInflight())
+	p.MaxInflight = 16
+	assert.Equal(t, 16, p.maxInflight())
+}
+
+type BlockingHandler struct {
+	started chan bool
+	release chan bool
+}
+
+func (h *BlockingHandler) Respond(req []byte, span *Span) (response []byte, err error) {
+	h.started <- true
+	<-h.release
+	return req, nil
+}
+
+func TestInflightSpans(t *testing.T) {
+	handler := &BlockingHandler{started: make(chan bool, 1), release: make(chan bool)}
+	l, addr := newTestServer(handler)
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	assert.Equal(t, 0, len(l.InflightSpans()))
+	done := make(chan error)
+	go func() {
+		_, err := c.SendRecv([]byte("PING"))
+		done <- err
+	}()
+	<-handler.started
+	spans := l.InflightSpans()
+	assert.Equal(t, 1, len(spans))
+	assert.T(t, spans[0].RemoteAddr != "")
+	assert.T(t, time.Since(spans[0].Started) > 0)
+	handler.release <- true
+	assert.T(t, <-done == nil)
+	assert.Equal(t, 0, len(l.InflightSpans()))
+}
+
+type CompressibleHandler struct{}
+
+func (h *CompressibleHandler) Respond(req []byte, span *Span) (response []byte, err error) {
+	if string(req) == "RAW" {
+		span.DisableCompression()
+	}
+	return []byte(strings.Repeat("PONG", 100)), nil
+}
+
+func TestCompression(t *testing.T) {
+	l, addr := newTestServer(new(CompressibleHandler), func(s *Server) { s.Compression = true })
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	for _, req := range []string{"PING", "RAW"} {
+		resp, err := c.SendRecv([]byte(req))
+		assert.T(t, err == nil)
+		assert.Equal(t, strings.Repeat("PONG", 100), string(resp))
+	}
+}
+
+func TestCompressionDisabledByHandler(t *testing.T) {
+	l, addr := newTestServer(new(CompressibleHandler), func(s *Server) { s.Compression = true })
+	defer l.Close()
+	conn, err := net.Dial("tcp", addr)
+	assert.T(t, err == nil)
+	defer conn.Close()
+	f, err := clientHandshake(conn, featureCompression)
+	assert.T(t, err == nil)
+	assert.Equal(t, featureCompression, f)
+
+	writeDataWithLength([]byte("PING"), conn)
+	header, info, err := readHeader(conn)
+	assert.T(t, err == nil)
+	assert.T(t, info.compressed)
+	assert.T(t, header < 400)
+	_, err = io.ReadFull(conn, make([]byte, header))
+	assert.T(t, err == nil)
+
+	writeDataWithLength([]byte("RAW"), conn)
+	header, info, err = readHeader(conn)
+	assert.T(t, err == nil)
+	assert.T(t, !info.compressed)
+	assert.Equal(t, int32(400), header)
+	raw := make([]byte, header)
+	_, err = io.ReadFull(conn, raw)
+	assert.T(t, err == nil)
+	assert.Equal(t, strings.Repeat("PONG", 100), string(raw))
+}
+
+// LargeHandler answers "n" with 64KB of "n"s, later requests finish first
+type LargeHandler struct{}
+
+func (h *LargeHandler) Respond(req []byte, span *Span) (response []byte, err error) {
+	var n int
+	fmt.Sscanf(string(req), "%d", &n)
+	time.Sleep(time.Duration(20-n) * time.Millisecond)
+	return []byte(strings.Repeat(string(req[len(req)-1]), 64*1024)), nil
+}
+
+func TestPipelineLargeResponses(t *testing.T) {
+	l, addr := newTestServer(new(LargeHandler))
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	pipe := c.Pipeline()
+	for i := 0; i < 20; i++ {
+		pipe.Send([]byte(fmt.Sprintf("%d", i)))
+	}
+	responses, err := pipe.Flush()
+	assert.T(t, err == nil)
+	assert.Equal(t, 20, len(responses))
+	for i, res := range responses {
+		req := fmt.Sprintf("%d", i)
+		assert.Equal(t, strings.Repeat(req[len(req)-1:], 64*1024), string(res))
+	}
+}
+
+func BenchmarkPipelineLargeResponses(b *testing.B) {
+	l, addr := newTestServer(new(LargeHandler))
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	b.ReportAllocs()
+	b.SetBytes(20 * 64 * 1024)
+	for i := 0; i < b.N; i++ {
+		pipe := c.Pipeline()
+		for j := 0; j < 20; j++ {
+			pipe.Send([]byte(fmt.Sprintf("%d", j)))
+		}
+		_, err := pipe.Flush()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// readCountingConn counts the Reads made from it
+type readCountingConn struct {
+	net.Conn
+	reads int64
+}
+
+func (c *readCountingConn) Read(b []byte) (int, error) {
+	atomic.AddInt64(&c.reads, 1)
+	return c.Conn.Read(b)
+}
+
+// newReadCountingClient returns a Client with a single connection whose
+// Reads are counted, and its responses read through a buffer of size
+func newReadCountingClient(addr string, size int) (c *Client, conn *readCountingConn) {
+	pool, _ := NewConnectionPool([]string{addr}, 0, time.Second)
+	pool.ReadBufferSize = size
+	pool.Dialer = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		dialed, err := net.DialTimeout(network, address, timeout)
+		if err != nil {
+			return nil, err
+		}
+		conn = &readCountingConn{Conn: dialed}
+		return conn, nil
+	}
+	c = NewClientWithPool(pool)
+	pooled, _ := pool.Take()
+	pool.Return(pooled)
+	return c, conn
+}
+
+func TestPooledConnReadBuffer(t *testing.T) {
+	l, addr := newTestServer(new(EchoHandler))
+	defer l.Close()
+	c, conn := newReadCountingClient(addr, 0)
+	reqs := make([][]byte, 500)
+	for i := range reqs {
+		reqs[i] = []byte(fmt.Sprintf("PING%d", i))
+	}
+	before := atomic.LoadInt64(&conn.reads)
+	responses, err := c.SendRecvBatch(reqs)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, reqs, responses)
+	// unbuffered the header and data of each response would take a read
+	// of their own
+	reads := atomic.LoadInt64(&conn.reads) - before
+	assert.T(t, reads < int64(len(reqs)), reads)
+	// what was left in the buffer stays with the connection for the next
+	// request
+	res, err := c.SendRecv([]byte("PING"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "PING", string(res))
+}
+
+func BenchmarkPipelineReads(b *testing.B) {
+	l, addr := newTestServer(new(EchoHandler))
+	defer l.Close()
+	reqs := make([][]byte, 1000)
+	for i := range reqs {
+		reqs[i] = []byte(fmt.Sprintf("PING%d", i))
+	}
+	for _, size := range []int{16, 4096, 64 * 1024} {
+		b.Run(fmt.Sprintf("buffer=%d", size), func(b *testing.B) {
+			c, conn := newReadCountingClient(addr, size)
+			before := atomic.LoadInt64(&conn.reads)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := c.SendRecvBatch(reqs)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(atomic.LoadInt64(&conn.reads)-before)/float64(b.N), "reads/op")
+		})
+	}
+}
+
+func TestMaxInflightQueueWait(t *testing.T) {
+	l, err := NewServer("127.0.0.1:0", &NamedHandler{name: "slow", sleep: 50 * time.Millisecond})
+	assert.T(t, err == nil)
+	defer l.Close()
+	stats := newTestStatsRecorder()
+	l.Stats = stats
+	l.MaxInflight = 1
+	go l.Start()
+	c, _ := NewClient([]string{l.Addr().String()}, 2, time.Second)
+	assert.T(t, c != nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.SendRecv([]byte("PING"))
+			assert.T(t, err == nil)
+		}()
+	}
+	wg.Wait()
+	waits := stats.timer("queue_wait")
+	assert.Equal(t, 2, len(waits))
+	// one of them had to wait for the other to be handled
+	assert.T(t, waits[0] >= 40 || waits[1] >= 40)
+}
+
+// OrderHandler records the order requests are handled in, holding up the
+// "block" request until release is closed
+type OrderHandler struct {
+	blocked chan struct{}
+	release chan struct{}
+	order   []string
+	sync.Mutex
+}
+
+func (h *OrderHandler) Respond(req []byte, span *Span) (response []byte, err error) {
+	if string(req) == "block" {
+		close(h.blocked)
+		<-h.release
+	}
+	h.Lock()
+	h.order = append(h.order, string(req))
+	h.Unlock()
+	return req, nil
+}
+
+func TestMaxInflightPriority(t *testing.T) {
+	handler := &OrderHandler{blocked: make(chan struct{}), release: make(chan struct{})}
+	l, err := NewServer("127.0.0.1:0", handler)
+	assert.T(t, err == nil)
+	defer l.Close()
+	l.MaxInflight = 1
+	go l.Start()
+	c, _ := NewClient([]string{l.Addr().String()}, 0, time.Second)
+	assert.T(t, c != nil)
+	var wg sync.WaitGroup
+	send := func(req string, opts ...Option) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.SendRecvOpts([]byte(req), opts...)
+			assert.T(t, err == nil)
+		}()
+	}
+	waitFor := func(cond func() bool) {
+		for cond() == false {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	send("block")
+	<-handler.blocked
+	send("low1")
+	waitFor(func() bool { return l.slots.queued() == 1 })
+	send("low2")
+	waitFor(func() bool { return l.slots.queued() == 2 })
+	send("high", WithMetadata(PriorityMetadataKey, PriorityHigh))
+	waitFor(func() bool { return l.slots.queued() == 3 })
+	close(handler.release)
+	wg.Wait()
+	handler.Lock()
+	defer handler.Unlock()
+	assert.Equal(t, []string{"block", "high", "low1", "low2"}, handler.order)
+}
+
+func TestClientClose(t *testing.T) {
+	l, addr := newTestServer(new(EchoHandler))
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 2, time.Second)
+	assert.T(t, c != nil)
+	_, err := c.SendRecv([]byte("PING"))
+	assert.T(t, err == nil)
+	conns := append([]*PooledConn(nil), c.pool.pools[addr]...)
+	assert.Equal(t, 2, len(conns))
+	assert.T(t, c.Close() == nil)
+	assert.Equal(t, 0, c.pool.Len())
+	for _, conn := range conns {
+		_, err := conn.Write([]byte("PING"))
+		assert.T(t, err != nil)
+	}
+	_, err = c.SendRecv([]byte("PING"))
+	assert.Equal(t, ErrPoolClosed, err)
+	assert.Equal(t, ErrPoolClosed, c.Close())
+}
+
+func TestSendRecvBatch(t *testing.T) {
+	l, addr := newTestServer(new(EchoHandler))
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	reqs := make([][]byte, 5)
+	for i := range reqs {
+		reqs[i] = []byte(fmt.Sprintf("PING%d", i))
+	}
+	responses, err := c.SendRecvBatch(reqs)
+	assert.T(t, err == nil)
+	assert.Equal(t, reqs, responses)
+	responses, err = c.SendRecvBatch(nil)
+	assert.T(t, err == nil)
+	assert.Equal(t, 0, len(responses))
+}
+
+// newFlakyPipelineServer echoes pipelined requests, except that it hangs up
+// on the first pipeline after answering only the first answered requests.
+// received counts every request it reads.
+func newFlakyPipelineServer(answered int) (l net.Listener, addr string, received *int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	received = new(int32)
+	var once sync.Once
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := serverHandshake(conn, 0); err != nil {
+					return
+				}
+				for {
+					header, _, err := readHeader(conn)
+					if err != nil || header >= 0 {
+						return
+					}
+					requests := make([][]byte, -header)
+					for i := range requests {
+						requests[i], _ = readDataWithLength(conn)
+						atomic.AddInt32(received, 1)
+					}
+					hangup := false
+					once.Do(func() { hangup = true })
+					binary.Write(conn, binary.BigEndian, header)
+					for i, req := range requests {
+						if hangup && i == answered {
+							return
+						}
+						writeDataWithLength(req, conn)
+					}
+				}
+			}()
+		}
+	}()
+	return l, l.Addr().String(), received
+}
+
+func TestSendRecvBatchRetriesUnanswered(t *testing.T) {
+	l, addr, received := newFlakyPipelineServer(2)
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	reqs := make([][]byte, 5)
+	for i := range reqs {
+		reqs[i] = []byte(fmt.Sprintf("PING%d", i))
+	}
+	responses, err := c.SendRecvBatch(reqs)
+	assert.T(t, err == nil)
+	assert.Equal(t, reqs, responses)
+	// the 3 requests that weren't answered were sent again
+	assert.Equal(t, int32(8), atomic.LoadInt32(received))
+
+	l2, addr2, _ := newFlakyPipelineServer(2)
+	defer l2.Close()
+	c2, _ := NewClient([]string{addr2}, 1, time.Second)
+	c2.Retries = 0
+	_, err = c2.SendRecvBatch(reqs)
+	assert.T(t, err != nil)
+}
+
+func TestRetryStats(t *testing.T) {
+	l, addr := newTestServer(new(EchoHandler))
+	c, _ := NewClient([]string{addr}, 3, 3*time.Second)
+	assert.T(t, c != nil)
+	stats := newTestStatsRecorder()
+	c.Stats = stats
+	_, err := c.SendRecv([]byte("PING"))
+	assert.T(t, err == nil)
+	assert.Equal(t, int64(0), stats.counter("client.retry"))
+	l.Close()
+	_, err = c.SendRecv([]byte("PING"))
+	assert.T(t, err != nil)
+	assert.Equal(t, int64(2), stats.counter("client.retry"))
+
+	fl, flakyAddr, _ := newFlakyPipelineServer(1)
+	defer fl.Close()
+	c, _ = NewClient([]string{flakyAddr}, 1, time.Second)
+	stats = newTestStatsRecorder()
+	c.Stats = stats
+	_, err = c.SendRecvBatch([][]byte{[]byte("PING1"), []byte("PING2")})
+	assert.T(t, err == nil)
+	assert.Equal(t, int64(1), stats.counter("client.retry"))
+	assert.Equal(t, int64(1), stats.counter("client.retry.eof"))
+}
+
+func TestRetryReason(t *testing.T) {
+	assert.Equal(t, "eof", retryReason(io.EOF))
+	assert.Equal(t, "connection_reset", retryReason(&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}))
+	assert.Equal(t, "broken_pipe", retryReason(&net.OpError{Op: "write", Err: syscall.EPIPE}))
+	assert.Equal(t, "other", retryReason(errors.New("boom")))
+}
+
+func TestClientStats(t *testing.T) {
+	l, addr := newTestServer(new(EchoHandler))
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	stats := newTestStatsRecorder()
+	c.Stats = stats
+	for i := 0; i < 3; i++ {
+		_, err := c.SendRecv([]byte("PING"))
+		assert.T(t, err == nil)
+	}
+	assert.Equal(t, 3, stats.timerCount("client.request"))
+	assert.Equal(t, int64(3), stats.counter("client.request.success"))
+	assert.Equal(t, int64(3), stats.counter("client.pool.take"))
+	assert.Equal(t, int64(0), stats.counter("client.pool.dial"))
+	l.Close()
+	_, err := c.SendRecvRetries([]byte("PING"), 0)
+	assert.T(t, err != nil)
+	assert.Equal(t, 4, stats.timerCount("client.request"))
+	assert.Equal(t, int64(1), stats.counter("client.request.failure"))
+}
+
+func TestClientSpan(t *testing.T) {
+	l, addr := newTestServer(new(EchoHandler))
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	stats := newTestStatsRecorder()
+	c.Stats = stats
+	_, info, err := c.SendRecvWithInfo([]byte("PING"))
+	assert.T(t, err == nil)
+	assert.T(t, info.Span != nil)
+	assert.T(t, info.Span.Duration("client.write") > 0)
+	assert.T(t, info.Span.Duration("client.read") > 0)
+	backend, _ := info.Span.GetAttr("backend")
+	assert.Equal(t, addr, backend)
+	assert.Equal(t, 1, stats.timerCount("client.read"))
+}
+
+func newDiscardConn() (conn net.Conn, closer func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	go func() {
+		server, err := l.Accept()
+		if err == nil {
+			io.Copy(io.Discard, server)
+		}
+	}()
+	conn, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		panic(err)
+	}
+	return conn, func() { conn.Close(); l.Close() }
+}
+
+func BenchmarkWriteDataWithLength(b *testing.B) {
+	conn, closer := newDiscardConn()
+	defer closer()
+	data := make([]byte, 1024*1024)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		writeDataWithLength(data, conn)
+	}
+}
+
+// BenchmarkWriteDataConcatenated is the copy writeDataWithLength avoids
+func BenchmarkWriteDataConcatenated(b *testing.B) {
+	conn, closer := newDiscardConn()
+	defer closer()
+	data := make([]byte, 1024*1024)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		buf := bytes.NewBuffer(nil)
+		binary.Write(buf, binary.BigEndian, int32(len(data)))
+		buf.Write(data)
+		conn.Write(buf.Bytes())
+	}
+}
+
+// countingConn counts the Writes made to it
+type countingConn struct {
+	net.Conn
+	writes int32
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt32(&c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+func TestSendResponseSingleWrite(t *testing.T) {
+	s := &Server{}
+	client, server := net.Pipe()
+	defer client.Close()
+	counting := &countingConn{Conn: server}
+	conn := &serverConn{Conn: counting, features: featureChecksum}
+	data := bytes.Repeat([]byte("PONG"), 100)
+	compressed, _ := compress(data)
+	for _, c := range []struct {
+		data       []byte
+		compressed bool
+	}{{data, false}, {compressed, true}, {nil, false}} {
+		atomic.StoreInt32(&counting.writes, 0)
+		go s.sendResponse(conn, 0, c.data, c.compressed)
+		res, err := readResponse(client, conn.features)
+		assert.T(t, err == nil)
+		if c.data == nil {
+			assert.Equal(t, 0, len(res))
+		} else {
+			assert.Equal(t, data, res)
+		}
+		assert.Equal(t, int32(1), atomic.LoadInt32(&counting.writes))
+	}
+}
+
+func BenchmarkSendResponse(b *testing.B) {
+	s := &Server{}
+	c, closer := newDiscardConn()
+	defer closer()
+	conn := &serverConn{Conn: c}
+	data := []byte("PONG")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		s.sendResponse(conn, 0, data, false)
+	}
+}
+
+func TestMaxBatchBytes(t *testing.T) {
+	stats := newTestStatsRecorder()
+	l, addr := newTestServer(new(EchoHandler), func(s *Server) {
+		s.Stats = stats
+		s.MaxBatchBytes = 100
+	})
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	c.Retries = 0
+	big := []byte(strings.Repeat("a", 60))
+	_, err := c.SendRecvBatch([][]byte{big, big, big})
+	assert.T(t, err != nil)
+	assert.Equal(t, int64(1), stats.counter("pipeline.batch_too_large"))
+	assert.Equal(t, 0, c.pool.Len())
+	// batches under the limit are still served
+	responses, err := c.SendRecvBatch([][]byte{big, []byte("PING")})
+	assert.T(t, err == nil)
+	assert.Equal(t, [][]byte{big, []byte("PING")}, responses)
+}
+
+func TestPipelineReadFailure(t *testing.T) {
+	l, addr := newTestServer(new(EchoHandler))
+	defer l.Close()
+	conn, err := net.Dial("tcp", addr)
+	assert.T(t, err == nil)
+	defer conn.Close()
+	_, err = clientHandshake(conn, 0)
+	assert.T(t, err == nil)
+	// a pipeline of 3 whose second request has a corrupt length
+	binary.Write(conn, binary.BigEndian, int32(-3))
+	writeDataWithLength([]byte("PING"), conn)
+	binary.Write(conn, binary.BigEndian, int32(-5))
+	writeDataWithLength([]byte("PING"), conn)
+	// the server can't tell where the rest of the batch is, it hangs up
+	// rather than answer it
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReusePort(t *testing.T) {
+	l, err := NewServer("127.0.0.1:0", new(EchoHandler), WithReusePort(), WithBacklog(16))
+	assert.T(t, err == nil)
+	defer l.Close()
+	addr := l.Addr().String()
+	// without SO_REUSEPORT the port is taken
+	_, err = NewServer(addr, new(EchoHandler))
+	assert.T(t, err != nil)
+	l2, err := NewServer(addr, new(EchoHandler), WithReusePort())
+	assert.T(t, err == nil)
+	defer l2.Close()
+	go l.Start()
+	go l2.Start()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	resp, err := c.SendRecv([]byte("PING"))
+	assert.T(t, err == nil)
+	assert.Equal(t, []byte("PING"), resp)
+}
+
+func TestIsRunning(t *testing.T) {
+	l, err := NewServer("127.0.0.1:0", new(EchoHandler))
+	assert.T(t, err == nil)
+	assert.T(t, !l.IsRunning())
+	stopped := make(chan bool)
+	go func() {
+		l.Start()
+		stopped <- true
+	}()
+	for i := 0; i < 100 && !l.IsRunning(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.T(t, l.IsRunning())
+	l.Close()
+	assert.T(t, !l.IsRunning())
+	<-stopped
+	assert.T(t, !l.IsRunning())
+}
+
+func TestIsRunningClosedBeforeStart(t *testing.T) {
+	l, err := NewServer("127.0.0.1:0", new(EchoHandler))
+	assert.T(t, err == nil)
+	assert.Equal(t, nil, l.Close())
+	// returns straight away, without ever running
+	l.Start()
+	assert.Equal(t, false, l.IsRunning())
+	assert.Equal(t, false, l.IsAccepting())
+}
+
+func TestClientInterceptors(t *testing.T) {
+	l, addr := newTestServer(new(EchoHandler))
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	c.Use(func(req []byte, next func([]byte) ([]byte, error)) ([]byte, error) {
+		return next(append([]byte("token:"), req...))
+	})
+	var logged []string
+	c.Use(func(req []byte, next func([]byte) ([]byte, error)) ([]byte, error) {
+		res, err := next(req)
+		logged = append(logged, string(req)+" => "+string(res))
+		return res, err
+	})
+	for _, req := range []string{"PING", "PONG"} {
+		// the EchoHandler shows what the server received
+		resp, err := c.SendRecv([]byte(req))
+		assert.T(t, err == nil)
+		assert.Equal(t, "token:"+req, string(resp))
+	}
+	assert.Equal(t, []string{"token:PING => token:PING", "token:PONG => token:PONG"}, logged)
+}
+
+// CountingReaderHandler counts the lines of the request as it reads it, and
+// stops reading at a line that says "STOP"
+type CountingReaderHandler struct{}
+
+func (h *CountingReaderHandler) RespondReader(r io.Reader, size int, span *Span) (response []byte, err error) {
+	scanner := bufio.NewScanner(r)
+	lines := 0
+	for scanner.Scan() {
+		if scanner.Text() == "STOP" {
+			break
+		}
+		lines++
+	}
+	return []byte(fmt.Sprintf("%d/%d", lines, size)), scanner.Err()
+}
+
+func TestReaderHandler(t *testing.T) {
+	l, addr := newTestServer(ReaderHandler(new(CountingReaderHandler)))
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	req := strings.Repeat("a line of the request\n", 10000)
+	resp, err := c.SendRecv([]byte(req))
+	assert.T(t, err == nil)
+	assert.Equal(t, fmt.Sprintf("10000/%d", len(req)), string(resp))
+	// the unread rest of the request is skipped
+	resp, err = c.SendRecv([]byte("one\nSTOP\nnot read\n"))
+	assert.T(t, err == nil)
+	assert.Equal(t, "1/18", string(resp))
+	resp, err = c.SendRecv([]byte("one\ntwo\n"))
+	assert.T(t, err == nil)
+	assert.Equal(t, "2/8", string(resp))
+	// pipelined requests go through the Respond adapter
+	responses, err := c.SendRecvBatch([][]byte{[]byte("one\n"), []byte("one\ntwo\n")})
+	assert.T(t, err == nil)
+	assert.Equal(t, [][]byte{[]byte("1/4"), []byte("2/8")}, responses)
+}
+
+type ChunkReaderHandler struct{}
+
+func (h *ChunkReaderHandler) RespondReader(r io.Reader, size int, span *Span) (response []byte, err error) {
+	chunk := make([]byte, 32*1024)
+	total := 0
+	for {
+		n, err := r.Read(chunk)
+		total += n
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return []byte(fmt.Sprintf("%d", total)), nil
+}
+
+func TestReaderHandlerLargeRequest(t *testing.T) {
+	l, addr := newTestServer(ReaderHandler(new(ChunkReaderHandler)))
+	defer l.Close()
+	conn, err := net.Dial("tcp", addr)
+	assert.T(t, err == nil)
+	defer conn.Close()
+	_, err = clientHandshake(conn, 0)
+	assert.T(t, err == nil)
+	size := 64 * 1024 * 1024
+	chunk := make([]byte, 64*1024)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	// stream the request so the client doesn't hold it in memory either
+	binary.Write(conn, binary.BigEndian, int32(size))
+	for written := 0; written < size; written += len(chunk) {
+		_, err = conn.Write(chunk)
+		assert.T(t, err == nil)
+	}
+	res, err := readDataWithLength(conn)
+	assert.T(t, err == nil)
+	assert.Equal(t, fmt.Sprintf("%d", size), string(res))
+	runtime.ReadMemStats(&after)
+	// the handler was fed the request a chunk at a time, it was never
+	// buffered whole
+	assert.T(t, after.TotalAlloc-before.TotalAlloc < uint64(size/8))
+}
+
+type HugeHandler struct{}
+
+func (h *HugeHandler) Respond(req []byte, span *Span) (response []byte, err error) {
+	return make([]byte, 64*1024*1024), nil
+}
+
+func TestWriteTimeout(t *testing.T) {
+	l, addr := newTestServer(new(HugeHandler), func(s *Server) { s.WriteTimeout = 50 * time.Millisecond })
+	defer l.Close()
+	conn, err := net.Dial("tcp", addr)
+	assert.T(t, err == nil)
+	defer conn.Close()
+	_, err = clientHandshake(conn, 0)
+	assert.T(t, err == nil)
+	// ask for a response far bigger than the socket buffers and never read it
+	writeDataWithLength([]byte("PING"), conn)
+	for i := 0; i < 100 && l.NumConnections() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, l.NumConnections())
+}
+
+// GatedHandler echoes requests, holding "SLOW" ones until release is closed
+type GatedHandler struct {
+	release chan bool
+}
+
+func (h *GatedHandler) Respond(req []byte, span *Span) (response []byte, err error) {
+	if string(req) == "SLOW" {
+		<-h.release
+	}
+	return req, nil
+}
+
+func TestPipelineSlowSubRequest(t *testing.T) {
+	handler := &GatedHandler{release: make(chan bool)}
+	l, addr := newTestServer(handler)
+	defer l.Close()
+	conn, err := net.Dial("tcp", addr)
+	assert.T(t, err == nil)
+	defer conn.Close()
+	_, err = clientHandshake(conn, 0)
+	assert.T(t, err == nil)
+	binary.Write(conn, binary.BigEndian, int32(-3))
+	for _, req := range []string{"FAST1", "FAST2", "SLOW"} {
+		writeDataWithLength([]byte(req), conn)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var count int32
+	err = binary.Read(conn, binary.BigEndian, &count)
+	assert.T(t, err == nil)
+	assert.Equal(t, int32(-3), count)
+	// the fast responses arrive while the slow one is still being handled
+	for _, req := range []string{"FAST1", "FAST2"} {
+		res, err := readDataWithLength(conn)
+		assert.T(t, err == nil)
+		assert.Equal(t, req, string(res))
+	}
+	close(handler.release)
+	res, err := readDataWithLength(conn)
+	assert.T(t, err == nil)
+	assert.Equal(t, "SLOW", string(res))
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	handler := &GatedHandler{release: make(chan bool)}
+	l, addr := newTestServer(handler)
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 2, time.Second)
+	assert.T(t, c != nil)
+	c.MaxConcurrentRequests = 2
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := c.SendRecv([]byte("SLOW"))
+			errs <- err
+		}()
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&c.inflight) < 2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	started := time.Now()
+	_, err := c.SendRecv([]byte("PING"))
+	assert.Equal(t, ErrClientOverloaded, err)
+	_, err = c.SendRecvBatch([][]byte{[]byte("PING")})
+	assert.Equal(t, ErrClientOverloaded, err)
+	assert.T(t, time.Since(started) < 100*time.Millisecond)
+	close(handler.release)
+	assert.T(t, <-errs == nil)
+	assert.T(t, <-errs == nil)
+	_, err = c.SendRecv([]byte("PING"))
+	assert.T(t, err == nil)
+}
+
+func TestSpanIdFromMetadata(t *testing.T) {
+	handler := RequestHandlerFunc(func(req []byte, span *Span) ([]byte, error) {
+		return []byte(span.JSON()), nil
+	})
+	l, addr := newTestServer(handler, func(s *Server) {
+		s.UUIDGenerator = func() string { return "generated" }
+	})
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	res, err := c.SendRecvOpts([]byte("PING"), WithMetadata(SpanIdMetadataKey, "correlation-1"))
+	assert.T(t, err == nil)
+	var span map[string]string
+	json.Unmarshal(res, &span)
+	assert.Equal(t, "correlation-1", span["id"])
+	res, err = c.SendRecv([]byte("PING"))
+	assert.T(t, err == nil)
+	json.Unmarshal(res, &span)
+	assert.Equal(t, "generated", span["id"])
+}
+
+func TestUUIDGeneratorWithContext(t *testing.T) {
+	handler := RequestHandlerFunc(func(req []byte, span *Span) ([]byte, error) {
+		return []byte(span.JSON()), nil
+	})
+	l, addr := newTestServer(handler, func(s *Server) {
+		s.UUIDGeneratorWithContext = func(remoteAddr string, parent string) string {
+			if parent == "" {
+				return "root"
+			}
+			return parent + ".1"
+		}
+	})
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	res, err := c.SendRecvOpts([]byte("PING"), WithMetadata(ParentIdMetadataKey, "trace-1"))
+	assert.T(t, err == nil)
+	var span map[string]string
+	json.Unmarshal(res, &span)
+	assert.Equal(t, "trace-1.1", span["id"])
+	assert.Equal(t, "trace-1", span["parentid"])
+	res, err = c.SendRecv([]byte("PING"))
+	assert.T(t, err == nil)
+	json.Unmarshal(res, &span)
+	assert.Equal(t, "root", span["id"])
+}
+
+func TestHandlerClosesConnection(t *testing.T) {
+	handler := RequestHandlerFunc(func(req []byte, span *Span) ([]byte, error) {
+		if string(req) == "BYE" {
+			span.CloseConnection()
+		}
+		return req, nil
+	})
+	l, addr := newTestServer(handler)
+	defer l.Close()
+	conn, err := net.Dial("tcp", addr)
+	assert.T(t, err == nil)
+	defer conn.Close()
+	_, err = clientHandshake(conn, 0)
+	assert.T(t, err == nil)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for _, req := range []string{"PING", "BYE"} {
+		writeDataWithLength([]byte(req), conn)
+		res, err := readDataWithLength(conn)
+		assert.T(t, err == nil)
+		assert.Equal(t, req, string(res))
+	}
+	// the response was sent, then the connection closed
+	_, err = readDataWithLength(conn)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestClientErrors(t *testing.T) {
+	l, err := NewServer("127.0.0.1:0", &NamedHandler{name: "slow", sleep: 200 * time.Millisecond})
+	assert.T(t, err == nil)
+	go l.Start()
+	c, _ := NewClient([]string{l.Addr().String()}, 1, time.Second)
+	assert.T(t, c != nil)
+	_, err = c.SendRecvOpts([]byte("PING"), WithTimeout(20*time.Millisecond))
+	assert.T(t, errors.Is(err, ErrTimeout))
+	assert.T(t, errors.Is(err, ErrAllRetriesFailed) == false)
+	var netErr net.Error
+	assert.T(t, errors.As(err, &netErr))
+
+	// every attempt fails once the server is gone
+	l.Close()
+	_, err = c.SendRecv([]byte("PING"))
+	assert.T(t, errors.Is(err, ErrAllRetriesFailed))
+	assert.T(t, errors.Is(err, syscall.ECONNREFUSED))
+
+	el, addr := newTestServer(new(EchoHandler))
+	defer el.Close()
+	c, _ = NewClient([]string{addr}, 1, time.Second)
+	c.pool.MaxActive = 1
+	c.pool.MaxWait = 10 * time.Millisecond
+	conn, _ := c.pool.Take()
+	_, err = c.SendRecvRetries([]byte("PING"), 0)
+	assert.T(t, errors.Is(err, ErrPoolExhausted))
+	_, err = c.SendRecvRetries([]byte("PING"), 1)
+	assert.T(t, errors.Is(err, ErrAllRetriesFailed))
+	assert.T(t, errors.Is(err, ErrPoolExhausted))
+	c.pool.Return(conn)
+
+	_, err = readDataWithLength(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xfe}))
+	assert.T(t, errors.Is(err, ErrProtocol))
+	assert.T(t, errors.Is(ErrProtocolMismatch, ErrProtocol))
+}
+
+func TestPipelineCountMismatch(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.T(t, err == nil)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := serverHandshake(conn, 0); err != nil {
+					return
+				}
+				header, _, err := readHeader(conn)
+				if err != nil || header >= 0 {
+					return
+				}
+				for i := int32(0); i < -header; i++ {
+					readDataWithLength(conn)
+				}
+				// answer one less request than was sent
+				binary.Write(conn, binary.BigEndian, header+1)
+				writeDataWithLength([]byte("PONG"), conn)
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	c, _ := NewClient([]string{l.Addr().String()}, 1, time.Second)
+	assert.T(t, c != nil)
+	p := c.Pipeline()
+	p.Send([]byte("PING1"))
+	p.Send([]byte("PING2"))
+	responses, err := p.Flush()
+	assert.T(t, responses == nil)
+	assert.T(t, errors.Is(err, ErrPipelineCountMismatch))
+	assert.T(t, errors.Is(err, ErrProtocol))
+	// the desynced connection was closed rather than returned
+	assert.Equal(t, 0, c.pool.Len())
+	assert.Equal(t, 0, c.pool.active)
+}
+
+func TestPipelineDesync(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.T(t, err == nil)
+	defer l.Close()
+	// each pipeline is answered by the next func, which is given the digest
+	// the server would send and returns the digest and number of responses
+	// it sends instead
+	answers := make(chan func(pipelineDigest) (pipelineDigest, int32), 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := serverHandshake(conn, featurePipelineDigest); err != nil {
+					return
+				}
+				header, info, err := readHeader(conn)
+				if err != nil || header >= 0 || info.digest == nil {
+					return
+				}
+				for i := int32(0); i < -header; i++ {
+					readDataWithLength(conn)
+				}
+				digest, count := (<-answers)(pipelineDigest{sequence: info.digest.sequence, count: -header})
+				conn.Write(digestFrame(digest))
+				binary.Write(conn, binary.BigEndian, -count)
+				for i := int32(0); i < count; i++ {
+					writeDataWithLength([]byte("PONG"), conn)
+				}
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	c, _ := NewClient([]string{l.Addr().String()}, 1, time.Second)
+	assert.T(t, c != nil)
+	reqs := [][]byte{[]byte("PING1"), []byte("PING2")}
+
+	// the responses to an earlier pipeline were left on the connection
+	answers <- func(digest pipelineDigest) (pipelineDigest, int32) {
+		digest.sequence--
+		return digest, digest.count
+	}
+	_, err = c.SendRecvBatch(reqs)
+	assert.T(t, errors.Is(err, ErrPipelineDesync))
+	assert.T(t, errors.Is(err, ErrProtocol))
+	assert.T(t, errors.Is(err, ErrPipelineCountMismatch) == false)
+	// the connection was closed rather than returned
+	assert.Equal(t, 0, c.pool.active)
+
+	// the pipeline's header was corrupted on the way
+	answers <- func(digest pipelineDigest) (pipelineDigest, int32) {
+		digest.count = 3
+		return digest, 3
+	}
+	_, err = c.SendRecvBatch(reqs)
+	assert.T(t, errors.Is(err, ErrPipelineDesync))
+	assert.T(t, errors.Is(err, ErrPipelineCountMismatch) == false)
+	assert.Equal(t, 0, c.pool.active)
+
+	// the server read the pipeline right but answers it wrong
+	answers <- func(digest pipelineDigest) (pipelineDigest, int32) {
+		return digest, digest.count - 1
+	}
+	_, err = c.SendRecvBatch(reqs)
+	assert.T(t, errors.Is(err, ErrPipelineCountMismatch))
+	assert.T(t, errors.Is(err, ErrPipelineDesync) == false)
+	assert.Equal(t, 0, c.pool.active)
+
+	answers <- func(digest pipelineDigest) (pipelineDigest, int32) {
+		return digest, digest.count
+	}
+	responses, err := c.SendRecvBatch(reqs)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, [][]byte{[]byte("PONG"), []byte("PONG")}, responses)
+}
+
+func TestPipelineGoroutineStats(t *testing.T) {
+	l, err := NewServer("127.0.0.1:0", &NamedHandler{name: "slow", sleep: 10 * time.Millisecond})
+	assert.T(t, err == nil)
+	defer l.Close()
+	stats := newTestStatsRecorder()
+	l.Stats = stats
+	go l.Start()
+	c, _ := NewClient([]string{l.Addr().String()}, 1, time.Second)
+	assert.T(t, c != nil)
+	p := c.Pipeline()
+	for i := 0; i < 5; i++ {
+		p.Send([]byte("PING"))
+	}
+	responses, err := p.Flush()
+	assert.T(t, err == nil)
+	assert.Equal(t, 5, len(responses))
+	assert.Equal(t, []int64{5}, stats.timer("pipeline.goroutines"))
+	// the handlers ran concurrently, but their time adds up
+	handlerTime := stats.timer("pipeline.handler_time")
+	assert.Equal(t, 1, len(handlerTime))
+	assert.T(t, handlerTime[0] >= 50)
+}
+
+type PagingHandler struct{}
+
+func (h *PagingHandler) RespondMulti(req []byte, span *Span) (frames [][]byte, err error) {
+	for i := 1; i <= 3; i++ {
+		frames = append(frames, []byte(fmt.Sprintf("%s page %d", req, i)))
+	}
+	return frames, nil
+}
+
+func TestMultiHandler(t *testing.T) {
+	l, addr := newTestServer(MultiHandler(new(PagingHandler)))
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	frames, err := c.SendRecvMulti([]byte("cats"))
+	assert.T(t, err == nil)
+	assert.Equal(t, [][]byte{[]byte("cats page 1"), []byte("cats page 2"), []byte("cats page 3")}, frames)
+	// SendRecv gets the frames joined together
+	res, err := c.SendRecv([]byte("dogs"))
+	assert.T(t, err == nil)
+	assert.Equal(t, "dogs page 1dogs page 2dogs page 3", string(res))
+	// and so do pipelined requests
+	p := c.Pipeline()
+	p.Send([]byte("owls"))
+	responses, err := p.Flush()
+	assert.T(t, err == nil)
+	assert.Equal(t, "owls page 1owls page 2owls page 3", string(responses[0]))
+
+	// other handlers answer with a single frame
+	el, eaddr := newTestServer(new(EchoHandler))
+	defer el.Close()
+	c, _ = NewClient([]string{eaddr}, 1, time.Second)
+	frames, err = c.SendRecvMulti([]byte("PING"))
+	assert.T(t, err == nil)
+	assert.Equal(t, [][]byte{[]byte("PING")}, frames)
+}
+
+// FindingHandler streams a frame per match, failing requests for "none"
+type FindingHandler struct{}
+
+func (h *FindingHandler) RespondStream(req []byte, send func([]byte) error, span *Span) error {
+	if string(req) == "none" {
+		return NewStatusError(CodeNotFound, "no matches")
+	}
+	for i := 1; i <= 3; i++ {
+		err := send([]byte(fmt.Sprintf("%s %d", req, i)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestStreamHandler(t *testing.T) {
+	l, addr := newTestServer(StreamHandler(new(FindingHandler)))
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	var frames []string
+	err := c.SendRecvStream([]byte("cats"), func(frame []byte) error {
+		frames = append(frames, string(frame))
+		return nil
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"cats 1", "cats 2", "cats 3"}, frames)
+
+	// a failed stream ends with the error
+	err = c.SendRecvStream([]byte("none"), func(frame []byte) error {
+		return nil
+	})
+	var remoteErr *RemoteError
+	assert.T(t, errors.As(err, &remoteErr))
+	assert.Equal(t, CodeNotFound, remoteErr.Code)
+	// which leaves the connection good for the next request
+	assert.Equal(t, 1, c.pool.Len())
+	res, err := c.SendRecv([]byte("dogs"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "dogs 1dogs 2dogs 3", string(res))
+	multi, err := c.SendRecvMulti([]byte("owls"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, [][]byte{[]byte("owls 1"), []byte("owls 2"), []byte("owls 3")}, multi)
+	// an error from fn abandons the stream
+	stop := errors.New("stop")
+	err = c.SendRecvStream([]byte("cats"), func(frame []byte) error {
+		return stop
+	})
+	assert.Equal(t, stop, err)
+	res, err = c.SendRecv([]byte("dogs"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "dogs 1dogs 2dogs 3", string(res))
+}
+
+// corruptingConn flips a bit in the data of the next read (or write) frame
+// once corruptRead (or corruptWrite) is set. Headers and checksums are read
+// and written 4 bytes at a time so they are left alone.
+type corruptingConn struct {
+	net.Conn
+	corruptRead  *int32
+	corruptWrite *int32
+}
+
+func (c *corruptingConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	if n > 4 && atomic.CompareAndSwapInt32(c.corruptRead, 1, 0) {
+		b[n-1] ^= 1
+	}
+	return n, err
+}
+
+func (c *corruptingConn) Write(b []byte) (n int, err error) {
+	if len(b) > 4 && atomic.CompareAndSwapInt32(c.corruptWrite, 1, 0) {
+		b = append([]byte(nil), b...)
+		b[len(b)-1] ^= 1
+	}
+	return c.Conn.Write(b)
+}
+
+func TestChecksum(t *testing.T) {
+	l, err := NewServer("127.0.0.1:0", new(EchoHandler))
+	assert.T(t, err == nil)
+	defer l.Close()
+	l.Checksum = true
+	go l.Start()
+	var corruptRead, corruptWrite int32
+	pool, err := NewConnectionPool([]string{l.Addr().String()}, 0, time.Second)
+	assert.T(t, err == nil)
+	pool.Checksum = true
+	pool.Dialer = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		conn, err := net.DialTimeout(network, address, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return &corruptingConn{Conn: conn, corruptRead: &corruptRead, corruptWrite: &corruptWrite}, nil
+	}
+	c := NewClientWithPool(pool)
+	stats := newTestStatsRecorder()
+	c.Stats = stats
+	req := []byte("HELLO WORLD")
+	res, info, err := c.SendRecvWithInfo(req)
+	assert.T(t, err == nil)
+	assert.Equal(t, req, res)
+	assert.Equal(t, 0, info.Retries)
+	assert.T(t, pool.pools[l.Addr().String()][0].features&featureChecksum != 0)
+
+	// a corrupted response is caught by the client, which retries
+	atomic.StoreInt32(&corruptRead, 1)
+	res, info, err = c.SendRecvWithInfo(req)
+	assert.T(t, err == nil)
+	assert.Equal(t, req, res)
+	assert.Equal(t, 1, info.Retries)
+	assert.Equal(t, int64(1), stats.counter("client.retry.checksum_mismatch"))
+
+	// a corrupted request is caught by the server, which hangs up
+	atomic.StoreInt32(&corruptWrite, 1)
+	res, info, err = c.SendRecvWithInfo(req)
+	assert.T(t, err == nil)
+	assert.Equal(t, req, res)
+	assert.Equal(t, 1, info.Retries)
+
+	atomic.StoreInt32(&corruptRead, 1)
+	_, err = c.SendRecvRetries(req, 0)
+	assert.T(t, errors.Is(err, ErrChecksumMismatch))
+}
+
+func TestSpanNegotiatedFeatures(t *testing.T) {
+	negotiated := make(chan bool, 1)
+	handler := RequestHandlerFunc(func(req []byte, span *Span) ([]byte, error) {
+		negotiated <- span.CompressionNegotiated()
+		return req, nil
+	})
+	l, err := NewServer("127.0.0.1:0", handler)
+	assert.T(t, err == nil)
+	defer l.Close()
+	l.Compression = true
+	go l.Start()
+	c, _ := NewClient([]string{l.Addr().String()}, 1, time.Second)
+	assert.T(t, c != nil)
+	_, err = c.SendRecv([]byte("PING"))
+	assert.T(t, err == nil)
+	assert.Equal(t, true, <-negotiated)
+
+	// a client that doesn't ask for compression doesn't get it
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assert.T(t, err == nil)
+	defer conn.Close()
+	_, err = clientHandshake(conn, 0)
+	assert.T(t, err == nil)
+	writeDataWithLength([]byte("PING"), conn)
+	_, err = readDataWithLength(conn)
+	assert.T(t, err == nil)
+	assert.Equal(t, false, <-negotiated)
+}
+
+func TestPipelineRetriesBatch(t *testing.T) {
+	l, addr, received := newFlakyPipelineServer(1)
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	stats := newTestStatsRecorder()
+	c.Stats = stats
+	p := c.Pipeline()
+	reqs := [][]byte{[]byte("PING1"), []byte("PING2"), []byte("PING3")}
+	for _, req := range reqs {
+		p.Send(req)
+	}
+	responses, err := p.Flush()
+	assert.T(t, err == nil)
+	assert.Equal(t, reqs, responses)
+	// the whole batch was sent again after the connection was dropped
+	assert.Equal(t, int32(6), atomic.LoadInt32(received))
+	assert.Equal(t, int64(1), stats.counter("client.retry"))
+
+	l2, addr2, _ := newFlakyPipelineServer(1)
+	defer l2.Close()
+	c2, _ := NewClient([]string{addr2}, 1, time.Second)
+	c2.Retries = 0
+	p = c2.Pipeline()
+	for _, req := range reqs {
+		p.Send(req)
+	}
+	responses, err = p.Flush()
+	// the response read before the connection dropped is kept
+	assert.Equal(t, reqs[:1], responses)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestStringHandler(t *testing.T) {
+	handler := StringHandler(func(req string, span *Span) (string, error) {
+		if req == "" {
+			return "", errors.New("empty request")
+		}
+		return strings.ToUpper(req), nil
+	})
+	l, addr := newTestServer(handler)
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	res, err := c.SendRecvString("ping")
+	assert.T(t, err == nil)
+	assert.Equal(t, "PING", res)
+	res, err = c.SendRecvString("héllo wörld")
+	assert.T(t, err == nil)
+	assert.Equal(t, "HÉLLO WÖRLD", res)
+	_, err = handler.Respond([]byte(""), NewSpan(""))
+	assert.Equal(t, "empty request", err.Error())
+}
+
+func TestAfterResponse(t *testing.T) {
+	release := make(chan bool)
+	finished := make(chan string, 2)
+	handler := RequestHandlerFunc(func(req []byte, span *Span) ([]byte, error) {
+		span.AfterResponse(func() {
+			<-release
+			finished <- string(req)
+		})
+		return []byte("ACK"), nil
+	})
+	l, addr := newTestServer(handler)
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	// the ack comes back while the work is still blocked
+	res, err := c.SendRecv([]byte("job1"))
+	assert.T(t, err == nil)
+	assert.Equal(t, "ACK", string(res))
+	// and the connection is free for the next request
+	res, err = c.SendRecv([]byte("job2"))
+	assert.T(t, err == nil)
+	assert.Equal(t, "ACK", string(res))
+	select {
+	case job := <-finished:
+		t.Fatalf("%s finished before it was released", job)
+	default:
+	}
+	close(release)
+	jobs := []string{<-finished, <-finished}
+	sort.Strings(jobs)
+	assert.Equal(t, []string{"job1", "job2"}, jobs)
+}
+
+func TestSpanFilter(t *testing.T) {
+	l, err := NewServer("127.0.0.1:0", StringHandler(func(req string, span *Span) (string, error) {
+		span.Increment("requests")
+		return req, nil
+	}))
+	assert.T(t, err == nil)
+	sink := &capturingSpanSink{spans: make(chan *Span, 10)}
+	l.SpanSink = sink
+	l.SpanFilter = func(req []byte) bool { return string(req) != "PING" }
+	go l.Start()
+	defer l.Close()
+	c, _ := NewClient([]string{l.Addr().String()}, 1, time.Second)
+	assert.T(t, c != nil)
+	for _, req := range []string{"PING", "GET", "PING"} {
+		res, err := c.SendRecvString(req)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, req, res)
+	}
+	assert.Equal(t, 1, len(sink.spans))
+	span := <-sink.spans
+	assert.Equal(t, int64(1), span.Counters["requests"])
+	assert.Equal(t, 1, l.LatencyStats().Count)
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	l, err := NewServer("127.0.0.1:0", StringHandler(func(req string, span *Span) (string, error) {
+		if req == "SLOW" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		return req, nil
+	}))
+	assert.T(t, err == nil)
+	stats := newTestStatsRecorder()
+	l.Stats = stats
+	l.HandlerTimeout = 50 * time.Millisecond
+	go l.Start()
+	defer l.Close()
+	c, _ := NewClient([]string{l.Addr().String()}, 1, time.Second)
+	assert.T(t, c != nil)
+	conn := c.pool.pools[l.Addr().String()][0]
+
+	_, err = c.SendRecvString("SLOW")
+	assert.T(t, errors.Is(err, ErrRemoteTimeout))
+	var remoteErr *RemoteError
+	assert.T(t, errors.As(err, &remoteErr))
+	assert.Equal(t, int64(1), stats.counter("handler.timeout"))
+
+	// the connection is still good for the next request
+	res, err := c.SendRecvString("FAST")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "FAST", res)
+	assert.Equal(t, 1, c.pool.Len())
+	assert.Equal(t, conn, c.pool.pools[l.Addr().String()][0])
+}
+
+func TestHandlerTimeoutWaitsForHandler(t *testing.T) {
+	returned := make(chan bool)
+	l, err := NewServer("127.0.0.1:0", StringHandler(func(req string, span *Span) (string, error) {
+		if req == "SLOW" {
+			time.Sleep(100 * time.Millisecond)
+			// carries on with the span after it has timed out
+			for i := 0; i < 100; i++ {
+				span.Increment("writes")
+				span.Attr("last", fmt.Sprintf("%d", i))
+				span.Start("write")
+				span.Finish("write")
+			}
+			close(returned)
+			return req, nil
+		}
+		select {
+		case <-returned:
+			return req, nil
+		default:
+			return "EARLY", nil
+		}
+	}))
+	assert.T(t, err == nil)
+	sink := &capturingSpanSink{spans: make(chan *Span, 2)}
+	l.SpanSink = sink
+	l.HandlerTimeout = 20 * time.Millisecond
+	l.MaxInflight = 1
+	go l.Start()
+	defer l.Close()
+	c, _ := NewClient([]string{l.Addr().String()}, 1, time.Second)
+	assert.T(t, c != nil)
+
+	_, err = c.SendRecvString("SLOW")
+	assert.T(t, errors.Is(err, ErrRemoteTimeout))
+	// the timed out handler holds on to its slot until it returns
+	res, err := c.SendRecvString("FAST")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "FAST", res)
+	// and its span is only recorded then, with everything it wrote
+	span := <-sink.spans
+	assert.Equal(t, "true", span.Attrs["timeout"])
+	assert.Equal(t, int64(100), span.Counters["writes"])
+	assert.Equal(t, "99", span.Attrs["last"])
+}
+
+func TestServerConnReaderPool(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	conn := &serverConn{Conn: server}
+	conn.raw.conn = server
+	go client.Write([]byte("PING"))
+	assert.Equal(t, nil, conn.waitForRequest())
+	assert.T(t, conn.reader != nil)
+	req := make([]byte, 4)
+	_, err := io.ReadFull(conn, req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "PING", string(req))
+	// nothing else was sent, the buffer goes back to the pool
+	conn.releaseReader()
+	assert.T(t, conn.reader == nil)
+
+	go client.Write([]byte("PONGPANG"))
+	assert.Equal(t, nil, conn.waitForRequest())
+	// read the first byte on its own and the rest through the buffer
+	_, err = io.ReadFull(conn, req[:1])
+	assert.Equal(t, nil, err)
+	_, err = io.ReadFull(conn, req[1:])
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "PONG", string(req))
+	// the start of the next request is buffered, so the buffer is kept
+	conn.releaseReader()
+	assert.T(t, conn.reader != nil)
+	assert.Equal(t, nil, conn.waitForRequest())
+	_, err = io.ReadFull(conn, req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "PANG", string(req))
+}
+
+// BenchmarkIdleConnectionMemory reports the heap held by each idle
+// connection after it has served a request.
+func BenchmarkIdleConnectionMemory(b *testing.B) {
+	c := TestClient(new(EchoHandler))
+	defer c.Close()
+	conns := make([]*PooledConn, b.N)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+	for i := range conns {
+		conn, err := c.pool.Take()
+		if err != nil {
+			b.Fatal(err)
+		}
+		c.sendRequest(conn, []byte("PING"), c.newRequestOptions(nil))
+		_, err = c.readResponse(conn)
+		if err != nil {
+			b.Fatal(err)
+		}
+		conns[i] = conn
+	}
+	b.StopTimer()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(int64(after.HeapInuse)-int64(before.HeapInuse))/float64(b.N), "heap-bytes/conn")
+	for _, conn := range conns {
+		c.pool.Return(conn)
+	}
+}
+
+func TestProtoServerStats(t *testing.T) {
+	requestFunc := ProtoInitializerFunc(func() proto.Message {
+		return new(Request)
+	})
+	responseFunc := ProtoInitializerFunc(func() proto.Message {
+		return new(Response)
+	})
+	handlerFunc := ProtoHandlerFunc(func(req proto.Message, res proto.Message, span *Span) {
+		res.(*Response).Status = proto.String("OK")
+	})
+	l, err := NewProtoServer("127.0.0.1:0", requestFunc, responseFunc, handlerFunc)
+	assert.T(t, err == nil)
+	stats := newTestStatsRecorder()
+	l.Stats = stats
+	go l.Start()
+	defer l.Close()
+	c, _ := NewClient([]string{l.Addr().String()}, 1, time.Second)
+	assert.T(t, c != nil)
+	req, _ := proto.Marshal(&Request{Command: proto.String("GET"), Args: proto.String("/")})
+	_, err = c.SendRecv(req)
+	assert.Equal(t, nil, err)
+	for _, timer := range []string{"pb.parse", "pb.response", "pb.encode"} {
+		assert.Equal(t, 1, len(stats.timer(timer)))
+	}
+}
+
+func TestProtoServerReusesMessages(t *testing.T) {
+	var allocated int64
+	requestFunc := ProtoInitializerFunc(func() proto.Message {
+		atomic.AddInt64(&allocated, 1)
+		return new(Request)
+	})
+	responseFunc := ProtoInitializerFunc(func() proto.Message {
+		atomic.AddInt64(&allocated, 1)
+		return new(Response)
+	})
+	handlerFunc := ProtoHandlerFunc(func(req proto.Message, res proto.Message, span *Span) {
+		res.(*Response).Status = proto.String("OK")
+	})
+	handler := NewProtoHandler(requestFunc, responseFunc, handlerFunc)
+	req, _ := proto.Marshal(&Request{Command: proto.String("GET"), Args: proto.String("/")})
+	requests := 100
+	for i := 0; i < requests; i++ {
+		_, err := handler.Respond(req, NewSpan("test"))
+		assert.Equal(t, nil, err)
+	}
+	// a sync.Pool may drop what's put in it (the race detector makes it drop
+	// some on purpose), but most requests should reuse the messages
+	assert.T(t, atomic.LoadInt64(&allocated) < int64(requests))
+}
+
+func TestProtoServerRequestContext(t *testing.T) {
+	requestFunc := ProtoInitializerFunc(func() proto.Message {
+		return new(Request)
+	})
+	responseFunc := ProtoInitializerFunc(func() proto.Message {
+		return new(Response)
+	})
+	handlerFunc := ProtoHandlerFunc(func(req proto.Message, res proto.Message, span *Span) {
+		response := res.(*Response)
+		response.Status = proto.String(span.Metadata["user"])
+		response.Message = proto.String(span.RemoteAddr)
+	})
+	l, err := NewProtoServer("127.0.0.1:0", requestFunc, responseFunc, handlerFunc)
+	assert.T(t, err == nil)
+	go l.Start()
+	defer l.Close()
+	c, _ := NewClient([]string{l.Addr().String()}, 1, time.Second)
+	assert.T(t, c != nil)
+	localAddr := c.pool.pools[l.Addr().String()][0].LocalAddr().String()
+	req, _ := proto.Marshal(&Request{Command: proto.String("GET")})
+	resp, err := c.SendRecvOpts(req, WithMetadata("user", "bob"))
+	assert.Equal(t, nil, err)
+	response := new(Response)
+	assert.Equal(t, nil, proto.Unmarshal(resp, response))
+	assert.Equal(t, "bob", response.GetStatus())
+	assert.Equal(t, localAddr, response.GetMessage())
+}
+
+func TestProtoServerValidator(t *testing.T) {
+	requestFunc := ProtoInitializerFunc(func() proto.Message {
+		return new(Request)
+	})
+	responseFunc := ProtoInitializerFunc(func() proto.Message {
+		return new(Response)
+	})
+	var handled int64
+	handlerFunc := ProtoHandlerFunc(func(req proto.Message, res proto.Message, span *Span) {
+		atomic.AddInt64(&handled, 1)
+		res.(*Response).Status = proto.String("OK")
+	})
+	l, err := NewProtoServer("127.0.0.1:0", requestFunc, responseFunc, handlerFunc)
+	assert.T(t, err == nil)
+	ps := l.ProtoServer()
+	assert.T(t, ps != nil)
+	ps.Validator = func(req proto.Message) error {
+		if req.(*Request).GetCommand() == "" {
+			return errors.New("missing command")
+		}
+		return nil
+	}
+	go l.Start()
+	defer l.Close()
+	c, _ := NewClient([]string{l.Addr().String()}, 1, time.Second)
+	assert.T(t, c != nil)
+	c.Retries = 0
+
+	req, _ := proto.Marshal(&Request{Command: proto.String("GET")})
+	_, err = c.SendRecv(req)
+	assert.Equal(t, nil, err)
+	req, _ = proto.Marshal(&Request{Args: proto.String("/")})
+	_, err = c.SendRecv(req)
+	assert.T(t, err != nil)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&handled))
+
+	echo := newServer(new(EchoHandler))
+	assert.T(t, echo.ProtoServer() == nil)
+}
+
+func TestProtoHandlerContextDeadline(t *testing.T) {
+	requestFunc := ProtoInitializerFunc(func() proto.Message {
+		return new(Request)
+	})
+	responseFunc := ProtoInitializerFunc(func() proto.Message {
+		return new(Response)
+	})
+	handlerFunc := ProtoHandlerFuncCtx(func(ctx context.Context, req proto.Message, res proto.Message, span *Span) error {
+		deadline, ok := ctx.Deadline()
+		if ok == false {
+			return errors.New("no deadline")
+		}
+		res.(*Response).Message = proto.String(time.Until(deadline).String())
+		return nil
+	})
+	l, err := NewProtoServerCtx("127.0.0.1:0", requestFunc, responseFunc, handlerFunc)
+	assert.T(t, err == nil)
+	l.HandlerTimeout = 2 * time.Second
+	go l.Start()
+	defer l.Close()
+	c, _ := NewClient([]string{l.Addr().String()}, 1, time.Second)
+	assert.T(t, c != nil)
+	req, _ := proto.Marshal(&Request{Command: proto.String("GET")})
+	remaining := func(opts ...Option) time.Duration {
+		resp, err := c.SendRecvOpts(req, opts...)
+		assert.Equal(t, nil, err)
+		response := new(Response)
+		assert.Equal(t, nil, proto.Unmarshal(resp, response))
+		d, err := time.ParseDuration(response.GetMessage())
+		assert.Equal(t, nil, err)
+		return d
+	}
+	// the server's HandlerTimeout
+	d := remaining()
+	assert.T(t, d > time.Second && d <= 2*time.Second)
+	// the client's timeout when it's shorter
+	d = remaining(WithMetadata(TimeoutMetadataKey, "100ms"))
+	assert.T(t, d > 0 && d <= 100*time.Millisecond)
+}
+
+func TestProtoServerCompressedRequest(t *testing.T) {
+	requestFunc := ProtoInitializerFunc(func() proto.Message {
+		return new(Request)
+	})
+	responseFunc := ProtoInitializerFunc(func() proto.Message {
+		return new(Response)
+	})
+	handlerFunc := ProtoHandlerFunc(func(req proto.Message, res proto.Message, span *Span) {
+		r := req.(*Request)
+		res.(*Response).Message = proto.String(fmt.Sprintf("%s %d", r.GetCommand(), len(r.GetArgs())))
+	})
+	l, err := NewProtoServer("127.0.0.1:0", requestFunc, responseFunc, handlerFunc)
+	assert.T(t, err == nil)
+	stats := newTestStatsRecorder()
+	l.Stats = stats
+	l.Compression = true
+	go l.Start()
+	defer l.Close()
+	c, _ := NewClient([]string{l.Addr().String()}, 1, time.Second)
+	assert.T(t, c != nil)
+	req, _ := proto.Marshal(&Request{Command: proto.String("PUT"), Args: proto.String(strings.Repeat("tcpez ", 200))})
+	resp, err := c.SendRecvOpts(req, WithCompression(CodecGzip))
+	assert.Equal(t, nil, err)
+	response := new(Response)
+	assert.Equal(t, nil, proto.Unmarshal(resp, response))
+	assert.Equal(t, "PUT 1200", response.GetMessage())
+	assert.Equal(t, int64(1), stats.counter("request.compressed"))
+}
+
+func TestReaderHandlerCompressedRequest(t *testing.T) {
+	l, err := NewServer("127.0.0.1:0", ReaderHandler(new(CountingReaderHandler)))
+	assert.T(t, err == nil)
+	l.Compression = true
+	l.Checksum = true
+	go l.Start()
+	defer l.Close()
+	pool, _ := NewConnectionPool([]string{l.Addr().String()}, 0, time.Second)
+	pool.Checksum = true
+	c := NewClientWithPool(pool)
+	req := strings.Repeat("a line of the request\n", 1000)
+	resp, err := c.SendRecvOpts([]byte(req), WithCompression(CodecGzip))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, fmt.Sprintf("1000/%d", len(req)), string(resp))
+	// the connection is still in step for the next request
+	resp, err = c.SendRecv([]byte("one\ntwo\n"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "2/8", string(resp))
+}
+
+func TestRequestCodecs(t *testing.T) {
+	l, err := NewServer("127.0.0.1:0", new(EchoHandler))
+	assert.T(t, err == nil)
+	stats := newTestStatsRecorder()
+	l.Stats = stats
+	l.Compression = true
+	go l.Start()
+	defer l.Close()
+	pool, _ := NewConnectionPool([]string{l.Addr().String()}, 1, time.Second)
+	pool.Compression = CodecGzip
+	c := NewClientWithPool(pool)
+	req := []byte(strings.Repeat("tcpez ", 200))
+	// both requests go over the one connection, each with its own codec
+	resp, err := c.SendRecvOpts(req, WithCompression(CodecFlate))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, req, resp)
+	resp, err = c.SendRecvOpts(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, req, resp)
+	resp, err = c.SendRecvOpts(req, WithCompression(CodecNone))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, req, resp)
+	assert.Equal(t, 1, l.NumConnections())
+	assert.Equal(t, int64(2), stats.counter("request.compressed"))
+	assert.Equal(t, int64(1), stats.counter("request.compressed.flate"))
+	assert.Equal(t, int64(1), stats.counter("request.compressed.gzip"))
+}
+
+func TestMaxDecompressedBytes(t *testing.T) {
+	l, err := NewServer("127.0.0.1:0", new(EchoHandler))
+	assert.T(t, err == nil)
+	stats := newTestStatsRecorder()
+	l.Stats = stats
+	l.Compression = true
+	l.MaxDecompressedBytes = 1024
+	go l.Start()
+	defer l.Close()
+	pool, _ := NewConnectionPool([]string{l.Addr().String()}, 1, time.Second)
+	c := NewClientWithPool(pool)
+	c.Retries = 0
+	// compresses to a small fraction of the limit
+	oversized := []byte(strings.Repeat("tcpez ", 1000))
+	for _, codec := range []Codec{CodecGzip, CodecFlate} {
+		_, err = c.SendRecvOpts(oversized, WithCompression(codec))
+		var remoteErr *RemoteError
+		assert.T(t, errors.As(err, &remoteErr))
+		assert.Equal(t, CodeResourceExhausted, remoteErr.Code)
+		// the connection is still good for the next request
+		req := []byte(strings.Repeat("tcpez ", 100))
+		resp, err := c.SendRecvOpts(req, WithCompression(codec))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, req, resp)
+	}
+	assert.Equal(t, 1, l.NumConnections())
+	assert.Equal(t, int64(2), stats.counter("request.decompressed_too_large"))
+}
+
+func BenchmarkProtoServerPooling(b *testing.B) {
+	requestFunc := ProtoInitializerFunc(func() proto.Message {
+		return new(Request)
+	})
+	responseFunc := ProtoInitializerFunc(func() proto.Message {
+		return new(Response)
+	})
+	handlerFunc := ProtoHandlerFunc(func(req proto.Message, res proto.Message, span *Span) {
+		response := res.(*Response)
+		response.Status = proto.String("OK")
+		response.Message = proto.String(req.(*Request).GetArgs())
+	})
+	req, _ := proto.Marshal(&Request{Command: proto.String("GET"), Args: proto.String("/users/1")})
+	for _, unpooled := range []bool{false, true} {
+		name := "pooled"
+		if unpooled == true {
+			name = "unpooled"
+		}
+		b.Run(name, func(b *testing.B) {
+			handler := NewProtoHandler(requestFunc, responseFunc, handlerFunc)
+			handler.unpooled = unpooled
+			span := NewSpan("bench")
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := handler.Respond(req, span)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestNewClientFromConn(t *testing.T) {
+	client, server := net.Pipe()
+	s := newServer(new(EchoHandler))
+	go s.handle(server, 1)
+	c := NewClientFromConn(client)
+	defer c.Close()
+
+	res, err := c.SendRecv([]byte("PING"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "PING", string(res))
+	pipe := c.Pipeline()
+	pipe.Send([]byte("ONE"))
+	pipe.Send([]byte("TWO"))
+	responses, err := pipe.Flush()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, [][]byte{[]byte("ONE"), []byte("TWO")}, responses)
+
+	// once the connection is gone there's no dialing another
+	server.Close()
+	_, err = c.SendRecv([]byte("PING"))
+	assert.T(t, err != nil)
+	_, err = c.SendRecv([]byte("PING"))
+	assert.T(t, errors.Is(err, ErrConnClosed))
+}
+
+func TestPipelinePartialResponses(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		if _, err := serverHandshake(server, 0); err != nil {
+			return
+		}
+		header, _, err := readHeader(server)
+		if err != nil || header >= 0 {
+			return
+		}
+		for i := int32(0); i < -header; i++ {
+			readDataWithLength(server)
+		}
+		// answer two of the three requests, then drop the connection
+		binary.Write(server, binary.BigEndian, header)
+		writeDataWithLength([]byte("ONE"), server)
+		writeDataWithLength([]byte("TWO"), server)
+	}()
+	c := NewClientFromConn(client)
+	defer c.Close()
+	p := c.Pipeline()
+	p.Send([]byte("ONE"))
+	p.Send([]byte("TWO"))
+	p.Send([]byte("THREE"))
+	responses, err := p.Flush()
+	assert.T(t, err != nil)
+	assert.Equal(t, [][]byte{[]byte("ONE"), []byte("TWO")}, responses)
+}
+
+func TestPipelineTruncatedResponse(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		if _, err := serverHandshake(server, 0); err != nil {
+			return
+		}
+		header, _, err := readHeader(server)
+		if err != nil || header >= 0 {
+			return
+		}
+		for i := int32(0); i < -header; i++ {
+			readDataWithLength(server)
+		}
+		// the second response is cut off partway through its data
+		binary.Write(server, binary.BigEndian, header)
+		writeDataWithLength([]byte("ONE"), server)
+		binary.Write(server, binary.BigEndian, int32(10))
+		server.Write([]byte("TW"))
+	}()
+	c := NewClientFromConn(client)
+	defer c.Close()
+	p := c.Pipeline()
+	for i := 0; i < 5; i++ {
+		p.Send([]byte("PING"))
+	}
+	started := time.Now()
+	responses, err := p.Flush()
+	// reading stops at the truncated response rather than carrying on
+	// through the ones that never came
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, [][]byte{[]byte("ONE")}, responses)
+	assert.T(t, time.Since(started) < time.Second)
+	assert.Equal(t, 0, c.pool.active)
+}
+
+func TestServerStopAccepting(t *testing.T) {
+	l, addr := newTestServer(new(EchoHandler))
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	res, err := c.SendRecv([]byte("PING"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "PING", string(res))
+	assert.Equal(t, true, l.IsAccepting())
+
+	assert.Equal(t, nil, l.StopAccepting())
+	assert.Equal(t, false, l.IsAccepting())
+	// it's still running, it's draining the connections it has
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, true, l.IsRunning())
+	// new connections are refused
+	_, err = net.DialTimeout("tcp", addr, time.Second)
+	assert.T(t, err != nil)
+	// while the existing one is still served
+	for i := 0; i < 3; i++ {
+		res, err = c.SendRecv([]byte("PING"))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "PING", string(res))
+	}
+	assert.Equal(t, 1, l.NumConnections())
+
+	assert.Equal(t, nil, l.Close())
+	assert.Equal(t, 0, l.NumConnections())
+	assert.Equal(t, false, l.IsRunning())
+}
+
+func TestSendAndForget(t *testing.T) {
+	handled := make(chan string, 3)
+	l, err := NewServer("127.0.0.1:0", StringHandler(func(req string, span *Span) (string, error) {
+		if req != "PING" {
+			handled <- req + " " + span.Metadata["user"]
+		}
+		return "PONG", nil
+	}))
+	assert.T(t, err == nil)
+	stats := newTestStatsRecorder()
+	l.Stats = stats
+	go l.Start()
+	defer l.Close()
+	c, _ := NewClient([]string{l.Addr().String()}, 1, time.Second)
+	assert.T(t, c != nil)
+	assert.Equal(t, nil, c.SendAndForget([]byte("LOG1")))
+	assert.Equal(t, nil, c.SendAndForget([]byte("LOG2"), WithMetadata("user", "bob")))
+	assert.Equal(t, "LOG1 ", <-handled)
+	assert.Equal(t, "LOG2 bob", <-handled)
+	assert.Equal(t, int64(2), stats.counter("request.one_way"))
+
+	// nothing was written back
+	conn, err := c.pool.Take()
+	assert.Equal(t, nil, err)
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	var netErr net.Error
+	assert.T(t, errors.As(err, &netErr) && netErr.Timeout())
+	conn.SetReadDeadline(time.Time{})
+	c.pool.Return(conn)
+	// and the connection is still in step for an ordinary request
+	res, err := c.SendRecv([]byte("PING"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "PONG", string(res))
+	assert.Equal(t, 1, l.NumConnections())
+}
+
+func TestSendAndForgetUnsupported(t *testing.T) {
+	handled := make(chan string, 1)
+	l, addr := newTestServer(StringHandler(func(req string, span *Span) (string, error) {
+		handled <- req
+		return "PONG", nil
+	}))
+	defer l.Close()
+	pool, _ := NewConnectionPool([]string{addr}, 0, time.Second)
+	pool.Dialer = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		conn, err := net.DialTimeout(network, address, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return &featureMaskingConn{Conn: conn, mask: featureOneWay}, nil
+	}
+	c := NewClientWithPool(pool)
+	conn, err := pool.Take()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, features(0), conn.features&featureOneWay)
+	pool.Return(conn)
+	// the response to the ordinary request sent instead is read and thrown
+	// away
+	assert.Equal(t, nil, c.SendAndForget([]byte("LOG")))
+	assert.Equal(t, "LOG", <-handled)
+	res, err := c.SendRecv([]byte("PING"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "PONG", string(res))
+	<-handled
+}
+
+// featureMaskingConn hides features from the client's hello, as if the
+// client didn't support them
+type featureMaskingConn struct {
+	net.Conn
+	mask   features
+	hidden bool
+}
+
+func (c *featureMaskingConn) Write(b []byte) (int, error) {
+	if c.hidden == false && len(b) == helloLength {
+		c.hidden = true
+		hello := append([]byte(nil), b...)
+		hello[5] &^= byte(c.mask)
+		return c.Conn.Write(hello)
+	}
+	return c.Conn.Write(b)
+}
+
+func TestServerConcurrentClose(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0", new(EchoHandler))
+	assert.T(t, err == nil)
+	s.WorkerPoolSize = 2
+	go s.Start()
+	c, _ := NewClient([]string{s.Addr().String()}, 3, time.Second)
+	assert.T(t, c != nil)
+	_, err = c.SendRecv([]byte("PING"))
+	assert.Equal(t, nil, err)
+
+	errs := make(chan error, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- s.Close()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	closed := 0
+	for err := range errs {
+		if err == nil {
+			closed++
+		} else {
+			assert.Equal(t, ErrServerClosed, err)
+		}
+	}
+	// only one of them closed the server
+	assert.Equal(t, 1, closed)
+	assert.Equal(t, 0, s.NumConnections())
+	assert.Equal(t, ErrServerClosed, s.Close())
+}
+
+func TestServerHandleAfterClose(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0", new(EchoHandler))
+	assert.T(t, err == nil)
+	stats := newTestStatsRecorder()
+	s.Stats = stats
+	s.Close()
+	// a connection accepted just before Close is hung up on, not served
+	client, server := net.Pipe()
+	defer client.Close()
+	s.handle(server, 1)
+	_, err = client.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 0, s.NumConnections())
+	assert.Equal(t, int64(0), stats.counter("connection.accepted"))
+	assert.Equal(t, int64(0), stats.counter("connection.closed"))
+}
+
+func TestConnectionChurnStats(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0", new(EchoHandler))
+	assert.T(t, err == nil)
+	stats := newTestStatsRecorder()
+	s.Stats = stats
+	go s.Start()
+	defer s.Close()
+	addr := s.Addr().String()
+
+	for i := 0; i < 3; i++ {
+		c, _ := NewClient([]string{addr}, 2, time.Second)
+		assert.T(t, c != nil)
+		_, err = c.SendRecv([]byte("PING"))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, int64(2*(i+1)), stats.counter("connection.accepted"))
+		assert.Equal(t, int64(2), stats.gauge("connection.active"))
+		c.Close()
+		for j := 0; j < 100 && s.NumConnections() > 0; j++ {
+			time.Sleep(5 * time.Millisecond)
+		}
+		assert.Equal(t, stats.counter("connection.accepted"), stats.counter("connection.closed"))
+		assert.Equal(t, int64(0), stats.gauge("connection.active"))
+	}
+}
+
+func TestMaxBytesPerConnection(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0", new(EchoHandler))
+	assert.T(t, err == nil)
+	stats := newTestStatsRecorder()
+	s.Stats = stats
+	s.MaxBytesPerConnection = 10
+	go s.Start()
+	defer s.Close()
+	c, _ := NewClient([]string{s.Addr().String()}, 1, time.Second)
+	assert.T(t, c != nil)
+	c.Retries = 0
+
+	for i := 0; i < 2; i++ {
+		res, err := c.SendRecv([]byte("PING"))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "PING", string(res))
+	}
+	// the third takes the connection to 12 bytes
+	_, err = c.SendRecv([]byte("PING"))
+	assert.T(t, err != nil)
+	assert.Equal(t, int64(1), stats.counter("connection.bytes_exceeded"))
+
+	// the limit counts pipelined requests too
+	p := c.Pipeline()
+	for i := 0; i < 3; i++ {
+		p.Send([]byte("PING"))
+	}
+	_, err = p.Flush()
+	assert.T(t, err != nil)
+	assert.Equal(t, int64(2), stats.counter("connection.bytes_exceeded"))
+	for i := 0; i < 100 && s.NumConnections() > 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, 0, s.NumConnections())
+}
+
+func TestMaxBytesPerConnectionDecompressed(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0", new(EchoHandler))
+	assert.T(t, err == nil)
+	stats := newTestStatsRecorder()
+	s.Stats = stats
+	s.Compression = true
+	s.MaxBytesPerConnection = 1000
+	go s.Start()
+	defer s.Close()
+	pool, _ := NewConnectionPool([]string{s.Addr().String()}, 1, time.Second)
+	pool.Compression = CodecGzip
+	c := NewClientWithPool(pool)
+	c.Retries = 0
+	req := []byte(strings.Repeat("PING", 150))
+
+	res, err := c.SendRecv(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, req, res)
+	// the requests count at their decompressed size, the second takes the
+	// connection to 1200 bytes
+	_, err = c.SendRecv(req)
+	assert.T(t, err != nil)
+	assert.Equal(t, int64(1), stats.counter("connection.bytes_exceeded"))
+}
+
+// PrefixReaderHandler answers with the first 4 bytes of the request, and
+// fails requests that start with MISS with CodeNotFound
+type PrefixReaderHandler struct{}
+
+func (h *PrefixReaderHandler) RespondReader(r io.Reader, size int, span *Span) (response []byte, err error) {
+	prefix := make([]byte, 4)
+	_, err = io.ReadFull(r, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if string(prefix) == "MISS" {
+		return nil, NewStatusError(CodeNotFound, "no such key")
+	}
+	return prefix, nil
+}
+
+func TestStatusError(t *testing.T) {
+	handlers := map[string]RequestHandler{
+		"plain": StringHandler(func(req string, span *Span) (string, error) {
+			if strings.HasPrefix(req, "MISS") {
+				return "", fmt.Errorf("looking up %s: %w", req, NewStatusError(CodeNotFound, "no such key"))
+			}
+			return req[:4], nil
+		}),
+		"reader": ReaderHandler(new(PrefixReaderHandler)),
+	}
+	for name, handler := range handlers {
+		l, addr := newTestServer(handler)
+		c, _ := NewClient([]string{addr}, 1, time.Second)
+		assert.T(t, c != nil)
+		conn := c.pool.pools[addr][0]
+
+		_, err := c.SendRecvString("MISSING")
+		var remoteErr *RemoteError
+		assert.T(t, errors.As(err, &remoteErr), name)
+		assert.Equal(t, CodeNotFound, remoteErr.Code, name)
+		assert.Equal(t, "no such key", remoteErr.Message, name)
+		assert.Equal(t, "tcpez: remote error: NotFound: no such key", remoteErr.Error(), name)
+		assert.Equal(t, false, errors.Is(err, ErrRemoteTimeout), name)
+
+		// the connection is still good for the next request
+		res, err := c.SendRecvString("PING")
+		assert.Equal(t, nil, err, name)
+		assert.Equal(t, "PING", res, name)
+		assert.Equal(t, conn, c.pool.pools[addr][0], name)
+		c.Close()
+		l.Close()
+	}
+}
+
+func TestStatusErrorRetries(t *testing.T) {
+	var calls int32
+	l, addr := newTestServer(StringHandler(func(req string, span *Span) (string, error) {
+		n := atomic.AddInt32(&calls, 1)
+		if req == "BUSY" && n == 1 {
+			return "", NewStatusError(CodeUnavailable, "try again")
+		}
+		if req == "MISSING" {
+			return "", NewStatusError(CodeNotFound, "no such key")
+		}
+		return req, nil
+	}))
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	stats := newTestStatsRecorder()
+	c.Stats = stats
+
+	// the server recovers on the second try and the retry is transparent
+	res, info, err := c.SendRecvWithInfo([]byte("BUSY"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "BUSY", string(res))
+	assert.Equal(t, 1, info.Retries)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	assert.Equal(t, int64(1), stats.counter("client.retry.unavailable"))
+
+	// a non-retryable code fails straight away
+	atomic.StoreInt32(&calls, 0)
+	_, info, err = c.SendRecvWithInfo([]byte("MISSING"))
+	var remoteErr *RemoteError
+	assert.T(t, errors.As(err, &remoteErr))
+	assert.Equal(t, CodeNotFound, remoteErr.Code)
+	assert.Equal(t, 0, info.Retries)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	assert.Equal(t, int64(1), stats.counter("client.retry"))
+
+	assert.Equal(t, true, CodeResourceExhausted.Retryable())
+	assert.Equal(t, false, CodeInvalidArgument.Retryable())
+}
+
+func TestSpanLogger(t *testing.T) {
+	var logged []string
+	var lock sync.Mutex
+	spans := make(chan *Span, 1)
+	l, addr := newTestServer(StringHandler(func(req string, span *Span) (string, error) {
+		span.Logger().Info("looking up %s", req)
+		span.Logger().Warning("%s is slow", req)
+		spans <- span
+		return req, nil
+	}), func(s *Server) {
+		s.onSpanLog = func(level logging.Level, line string) {
+			lock.Lock()
+			defer lock.Unlock()
+			logged = append(logged, level.String()+" "+line)
+		}
+	})
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	_, err := c.SendRecvString("user:42")
+	assert.Equal(t, nil, err)
+
+	span := <-spans
+	assert.T(t, span.Id != "")
+	prefix := fmt.Sprintf("[span=%s remote=%s] ", span.Id, span.RemoteAddr)
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, []string{"INFO " + prefix + "looking up user:42", "WARNING " + prefix + "user:42 is slow"}, logged)
+}
+
+// newTestCertificate returns a self signed certificate for names
+func newTestCertificate(names ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), DNSNames: names, NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// newTLSClient returns a Client that connects to addr over TLS, asking for
+// serverName
+func newTLSClient(addr string, serverName string) (*Client, error) {
+	pool, err := NewConnectionPool([]string{addr}, 0, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	pool.Dialer = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		config := &tls.Config{ServerName: serverName, InsecureSkipVerify: true}
+		return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, network, address, config)
+	}
+	return NewClientWithPool(pool), nil
+}
+
+func TestSNIHandlers(t *testing.T) {
+	named := func(name string) RequestHandler {
+		return StringHandler(func(req string, span *Span) (string, error) {
+			return name + ":" + req, nil
+		})
+	}
+	s, err := NewServer("127.0.0.1:0", nil)
+	assert.T(t, err == nil)
+	stats := newTestStatsRecorder()
+	s.Stats = stats
+	s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{newTestCertificate("users.test", "orders.test")}}
+	s.SNIHandlers = map[string]RequestHandler{"users.test": named("users"), "orders.test": named("orders")}
+	go s.Start()
+	defer s.Close()
+	addr := s.Addr().String()
+
+	for _, name := range []string{"users", "orders"} {
+		c, err := newTLSClient(addr, name+".test")
+		assert.Equal(t, nil, err)
+		res, err := c.SendRecvString("PING")
+		assert.Equal(t, nil, err)
+		assert.Equal(t, name+":PING", res)
+		c.Close()
+	}
+
+	// without a default Handler other names are turned away
+	c, err := newTLSClient(addr, "other.test")
+	assert.Equal(t, nil, err)
+	_, err = c.SendRecvString("PING")
+	assert.T(t, err != nil)
+	assert.T(t, stats.counter("connection.unknown_server_name") > 0)
+	c.Close()
+}
+
+func TestPipelineResponseWarnBytes(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0", new(EchoHandler))
+	assert.T(t, err == nil)
+	stats := newTestStatsRecorder()
+	s.Stats = stats
+	s.PipelineResponseWarnBytes = 1024
+	warnings := make(chan string, 1)
+	s.onWarning = func(line string) {
+		warnings <- line
+	}
+	go s.Start()
+	defer s.Close()
+	c, _ := NewClient([]string{s.Addr().String()}, 1, time.Second)
+	assert.T(t, c != nil)
+
+	// a batch under the threshold is quiet
+	_, err = c.SendRecvBatch([][]byte{make([]byte, 512), make([]byte, 512)})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(0), stats.counter("pipeline.large_response"))
+	assert.Equal(t, 0, len(warnings))
+
+	// one over it is still answered, but warned about
+	responses, err := c.SendRecvBatch([][]byte{make([]byte, 512), make([]byte, 1024)})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(responses))
+	assert.Equal(t, int64(1), stats.counter("pipeline.large_response"))
+	warning := <-warnings
+	local := c.pool.pools[s.Addr().String()][0].LocalAddr().String()
+	assert.T(t, strings.Contains(warning, local), warning)
+	assert.T(t, strings.Contains(warning, "1536 bytes"), warning)
+}
+
+func TestWorkerPoolSize(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0", new(EchoHandler))
+	assert.T(t, err == nil)
+	s.WorkerPoolSize = 2
+	go s.Start()
+	defer s.Close()
+	c, _ := NewClient([]string{s.Addr().String()}, 1, time.Second)
+	assert.T(t, c != nil)
+	reqs := make([][]byte, 100)
+	for i := range reqs {
+		reqs[i] = []byte(fmt.Sprintf("PING%d", i))
+	}
+	responses, err := c.SendRecvBatch(reqs)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, reqs, responses)
+	m, err := c.Mux()
+	assert.Equal(t, nil, err)
+	defer m.Close()
+	res, err := m.SendRecv([]byte("PING"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "PING", string(res))
+}
+
+func BenchmarkServerDispatch(b *testing.B) {
+	logging.SetLevel(logging.ERROR, "tcpez")
+	reqs := make([][]byte, 100)
+	for i := range reqs {
+		reqs[i] = []byte("PING")
+	}
+	for _, size := range []int{0, 64} {
+		name := "goroutine_per_request"
+		if size > 0 {
+			name = "worker_pool"
+		}
+		b.Run(name, func(b *testing.B) {
+			s, err := NewServer("127.0.0.1:0", new(EchoHandler))
+			if err != nil {
+				b.Fatal(err)
+			}
+			s.WorkerPoolSize = size
+			go s.Start()
+			defer s.Close()
+			c, _ := NewClient([]string{s.Addr().String()}, 8, time.Second)
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := c.SendRecvBatch(reqs); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
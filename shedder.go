@@ -0,0 +1,110 @@
+package tcpez
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrLoadShed is returned for the requests a Client's LoadShedder turns away.
+var ErrLoadShed = errors.New("tcpez: request shed, backend is slow")
+
+const (
+	// the weight of each new latency in a backend's recent and baseline
+	// moving averages, the baseline moves much slower so it catches up
+	// with a slowdown long after the recent latency shows it
+	recentLatencyWeight   = 0.3
+	baselineLatencyWeight = 0.01
+)
+
+// LoadShedder makes a Client fail a share of its requests to a backend fast,
+// with ErrLoadShed, when the backend's latency climbs past its usual latency,
+// rather than piling more requests onto a backend that is likely overloaded.
+// It keeps two moving averages of each backend's latency (the time it took
+// to write the request and read the response), a recent one and a much
+// slower moving baseline. Once the recent latency is over Threshold times
+// the baseline, the share of requests shed grows with it, up to MaxShed.
+//
+//        c.Shedder = tcpez.NewLoadShedder()
+//
+// The zero value is ready to use, but doesn't shed anything until its
+// Threshold and MaxShed are set.
+//
+// Shed requests are counted as the "client.request.shed" stat and are not
+// retried.
+type LoadShedder struct {
+	// Threshold is how many times the baseline the recent latency has to
+	// be before requests are shed. At twice the Threshold MaxShed of the
+	// requests are shed.
+	Threshold float64
+	// MaxShed is the largest share of requests that is shed, some requests
+	// always go through so the recent latency keeps being measured.
+	MaxShed float64
+	// MinLatency is the recent latency below which requests are never shed,
+	// so the jitter of very fast requests doesn't set the shedder off.
+	MinLatency time.Duration
+	backends   map[string]*backendLatency
+	random     func() float64
+	sync.Mutex
+}
+
+type backendLatency struct {
+	recent   float64
+	baseline float64
+}
+
+// NewLoadShedder creates a LoadShedder that starts shedding at twice the
+// baseline latency, as long as that's over 5ms, and sheds at most 90% of the
+// requests.
+func NewLoadShedder() *LoadShedder {
+	return &LoadShedder{Threshold: 2, MaxShed: 0.9, MinLatency: 5 * time.Millisecond, backends: make(map[string]*backendLatency), random: rand.Float64}
+}
+
+// observe adds the latency of a request to backend to its averages
+func (l *LoadShedder) observe(backend string, latency time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	if l.backends == nil {
+		l.backends = make(map[string]*backendLatency)
+	}
+	b, ok := l.backends[backend]
+	if ok == false {
+		l.backends[backend] = &backendLatency{recent: float64(latency), baseline: float64(latency)}
+		return
+	}
+	b.recent += recentLatencyWeight * (float64(latency) - b.recent)
+	b.baseline += baselineLatencyWeight * (float64(latency) - b.baseline)
+}
+
+// shedFraction is the share of the requests to backend to shed
+func (l *LoadShedder) shedFraction(backend string) float64 {
+	l.Lock()
+	defer l.Unlock()
+	b, ok := l.backends[backend]
+	if ok == false || b.baseline <= 0 || b.recent < float64(l.MinLatency) || l.Threshold <= 0 {
+		return 0
+	}
+	over := b.recent/b.baseline - l.Threshold
+	if over <= 0 {
+		return 0
+	}
+	fraction := l.MaxShed * over / l.Threshold
+	if fraction > l.MaxShed {
+		fraction = l.MaxShed
+	}
+	return fraction
+}
+
+// shed decides whether to turn away a request to backend
+func (l *LoadShedder) shed(backend string) bool {
+	fraction := l.shedFraction(backend)
+	if fraction <= 0 {
+		return false
+	}
+	random := l.random
+	if random == nil {
+		random = rand.Float64
+	}
+	return random() < fraction
+}
@@ -0,0 +1,75 @@
+package tcpez
+
+import (
+	"errors"
+	"github.com/bmizerany/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoadShedderFraction(t *testing.T) {
+	l := NewLoadShedder()
+	assert.Equal(t, float64(0), l.shedFraction("a"))
+	for i := 0; i < 10; i++ {
+		l.observe("a", 10*time.Millisecond)
+	}
+	assert.Equal(t, float64(0), l.shedFraction("a"))
+	l.backends["a"].recent = float64(30 * time.Millisecond)
+	assert.Equal(t, 0.45, l.shedFraction("a"))
+	l.backends["a"].recent = float64(100 * time.Millisecond)
+	assert.Equal(t, 0.9, l.shedFraction("a"))
+	// other backends are unaffected
+	l.observe("b", 10*time.Millisecond)
+	assert.Equal(t, float64(0), l.shedFraction("b"))
+	// and fast requests are never shed
+	l.observe("c", 10*time.Microsecond)
+	l.backends["c"].recent = float64(time.Millisecond)
+	assert.Equal(t, float64(0), l.shedFraction("c"))
+}
+
+func TestLoadShedderZeroValue(t *testing.T) {
+	var l LoadShedder
+	l.observe("a", 10*time.Millisecond)
+	l.backends["a"].recent = float64(100 * time.Millisecond)
+	assert.Equal(t, false, l.shed("a"))
+	// and sheds once it's configured
+	l.Threshold = 2
+	l.MaxShed = 1
+	assert.Equal(t, true, l.shed("a"))
+}
+
+func TestLoadShedding(t *testing.T) {
+	var slow int32
+	handler := RequestHandlerFunc(func(req []byte, span *Span) ([]byte, error) {
+		if atomic.LoadInt32(&slow) == 1 {
+			time.Sleep(20 * time.Millisecond)
+		}
+		return req, nil
+	})
+	l, addr := newTestServer(handler)
+	defer l.Close()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	stats := newTestStatsRecorder()
+	c.Stats = stats
+	c.Shedder = NewLoadShedder()
+	for i := 0; i < 20; i++ {
+		_, err := c.SendRecv([]byte("PING"))
+		assert.T(t, err == nil)
+	}
+	assert.Equal(t, int64(0), stats.counter("client.request.shed"))
+
+	atomic.StoreInt32(&slow, 1)
+	shed := 0
+	for i := 0; i < 20; i++ {
+		_, err := c.SendRecv([]byte("PING"))
+		if errors.Is(err, ErrLoadShed) {
+			shed++
+		} else {
+			assert.T(t, err == nil)
+		}
+	}
+	assert.T(t, shed > 0)
+	assert.Equal(t, int64(shed), stats.counter("client.request.shed"))
+}
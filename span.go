@@ -9,9 +9,12 @@ package tcpez
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/op/go-logging"
 	"github.com/satori/go.uuid"
+	"math"
 	"runtime"
 	"sync"
 	"syscall"
@@ -21,6 +24,12 @@ import (
 // A UUIDGenerator is a func that returns a unique id as a string
 type UUIDGenerator func() string
 
+// A UUIDGeneratorWithContext is a func that returns a unique id for the Span
+// of a request, given the address of the client that sent it and the id of
+// its parent Span (empty if it has none). It lets ids carry where they came
+// from, for example for a vector-clock style scheme.
+type UUIDGeneratorWithContext func(remoteAddr string, parent string) string
+
 // The DefaultUUIDGenerator uses "github.com/satori/go.uuid"/V1 to
 // generate RFC 4122 compatible uuids
 func DefaultUUIDGenerator() string {
@@ -42,14 +51,16 @@ func (s *SubSpan) Finish(started time.Time) time.Time {
 	return finished
 }
 
-// The Duration of the SubSpan as an int64 representing nanoseconds
-func (s *SubSpan) Duration() int64 {
-	return int64(s.Finished.Sub(s.Started))
+// Duration is how long the SubSpan took, from Started to Finished.
+func (s *SubSpan) Duration() time.Duration {
+	return s.Finished.Sub(s.Started)
 }
 
-// The Duration of the subspan as a millisecond prescision float64
+// MillisecondDuration is the Duration as a float64 number of milliseconds,
+// with sub-millisecond precision. This is the unit spans are logged and
+// recorded in.
 func (s *SubSpan) MillisecondDuration() float64 {
-	return float64(s.Finished.Sub(s.Started)) / float64(time.Millisecond)
+	return float64(s.Duration()) / float64(time.Millisecond)
 }
 
 // Span is the main object passed through a RequestHandler that stores
@@ -63,6 +74,25 @@ type Span struct {
 	SubSpans map[string]*SubSpan
 	Counters map[string]int64
 	Attrs    map[string]string
+	// Started is when the Span was created
+	Started time.Time
+	// RemoteAddr is the address of the client that sent the request
+	RemoteAddr string
+	// Metadata holds the key/values the client sent along with the request
+	// (see WithMetadata). It should be treated as read only.
+	Metadata map[string]string
+	// features were negotiated by the connection the request came in on
+	features features
+	// noCompression is set by DisableCompression
+	noCompression bool
+	// closeConnection is set by CloseConnection
+	closeConnection bool
+	// afterResponse are the funcs registered with AfterResponse
+	afterResponse []func()
+	// ctx is returned by Context
+	ctx context.Context
+	// onLog is passed the lines logged with Logger, for tests
+	onLog func(level logging.Level, line string)
 }
 
 // Initialize a Span for a unique request with a UUID. This also initializes
@@ -70,9 +100,11 @@ type Span struct {
 func NewSpan(id string) (s *Span) {
 	s = new(Span)
 	s.Id = id
+	s.Started = time.Now()
 	s.SubSpans = make(map[string]*SubSpan)
 	s.Counters = make(map[string]int64)
 	s.Attrs = make(map[string]string)
+	s.Metadata = make(map[string]string)
 	s.Stats = new(DebugStatsRecorder)
 	return s
 }
@@ -95,7 +127,7 @@ func (s *Span) Start(name string) {
 // Finish marks the subspan at name as finished, returning the duration (useful for debug logging).
 // This does not have to be called in the same goroutine or location as the .Start() for the SubSpan,
 // in fact, you can call Finish on an unstarted SubSpan without error (the duration will be 0).
-func (s *Span) Finish(name string) (duration int64) {
+func (s *Span) Finish(name string) (duration time.Duration) {
 	s.Lock()
 	defer s.Unlock()
 	sub := s.SubSpans[name]
@@ -109,13 +141,14 @@ func (s *Span) Finish(name string) (duration int64) {
 	return sub.Duration()
 }
 
-// SubSpanWithDuration creates a new subspan with the duration expressed as a float64 of milliseconds.
+// SubSpanWithDuration creates a new subspan with the duration expressed as a float64 of milliseconds,
+// the same unit MillisecondDuration returns, so MillisecondDuration(name) gives msduration back.
 func (s *Span) SubSpanWithDuration(name string, msduration float64) {
 	s.Lock()
 	defer s.Unlock()
 	sub := s.SubSpans[name]
 	started := time.Now()
-	dur := time.Duration(msduration * 1000 * 1000)
+	dur := time.Duration(math.Round(msduration * float64(time.Millisecond)))
 	finished := started.Add(dur)
 	if sub != nil {
 		sub.Started = started
@@ -149,6 +182,190 @@ func (s *Span) Attr(k, v string) {
 	s.Attrs[k] = v
 }
 
+// SetTag is the same as Attr, for code written against tracing APIs that
+// call attributes tags.
+func (s *Span) SetTag(k, v string) {
+	s.Attr(k, v)
+}
+
+// GetAttr returns the attribute at k and whether it was set.
+func (s *Span) GetAttr(k string) (v string, ok bool) {
+	s.Lock()
+	defer s.Unlock()
+	v, ok = s.Attrs[k]
+	return v, ok
+}
+
+// Counter returns the value of the counter at name and whether it was set.
+func (s *Span) Counter(name string) (val int64, ok bool) {
+	s.Lock()
+	defer s.Unlock()
+	val, ok = s.Counters[name]
+	return val, ok
+}
+
+// SubSpanDuration returns the duration of the SubSpan at name and whether
+// there is one. Unlike Duration it doesn't create the SubSpan when there
+// isn't.
+func (s *Span) SubSpanDuration(name string) (duration time.Duration, ok bool) {
+	s.Lock()
+	defer s.Unlock()
+	sub, ok := s.SubSpans[name]
+	if ok == false {
+		return 0, false
+	}
+	return sub.Duration(), true
+}
+
+// Attributes returns a copy of the Span's attributes, which unlike Attrs is
+// safe to read while the Span is still being used.
+func (s *Span) Attributes() (attrs map[string]string) {
+	s.Lock()
+	defer s.Unlock()
+	attrs = make(map[string]string, len(s.Attrs))
+	for k, v := range s.Attrs {
+		attrs[k] = v
+	}
+	return attrs
+}
+
+// DisableCompression tells the server not to compress the response to this
+// request even if compression is enabled, for example because the response
+// is already compressed.
+func (s *Span) DisableCompression() {
+	s.Lock()
+	defer s.Unlock()
+	s.noCompression = true
+}
+
+func (s *Span) compressionDisabled() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.noCompression
+}
+
+// CompressionNegotiated reports whether the client of the connection the
+// request came in on accepts compressed responses and the server has
+// Compression enabled, that is whether a large enough response will be
+// compressed unless DisableCompression is called.
+func (s *Span) CompressionNegotiated() bool {
+	return s.features&featureCompression != 0
+}
+
+// ChecksumNegotiated reports whether the request and its response are
+// checksummed on the connection the request came in on, see Server.Checksum.
+func (s *Span) ChecksumNegotiated() bool {
+	return s.features&featureChecksum != 0
+}
+
+// CloseConnection tells the server to close the connection the request came
+// in on once the response has been sent, for example when the client broke
+// the protocol or its authentication expired.
+func (s *Span) CloseConnection() {
+	s.Lock()
+	defer s.Unlock()
+	s.closeConnection = true
+}
+
+func (s *Span) connectionCloseRequested() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.closeConnection
+}
+
+// AfterResponse registers fn to be run once the response to the request has
+// been sent. It lets a handler answer straight away, for example with an
+// ack, and carry on with the slow part of its work without holding up the
+// client or the next request on the connection.
+//
+//        func (h *MyHandler) Respond(req []byte, span *tcpez.Span) ([]byte, error) {
+//                span.AfterResponse(func() { h.process(req) })
+//                return []byte("ACK"), nil
+//        }
+//
+// The funcs run in order in their own goroutine, they don't count towards
+// the Server's MaxInflight and aren't waited for by Close. They aren't run if
+// the handler returns an error or the response can't be sent. By the time
+// they run the span has been logged and recorded, so they shouldn't use it.
+func (s *Span) AfterResponse(fn func()) {
+	s.Lock()
+	defer s.Unlock()
+	s.afterResponse = append(s.afterResponse, fn)
+}
+
+func (s *Span) afterResponseFuncs() []func() {
+	s.Lock()
+	defer s.Unlock()
+	return s.afterResponse
+}
+
+// Context returns the context of the request, it carries the request's
+// deadline when it has one and is cancelled once the handler is done with the
+// request or has run out of time (see Server.HandlerTimeout and
+// TimeoutMetadataKey). Pass it on to downstream calls so they give up along
+// with the request. A Span that isn't for a server request has a background
+// context.
+func (s *Span) Context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// SpanLogger logs lines tagged with the id of a Span and the address of the
+// client that sent its request, so everything a handler logged about a slow
+// request can be found by grepping for the span id the request was logged
+// with. The lines go to the tcpez logger.
+//
+//        func (h *MyHandler) Respond(req []byte, span *tcpez.Span) ([]byte, error) {
+//                span.Logger().Info("looking up %s", req)
+//                ...
+//        }
+//        //=> ... INFO [tcpez] [span=6eede8679ad2888e remote=10.0.0.5:51234] looking up user:42
+//
+type SpanLogger struct {
+	prefix string
+	onLog  func(level logging.Level, line string)
+}
+
+// Logger returns a SpanLogger for the Span.
+func (s *Span) Logger() *SpanLogger {
+	return &SpanLogger{prefix: fmt.Sprintf("[span=%s remote=%s] ", s.Id, s.RemoteAddr), onLog: s.onLog}
+}
+
+func (l *SpanLogger) Debug(format string, args ...interface{}) {
+	l.log(logging.DEBUG, l.prefix+fmt.Sprintf(format, args...))
+}
+
+func (l *SpanLogger) Info(format string, args ...interface{}) {
+	l.log(logging.INFO, l.prefix+fmt.Sprintf(format, args...))
+}
+
+func (l *SpanLogger) Warning(format string, args ...interface{}) {
+	l.log(logging.WARNING, l.prefix+fmt.Sprintf(format, args...))
+}
+
+func (l *SpanLogger) Error(format string, args ...interface{}) {
+	l.log(logging.ERROR, l.prefix+fmt.Sprintf(format, args...))
+}
+
+// log writes line to the tcpez logger at level
+func (l *SpanLogger) log(level logging.Level, line string) {
+	if l.onLog != nil {
+		l.onLog(level, line)
+	}
+	switch level {
+	case logging.DEBUG:
+		log.Debug("%s", line)
+	case logging.INFO:
+		log.Info("%s", line)
+	case logging.WARNING:
+		log.Warning("%s", line)
+	default:
+		log.Error("%s", line)
+	}
+}
+
 // SubSpan returns the SubSpan at name. If the SubSpan does not exist,
 // it initializes a new one with name.
 func (s *Span) SubSpan(name string) (sub *SubSpan) {
@@ -162,12 +379,15 @@ func (s *Span) SubSpan(name string) (sub *SubSpan) {
 	return sub
 }
 
-// Duration returns the nanosecond duration of the SubSpan at name.
-func (s *Span) Duration(name string) int64 {
+// Duration returns the duration of the SubSpan at name. Use it to work with
+// the duration in Go, e.g. to compare it to a time.Duration.
+func (s *Span) Duration(name string) time.Duration {
 	return s.SubSpan(name).Duration()
 }
 
-// MillisecondDuration() returns a float64 of the duration with millisecond prescision.
+// MillisecondDuration returns the duration of the SubSpan at name as a
+// float64 number of milliseconds, the unit spans are logged in. It is
+// Duration(name) in milliseconds, with sub-millisecond precision.
 func (s *Span) MillisecondDuration(name string) float64 {
 	return s.SubSpan(name).MillisecondDuration()
 }
@@ -199,6 +419,8 @@ func (s *Span) MergeJSON(span string) (err error) {
 // be flushed to Statsd (or any other service that conforms to the StatsRecorder
 // interface)
 func (s *Span) Record() {
+	s.Lock()
+	defer s.Unlock()
 	if s.Stats != nil {
 		for k, v := range s.Counters {
 			s.Stats.Counter(k, v)
@@ -212,6 +434,8 @@ func (s *Span) Record() {
 // JSON marshalls the Span into a JSON formatted string with all the subspans turned
 // into their millisecond durations. This is the default for what is logged by the tcpez server.
 func (s *Span) JSON() string {
+	s.Lock()
+	defer s.Unlock()
 	j := make(map[string]string)
 
 	j["id"] = s.Id
@@ -229,9 +453,54 @@ func (s *Span) JSON() string {
 	return string(b)
 }
 
+// SetStartTime sets when the Span started, which is when it was created by
+// default. The SubSpans in TimelineJSON are placed relative to it, so moving
+// it back to when the client sent the request lets the client's timings (see
+// MergeJSON) and the server's be drawn on the same timeline.
+func (s *Span) SetStartTime(started time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	s.Started = started
+}
+
+type timelineJSON struct {
+	Id       string                   `json:"id"`
+	ParentId string                   `json:"parentid"`
+	Started  time.Time                `json:"started"`
+	SubSpans map[string]timelineEntry `json:"subspans"`
+}
+
+type timelineEntry struct {
+	Start  float64 `json:"start"`
+	Finish float64 `json:"finish"`
+}
+
+// TimelineJSON marshalls the Span into a JSON formatted string with when
+// each SubSpan started and finished, in milliseconds since the Span started,
+// rather than just how long it took. This is what a timeline or flamegraph of
+// the request is drawn from.
+//
+//        {"id":"6eede8679ad2888e","parentid":"","started":"2015-06-01T12:00:00Z","subspans":{"pb.parse":{"start":0.012,"finish":0.4}}}
+//
+func (s *Span) TimelineJSON() string {
+	s.Lock()
+	defer s.Unlock()
+	j := timelineJSON{Id: s.Id, ParentId: s.ParentId, Started: s.Started, SubSpans: make(map[string]timelineEntry, len(s.SubSpans))}
+	for k, v := range s.SubSpans {
+		j.SubSpans[k] = timelineEntry{
+			Start:  float64(v.Started.Sub(s.Started)) / float64(time.Millisecond),
+			Finish: float64(v.Finished.Sub(s.Started)) / float64(time.Millisecond),
+		}
+	}
+	b, _ := json.Marshal(j)
+	return string(b)
+}
+
 // String turns the Span into a k=v formatted string with the subspans turned into
 // their millisecond durations.
 func (s *Span) String() string {
+	s.Lock()
+	defer s.Unlock()
 	b := bytes.NewBufferString("")
 
 	for k, v := range s.Attrs {
@@ -0,0 +1,188 @@
+package tcpez
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"time"
+)
+
+// A SpanSink receives the Span of every request a Server handles once the
+// request is finished, to ship it somewhere like a tracing collector or a
+// file. Record is called on the goroutine that handled the request, before
+// the response is sent, so it should hand the Span off rather than do
+// anything slow with it. The Span must be treated as read only.
+type SpanSink interface {
+	Record(span *Span)
+}
+
+// NopSpanSink is a SpanSink that drops the Spans, it's the Server's default.
+type NopSpanSink struct{}
+
+func (NopSpanSink) Record(span *Span) {}
+
+// JSONFileSpanSink is a SpanSink that appends each Span to a file as a line
+// of JSON, in the same format the server logs them in (see Span.JSON).
+//
+//        sink, err := tcpez.NewJSONFileSpanSink("/var/log/myserver/spans.json")
+//        s.SpanSink = sink
+//
+type JSONFileSpanSink struct {
+	file *os.File
+	sync.Mutex
+}
+
+// NewJSONFileSpanSink opens path for appending, creating it if it doesn't
+// exist.
+func NewJSONFileSpanSink(path string) (sink *JSONFileSpanSink, err error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONFileSpanSink{file: file}, nil
+}
+
+func (sink *JSONFileSpanSink) Record(span *Span) {
+	sink.RecordBatch([]*Span{span})
+}
+
+// RecordBatch appends the spans to the file in a single write.
+func (sink *JSONFileSpanSink) RecordBatch(spans []*Span) {
+	b := new(bytes.Buffer)
+	for _, span := range spans {
+		b.WriteString(span.JSON())
+		b.WriteByte('\n')
+	}
+	sink.Lock()
+	defer sink.Unlock()
+	_, err := sink.file.Write(b.Bytes())
+	if err != nil {
+		log.Warning("Writing %d spans failed: %s", len(spans), err.Error())
+	}
+}
+
+// Close closes the file.
+func (sink *JSONFileSpanSink) Close() error {
+	sink.Lock()
+	defer sink.Unlock()
+	return sink.file.Close()
+}
+
+// A BatchSpanSink is a SpanSink that can also take many Spans at once, which
+// is how a BatchingSpanSink hands them over when it can.
+type BatchSpanSink interface {
+	SpanSink
+	RecordBatch(spans []*Span)
+}
+
+// BatchingSpanSink is a SpanSink that buffers the Spans and passes them on to
+// another sink in batches, once it has size of them or every interval,
+// whichever comes first. Record never blocks: when the sink can't keep up and
+// size Spans are already waiting, the Span is dropped and counted as
+// "span_sink.dropped" in Stats.
+//
+//        s.SpanSink = tcpez.NewBatchingSpanSink(collectorSink, 100, time.Second)
+//
+type BatchingSpanSink struct {
+	// Stats records the spans that were dropped
+	Stats    StatsRecorder
+	size     int
+	interval time.Duration
+	sink     SpanSink
+	spans    chan *Span
+	done     chan struct{}
+	stopped  chan struct{}
+	closed   sync.Once
+}
+
+// DefaultSpanBatchSize and DefaultSpanBatchInterval are what
+// NewBatchingSpanSink uses when it's given a size or interval that isn't
+// positive.
+const (
+	DefaultSpanBatchSize     = 100
+	DefaultSpanBatchInterval = time.Second
+)
+
+// NewBatchingSpanSink starts a BatchingSpanSink that passes the spans to
+// sink, using its RecordBatch if it is a BatchSpanSink.
+func NewBatchingSpanSink(sink SpanSink, size int, interval time.Duration) *BatchingSpanSink {
+	if size <= 0 {
+		size = DefaultSpanBatchSize
+	}
+	if interval <= 0 {
+		interval = DefaultSpanBatchInterval
+	}
+	b := &BatchingSpanSink{
+		Stats:    new(DebugStatsRecorder),
+		size:     size,
+		interval: interval,
+		sink:     sink,
+		spans:    make(chan *Span, size),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *BatchingSpanSink) Record(span *Span) {
+	select {
+	case b.spans <- span:
+	default:
+		b.Stats.Increment("span_sink.dropped")
+	}
+}
+
+// Close flushes the spans that are still buffered and stops the
+// BatchingSpanSink, spans recorded after it are dropped.
+func (b *BatchingSpanSink) Close() error {
+	b.closed.Do(func() {
+		close(b.done)
+	})
+	<-b.stopped
+	return nil
+}
+
+func (b *BatchingSpanSink) run() {
+	defer close(b.stopped)
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, b.size)
+	for {
+		select {
+		case span := <-b.spans:
+			batch = append(batch, span)
+			if len(batch) >= b.size {
+				batch = b.flush(batch)
+			}
+		case <-ticker.C:
+			batch = b.flush(batch)
+		case <-b.done:
+			for {
+				select {
+				case span := <-b.spans:
+					batch = append(batch, span)
+				default:
+					b.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush passes batch on to the sink and returns an empty batch to fill
+func (b *BatchingSpanSink) flush(batch []*Span) []*Span {
+	if len(batch) == 0 {
+		return batch
+	}
+	if sink, ok := b.sink.(BatchSpanSink); ok == true {
+		sink.RecordBatch(batch)
+	} else {
+		for _, span := range batch {
+			b.sink.Record(span)
+		}
+	}
+	// the sink may hold on to the batch, start a new one
+	return make([]*Span, 0, b.size)
+}
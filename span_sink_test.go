@@ -0,0 +1,151 @@
+package tcpez
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type capturingSpanSink struct {
+	spans chan *Span
+}
+
+func (sink *capturingSpanSink) Record(span *Span) {
+	sink.spans <- span
+}
+
+func TestServerSpanSink(t *testing.T) {
+	l, err := NewServer("127.0.0.1:0", StringHandler(func(req string, span *Span) (string, error) {
+		span.Attr("handler", "echo")
+		span.Increment("requests")
+		return req, nil
+	}))
+	assert.Equal(t, nil, err)
+	sink := &capturingSpanSink{spans: make(chan *Span, 1)}
+	l.SpanSink = sink
+	go l.Start()
+	defer l.Close()
+	addr := l.Addr().String()
+	c, _ := NewClient([]string{addr}, 1, time.Second)
+	assert.T(t, c != nil)
+	_, err = c.SendRecvOpts([]byte("PING"), WithMetadata(SpanIdMetadataKey, "abc"))
+	assert.Equal(t, nil, err)
+	span := <-sink.spans
+	assert.Equal(t, "abc", span.Id)
+	assert.Equal(t, "echo", span.Attrs["handler"])
+	assert.Equal(t, int64(1), span.Counters["requests"])
+	// it's handed over finished
+	assert.T(t, span.SubSpans["duration"].Finished.IsZero() == false)
+}
+
+func TestJSONFileSpanSink(t *testing.T) {
+	f, err := ioutil.TempFile("", "tcpez-spans")
+	assert.Equal(t, nil, err)
+	f.Close()
+	defer os.Remove(f.Name())
+	sink, err := NewJSONFileSpanSink(f.Name())
+	assert.Equal(t, nil, err)
+	for _, id := range []string{"one", "two"} {
+		span := NewSpan(id)
+		span.Attr("command", "GET")
+		sink.Record(span)
+	}
+	assert.Equal(t, nil, sink.Close())
+	b, _ := ioutil.ReadFile(f.Name())
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	assert.Equal(t, 2, len(lines))
+	var j map[string]string
+	assert.Equal(t, nil, json.Unmarshal([]byte(lines[1]), &j))
+	assert.Equal(t, "two", j["id"])
+	assert.Equal(t, "GET", j["command"])
+}
+
+type batchCapturingSpanSink struct {
+	batches chan []*Span
+}
+
+func (sink *batchCapturingSpanSink) Record(span *Span) {
+	sink.RecordBatch([]*Span{span})
+}
+
+func (sink *batchCapturingSpanSink) RecordBatch(spans []*Span) {
+	sink.batches <- spans
+}
+
+func TestBatchingSpanSinkSize(t *testing.T) {
+	sink := &batchCapturingSpanSink{batches: make(chan []*Span, 10)}
+	b := NewBatchingSpanSink(sink, 3, time.Hour)
+	for i := 0; i < 7; i++ {
+		// leave room so none are dropped
+		for len(b.spans) == cap(b.spans) {
+			time.Sleep(time.Millisecond)
+		}
+		b.Record(NewSpan(fmt.Sprintf("%d", i)))
+	}
+	assert.Equal(t, 3, len(<-sink.batches))
+	batch := <-sink.batches
+	assert.Equal(t, 3, len(batch))
+	assert.Equal(t, "5", batch[2].Id)
+	// the last one is flushed on Close
+	assert.Equal(t, nil, b.Close())
+	assert.Equal(t, 1, len(<-sink.batches))
+	assert.Equal(t, 0, len(sink.batches))
+}
+
+func TestBatchingSpanSinkInterval(t *testing.T) {
+	sink := &batchCapturingSpanSink{batches: make(chan []*Span, 10)}
+	b := NewBatchingSpanSink(sink, 100, 20*time.Millisecond)
+	defer b.Close()
+	b.Record(NewSpan("one"))
+	b.Record(NewSpan("two"))
+	select {
+	case batch := <-sink.batches:
+		assert.Equal(t, 2, len(batch))
+	case <-time.After(time.Second):
+		t.Fatal("batch wasn't flushed on the interval")
+	}
+}
+
+func TestBatchingSpanSinkDefaults(t *testing.T) {
+	sink := &batchCapturingSpanSink{batches: make(chan []*Span, 10)}
+	b := NewBatchingSpanSink(sink, 0, 0)
+	assert.Equal(t, DefaultSpanBatchSize, b.size)
+	assert.Equal(t, DefaultSpanBatchSize, cap(b.spans))
+	assert.Equal(t, DefaultSpanBatchInterval, b.interval)
+	b.Record(NewSpan("kept"))
+	assert.Equal(t, nil, b.Close())
+	assert.Equal(t, "kept", (<-sink.batches)[0].Id)
+
+	b = NewBatchingSpanSink(sink, -1, -time.Second)
+	assert.Equal(t, DefaultSpanBatchSize, b.size)
+	assert.Equal(t, DefaultSpanBatchInterval, b.interval)
+	assert.Equal(t, nil, b.Close())
+}
+
+func TestBatchingSpanSinkDrops(t *testing.T) {
+	// an unbuffered sink blocks the flush until the batch is received
+	sink := &batchCapturingSpanSink{batches: make(chan []*Span)}
+	b := NewBatchingSpanSink(sink, 1, time.Hour)
+	stats := newTestStatsRecorder()
+	b.Stats = stats
+	b.Record(NewSpan("flushing"))
+	for len(b.spans) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	b.Record(NewSpan("buffered"))
+	b.Record(NewSpan("dropped"))
+	assert.Equal(t, int64(1), stats.counter("span_sink.dropped"))
+	assert.Equal(t, "flushing", (<-sink.batches)[0].Id)
+	assert.Equal(t, "buffered", (<-sink.batches)[0].Id)
+	go b.Close()
+	select {
+	case batch := <-sink.batches:
+		t.Fatalf("dropped span %s was recorded", batch[0].Id)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -1,7 +1,9 @@
 package tcpez
 
 import (
+	"encoding/json"
 	"github.com/bmizerany/assert"
+	"math"
 	"strings"
 	"testing"
 	"time"
@@ -46,6 +48,25 @@ func TestSubSpanWithDuration(t *testing.T) {
 	span.SubSpanWithDuration("test", 42.4)
 	assert.Equal(t, 1, len(span.SubSpans))
 	assert.Equal(t, 42.4, span.MillisecondDuration("test"))
+	assert.Equal(t, 42400*time.Microsecond, span.Duration("test"))
+}
+
+func TestDurationUnits(t *testing.T) {
+	span := NewSpan("")
+	span.Start("test")
+	time.Sleep(2 * time.Millisecond)
+	finished := span.Finish("test")
+	assert.Equal(t, finished, span.Duration("test"))
+	assert.T(t, span.Duration("test") >= 2*time.Millisecond)
+	for _, name := range []string{"test", "other"} {
+		if name == "other" {
+			span.SubSpanWithDuration(name, 1.5)
+		}
+		ms := span.MillisecondDuration(name)
+		assert.T(t, math.Abs(ms-span.Duration(name).Seconds()*1000) < 1e-9)
+		assert.Equal(t, ms, span.SubSpans[name].MillisecondDuration())
+	}
+	assert.Equal(t, 1500*time.Microsecond, span.Duration("other"))
 }
 
 func TestMergeJSON(t *testing.T) {
@@ -60,6 +81,24 @@ func TestMergeJSON(t *testing.T) {
 	assert.Equal(t, 1, len(span.Counters))
 }
 
+func TestSpanSetStartTime(t *testing.T) {
+	span := NewSpan("1")
+	origin := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	span.SubSpan("client.render").Started = origin.Add(10 * time.Millisecond)
+	span.SubSpan("client.render").Finished = origin.Add(30 * time.Millisecond)
+	span.SetStartTime(origin)
+	assert.Equal(t, origin, span.Started)
+
+	var timeline struct {
+		Started  time.Time
+		SubSpans map[string]map[string]float64
+	}
+	err := json.Unmarshal([]byte(span.TimelineJSON()), &timeline)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, origin, timeline.Started.UTC())
+	assert.Equal(t, map[string]float64{"start": 10, "finish": 30}, timeline.SubSpans["client.render"])
+}
+
 func TestIncrement(t *testing.T) {
 	span := NewSpan("")
 	assert.T(t, span != nil)
@@ -72,6 +111,29 @@ func TestIncrement(t *testing.T) {
 	assert.Equal(t, int64(3), span.Increment("test"))
 }
 
+func TestCounter(t *testing.T) {
+	span := NewSpan("")
+	span.Add("rows", 40)
+	span.Increment("rows")
+	rows, ok := span.Counter("rows")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, int64(41), rows)
+	_, ok = span.Counter("missing")
+	assert.Equal(t, false, ok)
+}
+
+func TestSubSpanDuration(t *testing.T) {
+	span := NewSpan("")
+	span.SubSpanWithDuration("db", 12.5)
+	duration, ok := span.SubSpanDuration("db")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, 12500*time.Microsecond, duration)
+	_, ok = span.SubSpanDuration("missing")
+	assert.Equal(t, false, ok)
+	// looking doesn't create it
+	assert.Equal(t, 1, len(span.SubSpans))
+}
+
 func TestAttr(t *testing.T) {
 	span := NewSpan("")
 	assert.T(t, span != nil)
@@ -81,6 +143,23 @@ func TestAttr(t *testing.T) {
 	assert.Equal(t, 2, len(span.Attrs))
 }
 
+func TestGetAttr(t *testing.T) {
+	span := NewSpan("")
+	span.Attr("command", "GET")
+	span.SetTag("response", "OK")
+	v, ok := span.GetAttr("command")
+	assert.T(t, ok)
+	assert.Equal(t, "GET", v)
+	v, ok = span.GetAttr("missing")
+	assert.T(t, !ok)
+	assert.Equal(t, "", v)
+	attrs := span.Attributes()
+	assert.Equal(t, map[string]string{"command": "GET", "response": "OK"}, attrs)
+	attrs["command"] = "SET"
+	v, _ = span.GetAttr("command")
+	assert.Equal(t, "GET", v)
+}
+
 func TestString(t *testing.T) {
 	span := NewSpan("")
 	assert.T(t, span != nil)
@@ -0,0 +1,110 @@
+package tcpez
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A Code says what kind of error a request failed with, so clients can
+// branch on it. The codes are numbered like gRPC's status codes.
+type Code byte
+
+const (
+	CodeCanceled           Code = 1
+	CodeUnknown            Code = 2
+	CodeInvalidArgument    Code = 3
+	CodeDeadlineExceeded   Code = 4
+	CodeNotFound           Code = 5
+	CodeAlreadyExists      Code = 6
+	CodePermissionDenied   Code = 7
+	CodeResourceExhausted  Code = 8
+	CodeFailedPrecondition Code = 9
+	CodeAborted            Code = 10
+	CodeUnimplemented      Code = 12
+	CodeInternal           Code = 13
+	CodeUnavailable        Code = 14
+	CodeUnauthenticated    Code = 16
+)
+
+var codeNames = map[Code]string{
+	CodeCanceled:           "Canceled",
+	CodeUnknown:            "Unknown",
+	CodeInvalidArgument:    "InvalidArgument",
+	CodeDeadlineExceeded:   "DeadlineExceeded",
+	CodeNotFound:           "NotFound",
+	CodeAlreadyExists:      "AlreadyExists",
+	CodePermissionDenied:   "PermissionDenied",
+	CodeResourceExhausted:  "ResourceExhausted",
+	CodeFailedPrecondition: "FailedPrecondition",
+	CodeAborted:            "Aborted",
+	CodeUnimplemented:      "Unimplemented",
+	CodeInternal:           "Internal",
+	CodeUnavailable:        "Unavailable",
+	CodeUnauthenticated:    "Unauthenticated",
+}
+
+func (c Code) String() string {
+	if name, ok := codeNames[c]; ok == true {
+		return name
+	}
+	return fmt.Sprintf("Code(%d)", byte(c))
+}
+
+// Retryable reports whether a request that failed with the Code is worth
+// trying again, because the server couldn't handle it right then
+// (CodeUnavailable) or was out of some resource (CodeResourceExhausted)
+// rather than because of the request itself. A Client retries these like it
+// does connection errors, up to its Retries.
+func (c Code) Retryable() bool {
+	return c == CodeUnavailable || c == CodeResourceExhausted
+}
+
+// StatusError is an error a RequestHandler can return to fail a request with
+// a Code. Rather than closing the connection, like it does for other errors,
+// the server answers the request with an error frame and the client gets a
+// RemoteError with the same Code and Message back.
+//
+//        func (h *MyHandler) Respond(req []byte, span *tcpez.Span) ([]byte, error) {
+//                user, ok := h.users[string(req)]
+//                if ok == false {
+//                        return nil, tcpez.NewStatusError(tcpez.CodeNotFound, "no such user")
+//                }
+//                return user, nil
+//        }
+//
+// Pipelined requests that fail with one get an empty response, like any
+// other failed request in a pipeline.
+type StatusError struct {
+	Code    Code
+	Message string
+	// err is the error the StatusError stands for, if there's one, so it
+	// still matches it with errors.Is
+	err error
+}
+
+// NewStatusError returns a StatusError with code and message.
+func NewStatusError(code Code, message string) error {
+	return &StatusError{Code: code, Message: message}
+}
+
+func (e *StatusError) Error() string {
+	return e.Code.String() + ": " + e.Message
+}
+
+// Unwrap returns the error the StatusError stands for, if there's one.
+func (e *StatusError) Unwrap() error {
+	return e.err
+}
+
+// statusError returns the StatusError to answer a failed request with in an
+// error frame, or nil when the connection should be closed instead
+func statusError(err error) *StatusError {
+	if err == errHandlerTimeout {
+		return &StatusError{Code: CodeDeadlineExceeded, Message: err.Error()}
+	}
+	var status *StatusError
+	if errors.As(err, &status) == true {
+		return status
+	}
+	return nil
+}
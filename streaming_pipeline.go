@@ -0,0 +1,188 @@
+package tcpez
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// streamingPipelineWindow is the default, and the largest, MaxInflight of a
+// StreamingPipeline.
+const streamingPipelineWindow = 1024
+
+// ErrPipelineClosed is returned when sending on a StreamingPipeline that
+// has been closed.
+var ErrPipelineClosed = errors.New("tcpez: pipeline closed")
+
+// PipelineResponse is a single response (or the error reading it) delivered
+// by a StreamingPipeline.
+type PipelineResponse struct {
+	Response []byte
+	Err      error
+}
+
+// StreamingPipeline pipelines requests over a single connection without
+// waiting for a Flush. Each request is written to the connection as soon as
+// it is sent, while a background goroutine reads the responses and delivers
+// them, in the order the requests were sent, on Responses(). This keeps the
+// connection busy in both directions for producer/consumer workloads.
+//
+//        p, _ := c.StreamingPipeline()
+//        go func() {
+//                for _, req := range requests {
+//                        p.Send(req)
+//                }
+//                p.Close()
+//        }()
+//        for r := range p.Responses() {
+//                r.Response //=> []byte{"PONG"}
+//        }
+//
+type StreamingPipeline struct {
+	// MaxInflight is the number of requests that can have been sent
+	// without their responses having been read off the connection yet, 1024
+	// by default. Send blocks once it's reached until a response arrives,
+	// so neither end buffers more than that many. It can be lowered but not
+	// raised past the default: values over 1024 are clamped to 1024, and 0
+	// or less means the default.
+	MaxInflight int
+	inflight    int
+	window      *sync.Cond
+	client      *Client
+	conn        *PooledConn
+	sent        chan struct{}
+	responses   chan PipelineResponse
+	closed      bool
+	err         error
+	errLock     sync.Mutex
+	sync.Mutex
+}
+
+// StreamingPipeline takes a connection from the pool and starts a new
+// StreamingPipeline on it. The connection is returned to the pool once the
+// pipeline is closed and all of its responses have been read.
+func (c *Client) StreamingPipeline() (p *StreamingPipeline, err error) {
+	conn, err := c.pool.Take()
+	if err != nil {
+		return nil, err
+	}
+	p = &StreamingPipeline{
+		MaxInflight: streamingPipelineWindow,
+		window:      sync.NewCond(new(sync.Mutex)),
+		client:      c,
+		conn:        conn,
+		sent:        make(chan struct{}, streamingPipelineWindow),
+		responses:   make(chan PipelineResponse, streamingPipelineWindow),
+	}
+	go p.read()
+	return p, nil
+}
+
+// Send writes a request to the connection. Its response is delivered on
+// Responses() after the responses of all the requests sent before it. It
+// blocks while MaxInflight requests are waiting on their responses.
+func (p *StreamingPipeline) Send(req []byte) (err error) {
+	p.Lock()
+	defer p.Unlock()
+	if p.closed == true {
+		return ErrPipelineClosed
+	}
+	if err = p.failure(); err != nil {
+		return err
+	}
+	p.acquire()
+	p.conn.SetWriteDeadline(time.Now().Add(DefaultRequestTimeout))
+	_, err = writeFrame(req, p.conn, p.conn.features)
+	if err != nil {
+		p.release()
+		p.fail(err)
+		return err
+	}
+	p.sent <- struct{}{}
+	return nil
+}
+
+// acquire waits for room in the window for another request
+func (p *StreamingPipeline) acquire() {
+	p.window.L.Lock()
+	defer p.window.L.Unlock()
+	for p.inflight >= p.maxInflight() {
+		p.window.Wait()
+	}
+	p.inflight++
+}
+
+// maxInflight is the MaxInflight in effect, the default when it isn't over 0
+// and at most the default, which is all the responses channel can buffer
+func (p *StreamingPipeline) maxInflight() int {
+	if p.MaxInflight <= 0 || p.MaxInflight > streamingPipelineWindow {
+		return streamingPipelineWindow
+	}
+	return p.MaxInflight
+}
+
+// release makes room in the window once a request's response has been read
+func (p *StreamingPipeline) release() {
+	p.window.L.Lock()
+	defer p.window.L.Unlock()
+	p.inflight--
+	p.window.Signal()
+}
+
+// Responses returns the channel responses are delivered on. It is closed
+// after the pipeline is closed and the responses to all the requests sent
+// have been delivered.
+func (p *StreamingPipeline) Responses() <-chan PipelineResponse {
+	return p.responses
+}
+
+// Close stops the pipeline from sending any more requests. Responses to the
+// requests already sent are still delivered.
+func (p *StreamingPipeline) Close() error {
+	p.Lock()
+	defer p.Unlock()
+	if p.closed == true {
+		return ErrPipelineClosed
+	}
+	p.closed = true
+	close(p.sent)
+	return nil
+}
+
+func (p *StreamingPipeline) read() {
+	var err error
+	for range p.sent {
+		var res []byte
+		if err == nil {
+			p.conn.SetReadDeadline(time.Now().Add(DefaultRequestTimeout))
+			res, err = p.client.readResponse(p.conn)
+			if err != nil {
+				// the stream can't be trusted after a failed read, fail
+				// every request still outstanding
+				p.fail(err)
+			}
+		}
+		p.release()
+		p.responses <- PipelineResponse{Response: res, Err: err}
+	}
+	if p.failure() != nil {
+		p.client.pool.Discard(p.conn)
+	} else {
+		p.client.pool.Return(p.conn)
+	}
+	close(p.responses)
+}
+
+func (p *StreamingPipeline) fail(err error) {
+	p.errLock.Lock()
+	defer p.errLock.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+func (p *StreamingPipeline) failure() error {
+	p.errLock.Lock()
+	defer p.errLock.Unlock()
+	return p.err
+}
@@ -0,0 +1,34 @@
+package tcpez
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// testClientAddress is the address TestClient's pool dials, its connections
+// never leave the process so it's only used as the pool's key.
+const testClientAddress = "tcpez.test"
+
+// TestClient returns a Client whose requests are served by handler in the
+// same process, over in-memory connections from net.Pipe rather than
+// sockets. Each connection the Client dials gets its own server side, run
+// exactly as a Server would run an accepted connection, so single requests,
+// pipelines and streaming pipelines all go through the real protocol. It
+// makes handler tests fast and means they don't need a free port.
+//
+//        c := tcpez.TestClient(myHandler)
+//        defer c.Close()
+//        resp, err := c.SendRecv([]byte("PING"))
+//
+func TestClient(handler RequestHandler) *Client {
+	s := newServer(handler)
+	pool, _ := NewConnectionPool([]string{testClientAddress}, 0, DefaultRequestTimeout)
+	var id int32
+	pool.Dialer = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		client, server := net.Pipe()
+		go s.handle(server, int(atomic.AddInt32(&id, 1)))
+		return client, nil
+	}
+	return NewClientWithPool(pool)
+}
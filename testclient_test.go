@@ -0,0 +1,195 @@
+package tcpez
+
+import (
+	"context"
+	"fmt"
+	"github.com/bmizerany/assert"
+	"github.com/golang/protobuf/proto"
+	"strings"
+	"testing"
+)
+
+func TestTestClientProtoHandler(t *testing.T) {
+	requestFunc := ProtoInitializerFunc(func() proto.Message {
+		return new(Request)
+	})
+	responseFunc := ProtoInitializerFunc(func() proto.Message {
+		return new(Response)
+	})
+	handlerFunc := ProtoHandlerFunc(func(req proto.Message, res proto.Message, span *Span) {
+		r := req.(*Request)
+		response := res.(*Response)
+		response.Status = proto.String("OK")
+		response.Message = proto.String(fmt.Sprintf("%s %s", r.GetCommand(), r.GetArgs()))
+	})
+	c := TestClient(NewProtoHandler(requestFunc, responseFunc, handlerFunc))
+	defer c.Close()
+
+	req, _ := proto.Marshal(&Request{Command: proto.String("GET"), Args: proto.String("/")})
+	resp, err := c.SendRecv(req)
+	assert.Equal(t, nil, err)
+	response := new(Response)
+	assert.Equal(t, nil, proto.Unmarshal(resp, response))
+	assert.Equal(t, "OK", response.GetStatus())
+	assert.Equal(t, "GET /", response.GetMessage())
+
+	pipe := c.Pipeline()
+	for i := 0; i < 10; i++ {
+		req, _ := proto.Marshal(&Request{Command: proto.String("GET"), Args: proto.String(fmt.Sprintf("/%d", i))})
+		pipe.Send(req)
+	}
+	resps, err := pipe.Flush()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 10, len(resps))
+	for i, resp := range resps {
+		response := new(Response)
+		assert.Equal(t, nil, proto.Unmarshal(resp, response))
+		assert.Equal(t, fmt.Sprintf("GET /%d", i), response.GetMessage())
+	}
+}
+
+func TestTestClientConcurrent(t *testing.T) {
+	c := TestClient(new(EchoHandler))
+	defer c.Close()
+	done := make(chan error)
+	for i := 0; i < 5; i++ {
+		go func(i int) {
+			req := []byte(fmt.Sprintf("PING %d", i))
+			resp, err := c.SendRecv(req)
+			if err == nil && string(resp) != string(req) {
+				err = fmt.Errorf("got %q for %q", resp, req)
+			}
+			done <- err
+		}(i)
+	}
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, nil, <-done)
+	}
+}
+
+func TestProtoHandlerNoFieldBleed(t *testing.T) {
+	requestFunc := ProtoInitializerFunc(func() proto.Message {
+		return new(Request)
+	})
+	responseFunc := ProtoInitializerFunc(func() proto.Message {
+		return new(Response)
+	})
+	// each command only sets one of the response's fields, anything else
+	// in the response was left over from an earlier request
+	handlerFunc := ProtoHandlerFunc(func(req proto.Message, res proto.Message, span *Span) {
+		r := req.(*Request)
+		response := res.(*Response)
+		switch r.GetCommand() {
+		case "status":
+			response.Status = proto.String(r.GetArgs())
+		case "message":
+			response.Message = proto.String("args:" + r.GetArgs())
+		}
+	})
+	c := TestClient(NewProtoHandler(requestFunc, responseFunc, handlerFunc))
+	defer c.Close()
+
+	done := make(chan error)
+	for g := 0; g < 8; g++ {
+		go func(g int) {
+			var err error
+			for i := 0; i < 50 && err == nil; i++ {
+				request := &Request{Command: proto.String("message")}
+				if i%2 == 0 {
+					request = &Request{Command: proto.String("status"), Args: proto.String(fmt.Sprintf("%d-%d", g, i))}
+				}
+				req, _ := proto.Marshal(request)
+				var resp []byte
+				resp, err = c.SendRecv(req)
+				if err != nil {
+					break
+				}
+				response := new(Response)
+				err = proto.Unmarshal(resp, response)
+				if err != nil {
+					break
+				}
+				if i%2 == 0 && (response.GetStatus() != request.GetArgs() || response.Message != nil) {
+					err = fmt.Errorf("status response %d-%d bled: %v", g, i, response)
+				}
+				if i%2 == 1 && (response.GetMessage() != "args:" || response.Status != nil) {
+					err = fmt.Errorf("message response %d-%d bled: %v", g, i, response)
+				}
+			}
+			done <- err
+		}(g)
+	}
+	for g := 0; g < 8; g++ {
+		assert.Equal(t, nil, <-done)
+	}
+}
+
+func TestProtoResponseHandlerType(t *testing.T) {
+	requestFunc := ProtoInitializerFunc(func() proto.Message {
+		return new(Request)
+	})
+	responseFunc := ProtoInitializerFunc(func() proto.Message {
+		return new(Response)
+	})
+	handlerFunc := ProtoResponseFunc(func(ctx context.Context, req proto.Message, res proto.Message, span *Span) (proto.Message, error) {
+		r := req.(*Request)
+		if r.GetCommand() == "ECHO" {
+			// answer with a message of another type
+			return &Request{Command: proto.String("ECHOED"), Args: r.Args}, nil
+		}
+		// panics if anything but a Response got into the pool
+		res.(*Response).Status = proto.String("OK")
+		return res, nil
+	})
+	c := TestClient(NewProtoResponseHandler(requestFunc, responseFunc, handlerFunc))
+	defer c.Close()
+
+	for i := 0; i < 10; i++ {
+		req, _ := proto.Marshal(&Request{Command: proto.String("ECHO"), Args: proto.String("hi")})
+		resp, err := c.SendRecv(req)
+		assert.Equal(t, nil, err)
+		echoed := new(Request)
+		assert.Equal(t, nil, proto.Unmarshal(resp, echoed))
+		assert.Equal(t, "ECHOED", echoed.GetCommand())
+		assert.Equal(t, "hi", echoed.GetArgs())
+
+		req, _ = proto.Marshal(&Request{Command: proto.String("GET")})
+		resp, err = c.SendRecv(req)
+		assert.Equal(t, nil, err)
+		response := new(Response)
+		assert.Equal(t, nil, proto.Unmarshal(resp, response))
+		assert.Equal(t, "OK", response.GetStatus())
+	}
+}
+
+func TestProtoServerLogMessages(t *testing.T) {
+	requestFunc := ProtoInitializerFunc(func() proto.Message {
+		return new(Request)
+	})
+	responseFunc := ProtoInitializerFunc(func() proto.Message {
+		return new(Response)
+	})
+	handlerFunc := ProtoHandlerFunc(func(req proto.Message, res proto.Message, span *Span) {
+		res.(*Response).Status = proto.String("OK")
+	})
+	handler := NewProtoHandler(requestFunc, responseFunc, handlerFunc)
+	logged := make(chan string, 10)
+	handler.logMessages = func(line string) {
+		logged <- line
+	}
+	c := TestClient(handler)
+	defer c.Close()
+	req, _ := proto.Marshal(&Request{Command: proto.String("GET"), Args: proto.String("/")})
+
+	// nothing is logged by default
+	_, err := c.SendRecv(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(logged))
+
+	handler.LogMessages(1.0)
+	_, err = c.SendRecv(req)
+	assert.Equal(t, nil, err)
+	line := <-logged
+	assert.T(t, strings.Contains(line, `request: command:"GET" args:"/"`), line)
+	assert.T(t, strings.Contains(line, `response: status:"OK"`), line)
+}
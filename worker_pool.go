@@ -0,0 +1,50 @@
+package tcpez
+
+import (
+	"sync"
+)
+
+// workerPool runs tasks on a fixed set of goroutines, see
+// Server.WorkerPoolSize
+type workerPool struct {
+	tasks chan func()
+	done  chan struct{}
+	stop  sync.Once
+}
+
+func newWorkerPool(size int) *workerPool {
+	p := &workerPool{tasks: make(chan func()), done: make(chan struct{})}
+	for i := 0; i < size; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) work() {
+	for {
+		select {
+		case task := <-p.tasks:
+			task()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// submit runs task on the first worker that's free, waiting for one if they
+// are all busy. Once the pool is stopped tasks get a goroutine of their own
+// instead.
+func (p *workerPool) submit(task func()) {
+	select {
+	case p.tasks <- task:
+	case <-p.done:
+		go task()
+	}
+}
+
+// close stops the workers once they're done with their current tasks
+func (p *workerPool) close() {
+	p.stop.Do(func() {
+		close(p.done)
+	})
+}
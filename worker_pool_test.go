@@ -0,0 +1,47 @@
+package tcpez
+
+import (
+	"github.com/bmizerany/assert"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolBoundsConcurrency(t *testing.T) {
+	p := newWorkerPool(2)
+	defer p.close()
+	var running, most int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		p.submit(func() {
+			defer wg.Done()
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&most)
+				if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		})
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&most))
+}
+
+func TestWorkerPoolClosed(t *testing.T) {
+	p := newWorkerPool(1)
+	p.close()
+	p.close()
+	// tasks submitted after close still run
+	done := make(chan bool)
+	p.submit(func() { done <- true })
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("task submitted after close never ran")
+	}
+}